@@ -13,25 +13,62 @@ const (
 )
 
 type Payment struct {
-	ID        string
-	AccountID int64
-	Amount    Money
-	Category  PaymentCategory
-	Status    PaymentStatus
+	ID        string          `json:"id"`
+	AccountID int64           `json:"account_id"`
+	Amount    Money           `json:"amount"`
+	Category  PaymentCategory `json:"category"`
+	Status    PaymentStatus   `json:"status"`
+	// Created is the Unix time in seconds the payment was made at.
+	Created int64 `json:"created"`
+	// RiskHits are the risk rules that sent the payment to manual review.
+	RiskHits []string `json:"risk_hits,omitempty"`
 }
 
 type Phone string
 
 type Account struct {
-	ID      int64
-	Phone   Phone
-	Balance Money
+	ID      int64 `json:"id"`
+	Phone   Phone `json:"phone"`
+	Balance Money `json:"balance"`
 }
 
 type Favorite struct {
-	ID        string
-	AccountID int64
-	Name      string
-	Amount    Money
-	Category  PaymentCategory
+	ID        string          `json:"id"`
+	AccountID int64           `json:"account_id"`
+	Name      string          `json:"name"`
+	Amount    Money           `json:"amount"`
+	Category  PaymentCategory `json:"category"`
+}
+
+type DepositSource string
+
+const (
+	DepositSourceCashTerminal DepositSource = "CASH_TERMINAL"
+	DepositSourceBankCard     DepositSource = "BANK_CARD"
+	DepositSourceTransfer     DepositSource = "TRANSFER"
+	// DepositSourceCashback and DepositSourceRewards are credits of the
+	// rewards program: cashback on a payment and redeemed points.
+	DepositSourceCashback DepositSource = "CASHBACK"
+	DepositSourceRewards  DepositSource = "REWARDS"
+)
+
+type DepositStatus string
+
+const (
+	DepositStatusOk       DepositStatus = "OK"
+	DepositStatusReversed DepositStatus = "REVERSED"
+)
+
+type Deposit struct {
+	ID        string        `json:"id"`
+	AccountID int64         `json:"account_id"`
+	Amount    Money         `json:"amount"`
+	Source    DepositSource `json:"source"`
+	// Reference is the ID of the top-up in the system it came from.
+	Reference string        `json:"reference"`
+	Status    DepositStatus `json:"status"`
+	// Created and Reversed are Unix times in seconds, Reversed is zero until
+	// the deposit is reversed.
+	Created  int64 `json:"created"`
+	Reversed int64 `json:"reversed"`
 }
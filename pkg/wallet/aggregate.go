@@ -0,0 +1,200 @@
+package wallet
+
+import (
+	"context"
+	"github.com/rustamfozilov/wallet/pkg/types"
+)
+
+// Stats is the accumulator of StatsReducer, the default aggregation. Merging is
+// associative and commutative, so parts scanned in parallel give the same
+// result as the sequential pass.
+type Stats struct {
+	Count int
+	Sum   types.Money
+	Min   types.Money
+	Max   types.Money
+}
+
+func (st Stats) Add(amount types.Money) Stats {
+	if st.Count == 0 || amount < st.Min {
+		st.Min = amount
+	}
+	if st.Count == 0 || amount > st.Max {
+		st.Max = amount
+	}
+	st.Count++
+	st.Sum += amount
+	return st
+}
+
+func (st Stats) Merge(other Stats) Stats {
+	if other.Count == 0 {
+		return st
+	}
+	if st.Count == 0 {
+		return other
+	}
+	if other.Min < st.Min {
+		st.Min = other.Min
+	}
+	if other.Max > st.Max {
+		st.Max = other.Max
+	}
+	st.Count += other.Count
+	st.Sum += other.Sum
+	return st
+}
+
+// Avg returns the mean amount truncated toward zero.
+func (st Stats) Avg() types.Money {
+	if st.Count == 0 {
+		return 0
+	}
+	return st.Sum / types.Money(st.Count)
+}
+
+// Reducer folds the payments of a group into an accumulator. Init starts a
+// group, Add folds a payment in and Merge combines the accumulators of two
+// parts. Merge must be associative, parts are merged in order.
+type Reducer struct {
+	Init  func() interface{}
+	Add   func(acc interface{}, payment types.Payment) interface{}
+	Merge func(acc interface{}, other interface{}) interface{}
+}
+
+// StatsReducer is the default reducer, it reduces every group to Stats.
+var StatsReducer = Reducer{
+	Init: func() interface{} { return Stats{} },
+	Add: func(acc interface{}, payment types.Payment) interface{} {
+		return acc.(Stats).Add(payment.Amount)
+	},
+	Merge: func(acc interface{}, other interface{}) interface{} {
+		return acc.(Stats).Merge(other.(Stats))
+	},
+}
+
+// ReducePayments groups payments by key and folds every group with the
+// reducer, scanning the payments with the same chunking as SumPayments. Keys
+// must be comparable.
+func (s *Service) ReducePayments(ctx context.Context, goroutines int,
+	key func(payment types.Payment) interface{}, reducer Reducer,
+) (map[interface{}]interface{}, error) {
+	return s.ReducePaymentsWithProgress(ctx, goroutines, key, reducer, ProgressOptions{})
+}
+
+func (s *Service) ReducePaymentsWithProgress(ctx context.Context, goroutines int,
+	key func(payment types.Payment) interface{}, reducer Reducer, options ProgressOptions,
+) (map[interface{}]interface{}, error) {
+	return s.reduce(ctx, goroutines, options, func(payment *types.Payment) interface{} {
+		return key(*payment)
+	}, reducer)
+}
+
+// AggregatePayments groups payments by key and reduces every group to Stats.
+func (s *Service) AggregatePayments(ctx context.Context, goroutines int,
+	key func(payment types.Payment) string,
+) (map[string]Stats, error) {
+	return s.AggregatePaymentsWithProgress(ctx, goroutines, key, ProgressOptions{})
+}
+
+func (s *Service) AggregatePaymentsWithProgress(ctx context.Context, goroutines int,
+	key func(payment types.Payment) string, options ProgressOptions,
+) (map[string]Stats, error) {
+	groups, err := s.aggregate(ctx, goroutines, options, func(payment *types.Payment) interface{} {
+		return key(*payment)
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]Stats, len(groups))
+	for k, stats := range groups {
+		result[k.(string)] = stats.(Stats)
+	}
+	return result, nil
+}
+
+func (s *Service) StatsByCategory(ctx context.Context, goroutines int) (map[types.PaymentCategory]Stats, error) {
+	groups, err := s.aggregate(ctx, goroutines, ProgressOptions{}, func(payment *types.Payment) interface{} {
+		return payment.Category
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[types.PaymentCategory]Stats, len(groups))
+	for k, stats := range groups {
+		result[k.(types.PaymentCategory)] = stats.(Stats)
+	}
+	return result, nil
+}
+
+func (s *Service) StatsByAccount(ctx context.Context, goroutines int) (map[int64]Stats, error) {
+	groups, err := s.aggregate(ctx, goroutines, ProgressOptions{}, func(payment *types.Payment) interface{} {
+		return payment.AccountID
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[int64]Stats, len(groups))
+	for k, stats := range groups {
+		result[k.(int64)] = stats.(Stats)
+	}
+	return result, nil
+}
+
+func (s *Service) StatsByStatus(ctx context.Context, goroutines int) (map[types.PaymentStatus]Stats, error) {
+	groups, err := s.aggregate(ctx, goroutines, ProgressOptions{}, func(payment *types.Payment) interface{} {
+		return payment.Status
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[types.PaymentStatus]Stats, len(groups))
+	for k, stats := range groups {
+		result[k.(types.PaymentStatus)] = stats.(Stats)
+	}
+	return result, nil
+}
+
+func (s *Service) aggregate(ctx context.Context, goroutines int, options ProgressOptions,
+	key func(payment *types.Payment) interface{},
+) (map[interface{}]interface{}, error) {
+	return s.reduce(ctx, goroutines, options, key, StatsReducer)
+}
+
+// reduce folds every part into its own map and merges the maps in part order
+// once the scan is done.
+func (s *Service) reduce(ctx context.Context, goroutines int, options ProgressOptions,
+	key func(payment *types.Payment) interface{}, reducer Reducer,
+) (map[interface{}]interface{}, error) {
+	size := options.partSize(len(s.payments), goroutines)
+	parts := make([]map[interface{}]interface{}, scanParts(len(s.payments), size))
+	report := newProgressReporter(options.Report, len(parts), len(s.payments), 0)
+	err := scanPayments(ctx, s.payments, goroutines, size,
+		func(part int, payments []*types.Payment) error {
+			groups := make(map[interface{}]interface{})
+			for _, payment := range payments {
+				k := key(payment)
+				acc, ok := groups[k]
+				if !ok {
+					acc = reducer.Init()
+				}
+				groups[k] = reducer.Add(acc, *payment)
+			}
+			parts[part] = groups
+			report.part(part, len(payments), 0, 0)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[interface{}]interface{})
+	for _, groups := range parts {
+		for k, acc := range groups {
+			if merged, ok := result[k]; ok {
+				acc = reducer.Merge(merged, acc)
+			}
+			result[k] = acc
+		}
+	}
+	return result, nil
+}
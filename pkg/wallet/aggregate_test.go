@@ -0,0 +1,136 @@
+package wallet
+
+import (
+	"context"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"reflect"
+	"testing"
+)
+
+// withAggregatePayments adds payments of four accounts in three categories
+// and statuses, some of them negative.
+func withAggregatePayments() testOption {
+	return func(s *testService) {
+		categories := []types.PaymentCategory{"auto", "food", "mobile"}
+		statuses := []types.PaymentStatus{types.PaymentStatusOk, types.PaymentStatusFail, types.PaymentStatusInProgress}
+		for i := 0; i < 100; i++ {
+			s.payments = append(s.payments, &types.Payment{
+				ID:        string(rune('a' + i)),
+				AccountID: int64(i%4 + 1),
+				Amount:    types.Money((i*37)%1000 - 100),
+				Category:  categories[i%len(categories)],
+				Status:    statuses[i%len(statuses)],
+			})
+		}
+	}
+}
+
+func TestStats_Add(t *testing.T) {
+	var st Stats
+	for _, amount := range []types.Money{5, -3, 10} {
+		st = st.Add(amount)
+	}
+	want := Stats{Count: 3, Sum: 12, Min: -3, Max: 10}
+	if st != want {
+		t.Errorf("got: %v, want: %v", st, want)
+	}
+	if st.Avg() != 4 {
+		t.Errorf("invalid avg: %v", st.Avg())
+	}
+	if (Stats{}).Avg() != 0 {
+		t.Errorf("avg of empty stats must be zero")
+	}
+}
+
+func TestService_StatsByCategory_parallelMatchesSequential(t *testing.T) {
+	s := newTestService(withAggregatePayments())
+	ctx := context.Background()
+	want := make(map[types.PaymentCategory]Stats)
+	for _, payment := range s.payments {
+		want[payment.Category] = want[payment.Category].Add(payment.Amount)
+	}
+	for _, goroutines := range []int{0, 1, 3, 8, 1000} {
+		got, err := s.StatsByCategory(ctx, goroutines)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("goroutines %d: got: %v, want: %v", goroutines, got, want)
+		}
+	}
+}
+
+func TestService_StatsByAccountAndStatus(t *testing.T) {
+	s := newTestService(withAggregatePayments())
+	ctx := context.Background()
+	byAccount, err := s.StatsByAccount(ctx, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byStatus, err := s.StatsByStatus(ctx, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := s.SumPayments(1)
+	var accountsSum, statusSum types.Money
+	for _, stats := range byAccount {
+		accountsSum += stats.Sum
+	}
+	for _, stats := range byStatus {
+		statusSum += stats.Sum
+	}
+	if len(byAccount) != 4 || len(byStatus) != 3 {
+		t.Errorf("invalid groups: %v, %v", byAccount, byStatus)
+	}
+	if accountsSum != total || statusSum != total {
+		t.Errorf("group sums %v, %v differ from total %v", accountsSum, statusSum, total)
+	}
+}
+
+func TestService_AggregatePayments_customKey(t *testing.T) {
+	s := newTestService(withAggregatePayments())
+	got, err := s.AggregatePayments(context.Background(), 3, func(payment types.Payment) string {
+		if payment.Amount < 0 {
+			return "refund"
+		}
+		return "charge"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["refund"].Max >= 0 || got["charge"].Min < 0 {
+		t.Errorf("invalid groups: %v", got)
+	}
+	if got["refund"].Count+got["charge"].Count != len(s.payments) {
+		t.Errorf("lost payments: %v", got)
+	}
+}
+
+func TestService_ReducePayments_customReducer(t *testing.T) {
+	s := newTestService(withAggregatePayments())
+	ids := Reducer{
+		Init: func() interface{} { return []string(nil) },
+		Add: func(acc interface{}, payment types.Payment) interface{} {
+			return append(acc.([]string), payment.ID)
+		},
+		Merge: func(acc interface{}, other interface{}) interface{} {
+			return append(acc.([]string), other.([]string)...)
+		},
+	}
+	want := make(map[interface{}]interface{})
+	for _, payment := range s.payments {
+		ids, _ := want[payment.AccountID].([]string)
+		want[payment.AccountID] = append(ids, payment.ID)
+	}
+	for _, goroutines := range []int{1, 3, 8} {
+		got, err := s.ReducePayments(context.Background(), goroutines, func(payment types.Payment) interface{} {
+			return payment.AccountID
+		}, ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("goroutines %d: got: %v, want: %v", goroutines, got, want)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package wallet
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AMLConfig sets the limits the monitor checks. A zero limit turns its rule
+// off.
+type AMLConfig struct {
+	// Threshold raises a case for a single transaction of at least this amount.
+	Threshold types.Money
+	// Window is the period of the rolling aggregates.
+	Window time.Duration
+	// StructuringCount deposits within Window, each below Threshold by at
+	// most StructuringMargin, raise a structuring case.
+	StructuringCount  int
+	StructuringMargin types.Money
+	// AggregateThreshold raises a case when the deposits or the payments of
+	// an account within Window add up to at least this amount.
+	AggregateThreshold types.Money
+}
+
+const (
+	AMLThreshold   = "threshold"
+	AMLStructuring = "structuring"
+	AMLAggregate   = "aggregate"
+)
+
+// AMLTransaction is a deposit or payment the monitor has seen.
+type AMLTransaction struct {
+	Seq       uint64                `json:"seq"`
+	Kind      string                `json:"kind"`
+	AccountID int64                 `json:"account_id"`
+	PaymentID string                `json:"payment_id,omitempty"`
+	DepositID string                `json:"deposit_id,omitempty"`
+	Amount    types.Money           `json:"amount"`
+	Category  types.PaymentCategory `json:"category,omitempty"`
+	Time      time.Time             `json:"time"`
+}
+
+// AMLCase is a suspicion with the transactions that raised it. Further
+// transactions matching an open case within Window are added to it instead
+// of opening a new one.
+type AMLCase struct {
+	ID        string           `json:"id"`
+	AccountID int64            `json:"account_id"`
+	Rule      string           `json:"rule"`
+	Kind      string           `json:"kind"`
+	Reason    string           `json:"reason"`
+	Opened    time.Time        `json:"opened"`
+	Updated   time.Time        `json:"updated"`
+	Evidence  []AMLTransaction `json:"evidence"`
+}
+
+// AMLTotals sums the transactions of an account within the window.
+type AMLTotals struct {
+	Deposits Stats
+	Payments Stats
+}
+
+type AMLMonitor struct {
+	mu     sync.Mutex
+	config AMLConfig
+	recent map[int64][]AMLTransaction
+	cases  []*AMLCase
+}
+
+func NewAMLMonitor(config AMLConfig) *AMLMonitor {
+	return &AMLMonitor{config: config, recent: make(map[int64][]AMLTransaction)}
+}
+
+// Attach subscribes to the deposits and payments of s. The returned function
+// detaches.
+func (m *AMLMonitor) Attach(s *Service) func() {
+	return s.Events().Subscribe(m.Observe)
+}
+
+// Observe checks deposits and payments against the rules. Rejected payments
+// and reversed deposits leave the rolling totals, the cases they raised stay.
+func (m *AMLMonitor) Observe(event Event) {
+	meta := event.Meta()
+	t := AMLTransaction{Seq: meta.Seq, AccountID: meta.AccountID, Time: meta.Time}
+	switch e := event.(type) {
+	case PaymentRejected:
+		m.forget(meta.AccountID, func(t AMLTransaction) bool { return t.PaymentID == e.Payment.ID })
+		return
+	case DepositReversed:
+		m.forget(meta.AccountID, func(t AMLTransaction) bool { return t.DepositID == e.Deposit.ID })
+		return
+	case Deposited:
+		t.Kind, t.DepositID, t.Amount = "deposit", e.Deposit.ID, e.Amount
+	case PaymentCreated:
+		t.Kind, t.PaymentID, t.Amount, t.Category = "payment", e.Payment.ID, e.Payment.Amount, e.Payment.Category
+	case PaymentRepeated:
+		t.Kind, t.PaymentID, t.Amount, t.Category = "payment", e.Payment.ID, e.Payment.Amount, e.Payment.Category
+	default:
+		return
+	}
+	m.observe(t)
+}
+
+func (m *AMLMonitor) observe(t AMLTransaction) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	recent := append(m.window(t.AccountID, t.Time), t)
+	m.recent[t.AccountID] = recent
+
+	c := m.config
+	if c.Threshold > 0 && t.Amount >= c.Threshold {
+		m.raise(t, AMLThreshold, t.Kind+" of "+formatMoney(t.Amount)+" reaches the threshold",
+			[]AMLTransaction{t})
+	}
+	if c.StructuringCount > 0 && t.Kind == "deposit" && nearThreshold(t.Amount, c) {
+		var below []AMLTransaction
+		for _, r := range recent {
+			if r.Kind == "deposit" && nearThreshold(r.Amount, c) {
+				below = append(below, r)
+			}
+		}
+		if len(below) >= c.StructuringCount {
+			m.raise(t, AMLStructuring, strconv.Itoa(len(below))+" deposits just below the threshold", below)
+		}
+	}
+	if c.AggregateThreshold > 0 {
+		var same []AMLTransaction
+		sum := types.Money(0)
+		for _, r := range recent {
+			if r.Kind == t.Kind {
+				same = append(same, r)
+				sum += r.Amount
+			}
+		}
+		if sum >= c.AggregateThreshold {
+			m.raise(t, AMLAggregate, t.Kind+"s of "+formatMoney(sum)+" within the window", same)
+		}
+	}
+}
+
+// raise adds the evidence to an open case of the account, rule and kind
+// updated within the window, or opens a new case.
+func (m *AMLMonitor) raise(t AMLTransaction, rule string, reason string, evidence []AMLTransaction) {
+	for i := len(m.cases) - 1; i >= 0; i-- {
+		c := m.cases[i]
+		if c.AccountID != t.AccountID || c.Rule != rule || c.Kind != t.Kind ||
+			t.Time.Sub(c.Updated) > m.config.Window {
+			continue
+		}
+		for _, e := range evidence {
+			if !containsTransaction(c.Evidence, e.Seq) {
+				c.Evidence = append(c.Evidence, e)
+			}
+		}
+		c.Reason = reason
+		c.Updated = t.Time
+		return
+	}
+	m.cases = append(m.cases, &AMLCase{
+		ID:        uuid.New().String(),
+		AccountID: t.AccountID,
+		Rule:      rule,
+		Kind:      t.Kind,
+		Reason:    reason,
+		Opened:    t.Time,
+		Updated:   t.Time,
+		Evidence:  append([]AMLTransaction(nil), evidence...),
+	})
+}
+
+// window drops the transactions of the account older than the window.
+func (m *AMLMonitor) window(accountID int64, now time.Time) []AMLTransaction {
+	recent := m.recent[accountID]
+	since := now.Add(-m.config.Window)
+	start := 0
+	for start < len(recent) && recent[start].Time.Before(since) {
+		start++
+	}
+	return recent[start:]
+}
+
+// forget drops the matching transactions from the window of the account.
+func (m *AMLMonitor) forget(accountID int64, match func(t AMLTransaction) bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	recent := m.recent[accountID]
+	kept := make([]AMLTransaction, 0, len(recent))
+	for _, t := range recent {
+		if !match(t) {
+			kept = append(kept, t)
+		}
+	}
+	m.recent[accountID] = kept
+}
+
+func (m *AMLMonitor) Totals(accountID int64, now time.Time) AMLTotals {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var aggregate AMLTotals
+	for _, t := range m.window(accountID, now) {
+		if t.Kind == "deposit" {
+			aggregate.Deposits = aggregate.Deposits.Add(t.Amount)
+		} else {
+			aggregate.Payments = aggregate.Payments.Add(t.Amount)
+		}
+	}
+	return aggregate
+}
+
+// Cases returns the cases of an account, zero for every account.
+func (m *AMLMonitor) Cases(accountID int64) []AMLCase {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := make([]AMLCase, 0)
+	for _, c := range m.cases {
+		if accountID == 0 || c.AccountID == accountID {
+			copied := *c
+			copied.Evidence = append([]AMLTransaction(nil), c.Evidence...)
+			result = append(result, copied)
+		}
+	}
+	return result
+}
+
+// WriteAMLReportJSON writes the cases as one JSON document.
+func WriteAMLReportJSON(w io.Writer, cases []AMLCase) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(struct {
+		Cases []AMLCase `json:"cases"`
+	}{cases})
+}
+
+// WriteAMLReportCSV writes a row per piece of evidence, prefixed by its case.
+func WriteAMLReportCSV(w io.Writer, cases []AMLCase) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write([]string{"case_id", "account_id", "rule", "case_kind", "reason", "opened",
+		"seq", "kind", "payment_id", "deposit_id", "amount", "category", "time"})
+	if err != nil {
+		return err
+	}
+	for _, c := range cases {
+		for _, e := range c.Evidence {
+			err = writer.Write([]string{
+				c.ID,
+				strconv.FormatInt(c.AccountID, 10),
+				c.Rule,
+				c.Kind,
+				c.Reason,
+				c.Opened.UTC().Format(time.RFC3339),
+				strconv.FormatUint(e.Seq, 10),
+				e.Kind,
+				e.PaymentID,
+				e.DepositID,
+				formatMoney(e.Amount),
+				string(e.Category),
+				e.Time.UTC().Format(time.RFC3339),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func nearThreshold(amount types.Money, config AMLConfig) bool {
+	return amount < config.Threshold && amount >= config.Threshold-config.StructuringMargin
+}
+
+func containsTransaction(transactions []AMLTransaction, seq uint64) bool {
+	for _, t := range transactions {
+		if t.Seq == seq {
+			return true
+		}
+	}
+	return false
+}
+
+func formatMoney(amount types.Money) string {
+	return strconv.FormatInt(int64(amount), 10)
+}
@@ -0,0 +1,177 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"testing"
+	"time"
+)
+
+func TestAMLMonitor_threshold(t *testing.T) {
+	monitor := NewAMLMonitor(AMLConfig{Threshold: 10_000, Window: 24 * time.Hour})
+	s := newTestService(withClock(time.Unix(1700000000, 0)), withAMLMonitor(monitor))
+	s.addAccounts(t, 0, "1", "2")
+	if err := s.Deposit(1, 40_000); err != nil {
+		t.Fatal(err)
+	}
+	payment, err := s.Pay(1, 10_000, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Pay(1, 9_999, "auto"); err != nil {
+		t.Fatal(err)
+	}
+	cases := monitor.Cases(1)
+	if len(cases) != 2 || cases[0].Rule != AMLThreshold || cases[1].Evidence[0].PaymentID != payment.ID {
+		t.Fatalf("invalid cases: %+v", cases)
+	}
+	// a further payment over the threshold extends the open case
+	*s.clock = s.clock.Add(time.Hour)
+	if _, err := s.Pay(1, 15_000, "auto"); err != nil {
+		t.Fatal(err)
+	}
+	cases = monitor.Cases(1)
+	if len(cases) != 2 || len(cases[1].Evidence) != 2 {
+		t.Fatalf("case not extended: %+v", cases)
+	}
+	if len(monitor.Cases(2)) != 0 {
+		t.Errorf("cases of a quiet account: %+v", monitor.Cases(2))
+	}
+}
+
+func TestAMLMonitor_structuring(t *testing.T) {
+	monitor := NewAMLMonitor(AMLConfig{
+		Threshold:         10_000,
+		Window:            24 * time.Hour,
+		StructuringCount:  3,
+		StructuringMargin: 1_000,
+	})
+	s := newTestService(withClock(time.Unix(1700000000, 0)), withAMLMonitor(monitor))
+	s.addAccounts(t, 0, "1", "2")
+	for _, amount := range []int64{9_500, 5_000, 9_900, 9_000} {
+		if err := s.Deposit(1, types.Money(amount)); err != nil {
+			t.Fatal(err)
+		}
+		*s.clock = s.clock.Add(time.Hour)
+	}
+	cases := monitor.Cases(0)
+	if len(cases) != 1 || cases[0].Rule != AMLStructuring || len(cases[0].Evidence) != 3 {
+		t.Fatalf("invalid cases: %+v", cases)
+	}
+	// a further deposit extends the open case
+	if err := s.Deposit(1, 9_800); err != nil {
+		t.Fatal(err)
+	}
+	cases = monitor.Cases(0)
+	if len(cases) != 1 || len(cases[0].Evidence) != 4 {
+		t.Fatalf("case not extended: %+v", cases)
+	}
+	// deposits out of the window don't count
+	*s.clock = s.clock.Add(48 * time.Hour)
+	if err := s.Deposit(1, 9_800); err != nil {
+		t.Fatal(err)
+	}
+	if len(monitor.Cases(0)) != 1 {
+		t.Errorf("stale deposits raised a case: %+v", monitor.Cases(0))
+	}
+	totals := monitor.Totals(1, *s.clock)
+	if totals.Deposits.Count != 1 || totals.Deposits.Sum != 9_800 {
+		t.Errorf("invalid totals: %+v", totals)
+	}
+}
+
+func TestAMLMonitor_aggregate(t *testing.T) {
+	monitor := NewAMLMonitor(AMLConfig{Window: time.Hour, AggregateThreshold: 1_000})
+	s := newTestService(withClock(time.Unix(1700000000, 0)), withAMLMonitor(monitor))
+	s.addAccounts(t, 0, "1", "2")
+	if err := s.Deposit(2, 5_000); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := s.Pay(2, 300, "auto"); err != nil {
+			t.Fatal(err)
+		}
+		*s.clock = s.clock.Add(time.Minute)
+	}
+	cases := monitor.Cases(2)
+	if len(cases) != 2 || cases[0].Rule != AMLAggregate || cases[1].Rule != AMLAggregate {
+		t.Fatalf("invalid cases: %+v", cases)
+	}
+	if cases[0].Kind != "deposit" || len(cases[1].Evidence) != 4 || cases[1].Evidence[0].Kind != "payment" {
+		t.Errorf("invalid payments case: %+v", cases[1])
+	}
+}
+
+func TestAMLMonitor_returnedMoney(t *testing.T) {
+	monitor := NewAMLMonitor(AMLConfig{Window: time.Hour, AggregateThreshold: 1_000})
+	s := newTestService(withClock(time.Unix(1700000000, 0)), withAMLMonitor(monitor))
+	s.addAccounts(t, 0, "1")
+	deposit, err := s.DepositFrom(1, 900, types.DepositSourceCashTerminal, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment, err := s.Pay(1, 800, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reject(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReverseDeposit(deposit.ID); err != nil {
+		t.Fatal(err)
+	}
+	totals := monitor.Totals(1, *s.clock)
+	if totals.Deposits.Count != 0 || totals.Payments.Count != 0 {
+		t.Errorf("returned money still counted: %+v", totals)
+	}
+	if err := s.Deposit(1, 900); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Pay(1, 800, "auto"); err != nil {
+		t.Fatal(err)
+	}
+	if cases := monitor.Cases(1); len(cases) != 0 {
+		t.Errorf("returned money raised a case: %+v", cases)
+	}
+}
+
+func TestWriteAMLReport(t *testing.T) {
+	monitor := NewAMLMonitor(AMLConfig{Threshold: 100, Window: time.Hour})
+	s := newTestService(withClock(time.Unix(1700000000, 0)), withAMLMonitor(monitor))
+	s.addAccounts(t, 0, "1", "2")
+	if err := s.Deposit(1, 100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Pay(1, 100, "auto"); err != nil {
+		t.Fatal(err)
+	}
+	cases := monitor.Cases(0)
+
+	var buf bytes.Buffer
+	if err := WriteAMLReportJSON(&buf, cases); err != nil {
+		t.Fatal(err)
+	}
+	var report struct {
+		Cases []AMLCase `json:"cases"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Cases) != 2 || report.Cases[1].Evidence[0].Amount != 100 {
+		t.Errorf("invalid report: %+v", report)
+	}
+
+	buf.Reset()
+	if err := WriteAMLReportCSV(&buf, cases); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0][0] != "case_id" || rows[2][7] != "payment" || rows[2][10] != "100" || rows[1][9] == "" {
+		t.Errorf("invalid rows: %v", rows)
+	}
+}
@@ -0,0 +1,261 @@
+package wallet
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrAuditTampered = errors.New("audit log tampered")
+
+// AuditEntry records one call of a mutating Service method. Every entry
+// holds the hash of the previous one, so changing, removing or reordering
+// entries breaks the chain.
+type AuditEntry struct {
+	Seq       uint64            `json:"seq"`
+	Time      time.Time         `json:"time"`
+	Actor     string            `json:"actor"`
+	Operation string            `json:"operation"`
+	AccountID int64             `json:"account_id"`
+	Params    map[string]string `json:"params"`
+	Before    json.RawMessage   `json:"before"`
+	After     json.RawMessage   `json:"after"`
+	// Outcome is "ok" or the error returned by the operation.
+	Outcome  string `json:"outcome"`
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+func (e AuditEntry) hash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditLog is an append-only chain of entries, kept in memory and, when
+// opened with a file, appended to it as JSON Lines.
+type AuditLog struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+	file    *os.File
+}
+
+func NewAuditLog() *AuditLog {
+	return &AuditLog{}
+}
+
+// OpenAuditLog verifies the entries already in filename and appends new
+// ones to it.
+func OpenAuditLog(filename string) (*AuditLog, error) {
+	entries, err := ReadAuditLog(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	err = VerifyAuditEntries(entries)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, dumpFileMode)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{entries: entries, file: file}, nil
+}
+
+func ReadAuditLog(filename string) ([]AuditEntry, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	entries := make([]AuditEntry, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, maxSnapshotString)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var entry AuditEntry
+		err = json.Unmarshal(line, &entry)
+		if err != nil {
+			return nil, fmt.Errorf("%w: entry %d: %v", ErrAuditTampered, len(entries)+1, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// VerifyAuditEntries checks the sequence numbers and the hash chain.
+func VerifyAuditEntries(entries []AuditEntry) error {
+	prev := ""
+	for i, entry := range entries {
+		hash, err := entry.hash()
+		if err != nil {
+			return err
+		}
+		if entry.Seq != uint64(i+1) || entry.PrevHash != prev || entry.Hash != hash {
+			return fmt.Errorf("%w: entry %d", ErrAuditTampered, i+1)
+		}
+		prev = entry.Hash
+	}
+	return nil
+}
+
+func (l *AuditLog) Verify() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return VerifyAuditEntries(l.entries)
+}
+
+func (l *AuditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+func (l *AuditLog) Entries() []AuditEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]AuditEntry(nil), l.entries...)
+}
+
+// Query returns the entries of an account, zero for every account, made in
+// [from, to). Zero times are unbounded.
+func (l *AuditLog) Query(accountID int64, from time.Time, to time.Time) []AuditEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result := make([]AuditEntry, 0)
+	for _, entry := range l.entries {
+		if accountID != 0 && entry.AccountID != accountID {
+			continue
+		}
+		if !from.IsZero() && entry.Time.Before(from) {
+			continue
+		}
+		if !to.IsZero() && !entry.Time.Before(to) {
+			continue
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+func (l *AuditLog) append(entry AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry.Seq = uint64(len(l.entries) + 1)
+	if len(l.entries) > 0 {
+		entry.PrevHash = l.entries[len(l.entries)-1].Hash
+	}
+	hash, err := entry.hash()
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+	if l.file != nil {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		_, err = l.file.Write(append(data, '\n'))
+		if err != nil {
+			return err
+		}
+	}
+	l.entries = append(l.entries, entry)
+	return nil
+}
+
+// SetAuditLog starts recording every mutating call, nil stops.
+func (s *Service) SetAuditLog(auditLog *AuditLog) {
+	s.auditLog = auditLog
+}
+
+// SetActor sets who the following calls are recorded for.
+func (s *Service) SetActor(actor string) {
+	s.actor = actor
+}
+
+// auditTarget names the records an operation reads or changes. They are
+// only looked up when an audit log is set.
+type auditTarget struct {
+	accountID  int64
+	paymentID  string
+	favoriteID string
+	depositID  string
+	counts     bool
+}
+
+// paymentAuditTarget is the payment and its account.
+func (s *Service) paymentAuditTarget(paymentID string) auditTarget {
+	if s.auditLog == nil {
+		return auditTarget{}
+	}
+	target := auditTarget{paymentID: paymentID}
+	if payment, err := s.FindPaymentByID(paymentID); err == nil {
+		target.accountID = payment.AccountID
+	}
+	return target
+}
+
+type auditState struct {
+	Account   *types.Account  `json:"account,omitempty"`
+	Payment   *types.Payment  `json:"payment,omitempty"`
+	Favorite  *types.Favorite `json:"favorite,omitempty"`
+	Deposit   *types.Deposit  `json:"deposit,omitempty"`
+	Accounts  *int            `json:"accounts,omitempty"`
+	Payments  *int            `json:"payments,omitempty"`
+	Favorites *int            `json:"favorites,omitempty"`
+}
+
+func (s *Service) auditState(target auditTarget) json.RawMessage {
+	var state auditState
+	if target.accountID != 0 {
+		if account, err := s.FindAccountByID(target.accountID); err == nil {
+			copied := *account
+			state.Account = &copied
+		}
+	}
+	if target.paymentID != "" {
+		if payment, err := s.FindPaymentByID(target.paymentID); err == nil {
+			copied := *payment
+			state.Payment = &copied
+		}
+	}
+	if target.favoriteID != "" {
+		if favorite, err := s.FindFavoriteByID(target.favoriteID); err == nil {
+			copied := *favorite
+			state.Favorite = &copied
+		}
+	}
+	if target.depositID != "" {
+		if deposit, err := s.FindDepositByID(target.depositID); err == nil {
+			copied := *deposit
+			state.Deposit = &copied
+		}
+	}
+	if target.counts {
+		accounts, payments, favorites := len(s.accounts), len(s.payments), len(s.favorites)
+		state.Accounts, state.Payments, state.Favorites = &accounts, &payments, &favorites
+	}
+	data, _ := json.Marshal(state)
+	return data
+}
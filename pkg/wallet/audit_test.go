@@ -0,0 +1,165 @@
+package wallet
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// auditScenario makes a service audited to auditLog and records a failed
+// deposit and a rejected payment an hour apart.
+func auditScenario(t *testing.T, auditLog *AuditLog) *testService {
+	s := newTestService(withClock(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)), withAuditLog(auditLog))
+	s.SetActor("operator")
+	account, err := s.RegisterAccount("123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	*s.clock = s.clock.Add(time.Hour)
+	if err := s.Deposit(account.ID, 100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RegisterAccount("456"); err != nil {
+		t.Fatal(err)
+	}
+	*s.clock = s.clock.Add(time.Hour)
+	payment, err := s.Pay(account.ID, 30, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reject(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deposit(account.ID, -5); err != ErrAmountMustBePositive {
+		t.Fatalf("want: %v, got: %v", ErrAmountMustBePositive, err)
+	}
+	return s
+}
+
+func TestService_audit(t *testing.T) {
+	auditLog := NewAuditLog()
+	auditScenario(t, auditLog)
+	entries := auditLog.Entries()
+	var operations []string
+	for _, entry := range entries {
+		operations = append(operations, entry.Operation)
+		if entry.Actor != "operator" {
+			t.Errorf("invalid actor: %+v", entry)
+		}
+	}
+	want := "RegisterAccount Deposit RegisterAccount Pay Reject Deposit"
+	if strings.Join(operations, " ") != want {
+		t.Fatalf("got: %v, want: %v", operations, want)
+	}
+	if err := auditLog.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	deposit := entries[1]
+	var before, after auditState
+	if err := json.Unmarshal(deposit.Before, &before); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(deposit.After, &after); err != nil {
+		t.Fatal(err)
+	}
+	if before.Account.Balance != 0 || after.Account.Balance != 100 || deposit.Params["amount"] != "100" {
+		t.Errorf("invalid deposit entry: %+v", deposit)
+	}
+	if entries[4].AccountID != 1 || entries[4].Outcome != "ok" {
+		t.Errorf("invalid reject entry: %+v", entries[4])
+	}
+	if entries[5].Outcome != ErrAmountMustBePositive.Error() {
+		t.Errorf("invalid failed entry: %+v", entries[5])
+	}
+}
+
+func TestAuditLog_Query(t *testing.T) {
+	auditLog := NewAuditLog()
+	auditScenario(t, auditLog)
+	if got := auditLog.Query(2, time.Time{}, time.Time{}); len(got) != 1 || got[0].Operation != "RegisterAccount" {
+		t.Errorf("invalid account entries: %+v", got)
+	}
+	from := time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	if got := auditLog.Query(1, from, to); len(got) != 1 || got[0].Operation != "Deposit" {
+		t.Errorf("invalid range entries: %+v", got)
+	}
+}
+
+func TestAuditLog_file(t *testing.T) {
+	filename := path.Join(t.TempDir(), "audit.jsonl")
+	auditLog, err := OpenAuditLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := auditScenario(t, auditLog)
+	if err := auditLog.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening continues the chain.
+	auditLog, err = OpenAuditLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetAuditLog(auditLog)
+	if err := s.Deposit(1, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := auditLog.Close(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ReadAuditLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 7 {
+		t.Fatalf("got %d entries, want 7", len(entries))
+	}
+	if err := VerifyAuditEntries(entries); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := strings.Replace(string(data), `"amount":"100"`, `"amount":"1000"`, 1)
+	if err := ioutil.WriteFile(filename, []byte(tampered), dumpFileMode); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenAuditLog(filename); !errors.Is(err, ErrAuditTampered) {
+		t.Errorf("want: %v, got: %v", ErrAuditTampered, err)
+	}
+
+	lines := strings.SplitAfter(string(data), "\n")
+	removed := strings.Join(append(lines[:2:2], lines[3:]...), "")
+	if err := ioutil.WriteFile(filename, []byte(removed), dumpFileMode); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenAuditLog(filename); !errors.Is(err, ErrAuditTampered) {
+		t.Errorf("want: %v, got: %v", ErrAuditTampered, err)
+	}
+}
+
+func TestService_audit_import(t *testing.T) {
+	dir := t.TempDir()
+	if err := newTestService(withFormatsData()).ExportFormat(dir, FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	auditLog := NewAuditLog()
+	var s Service
+	s.SetAuditLog(auditLog)
+	if err := s.ImportFormat(dir, FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	entries := auditLog.Entries()
+	if len(entries) != 1 || entries[0].Operation != "Import" || !strings.Contains(string(entries[0].After), `"payments":2`) {
+		t.Errorf("invalid entries: %+v", entries)
+	}
+}
@@ -0,0 +1,257 @@
+package wallet
+
+import (
+	"errors"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrBudgetExceeded = errors.New("budget exceeded")
+var ErrWrongBudget = errors.New("wrong budget")
+
+// DefaultBudgetAlerts are the percentages of the limit alerted at when a
+// budget doesn't set its own.
+var DefaultBudgetAlerts = []int{80, 100}
+
+var budgetColumns = []string{"account_id", "category", "limit", "alerts", "enforce"}
+
+// Budget caps what an account spends on a category in a calendar month
+// (UTC). A zero Limit switches the budget off.
+type Budget struct {
+	AccountID int64                 `json:"account_id"`
+	Category  types.PaymentCategory `json:"category"`
+	Limit     types.Money           `json:"limit"`
+	// Alerts are percentages of Limit, a BudgetAlert is published when the
+	// spending reaches one of them.
+	Alerts []int `json:"alerts,omitempty"`
+	// Enforce makes payments that would exceed Limit fail.
+	Enforce bool `json:"enforce"`
+}
+
+// BudgetStatus is the spending of the month against a budget. Payments that
+// failed or were rejected aren't spending.
+type BudgetStatus struct {
+	Budget
+	Month     time.Time
+	Spent     types.Money
+	Remaining types.Money
+}
+
+// SetBudget creates the budget of the account and category or replaces it.
+func (s *Service) SetBudget(budget Budget) (err error) {
+	op := s.beginOperation("SetBudget", budget.AccountID, map[string]string{
+		"category": string(budget.Category),
+		"limit":    strconv.FormatInt(int64(budget.Limit), 10),
+		"enforce":  strconv.FormatBool(budget.Enforce),
+	}, auditTarget{accountID: budget.AccountID})
+	defer func() { op.end(err, auditTarget{accountID: budget.AccountID}) }()
+	if budget.Limit < 0 {
+		return ErrWrongBudget
+	}
+	for _, alert := range budget.Alerts {
+		if alert <= 0 {
+			return ErrWrongBudget
+		}
+	}
+	_, err = s.FindAccountByID(budget.AccountID)
+	if err != nil {
+		return err
+	}
+	budget.Alerts = append([]int(nil), budget.Alerts...)
+	s.changes.budget(budgetKey(budget.AccountID, budget.Category))
+	for i, b := range s.budgets {
+		if b.AccountID == budget.AccountID && b.Category == budget.Category {
+			s.budgets[i] = &budget
+			return nil
+		}
+	}
+	s.budgets = append(s.budgets, &budget)
+	return nil
+}
+
+// Budgets returns the status of the budgets of the account for the current
+// month.
+func (s *Service) Budgets(accountID int64) ([]BudgetStatus, error) {
+	_, err := s.FindAccountByID(accountID)
+	if err != nil {
+		return nil, err
+	}
+	month := budgetMonth(s.now())
+	statuses := make([]BudgetStatus, 0)
+	for _, budget := range s.budgets {
+		if budget.AccountID != accountID || budget.Limit == 0 {
+			continue
+		}
+		spent := s.spent(accountID, budget.Category, month)
+		statuses = append(statuses, BudgetStatus{
+			Budget:    *budget,
+			Month:     month,
+			Spent:     spent,
+			Remaining: budget.Limit - spent,
+		})
+	}
+	return statuses, nil
+}
+
+func (s *Service) findBudget(accountID int64, category types.PaymentCategory) *Budget {
+	for _, budget := range s.budgets {
+		if budget.AccountID == accountID && budget.Category == category && budget.Limit != 0 {
+			return budget
+		}
+	}
+	return nil
+}
+
+// budgetMonth is the first moment of the month of t in UTC.
+func budgetMonth(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func (s *Service) spent(accountID int64, category types.PaymentCategory, month time.Time) types.Money {
+	start, end := month.Unix(), month.AddDate(0, 1, 0).Unix()
+	spent := types.Money(0)
+	for _, payment := range s.payments {
+		if payment.AccountID == accountID && payment.Category == category &&
+			payment.Status != types.PaymentStatusFail && payment.Created >= start && payment.Created < end {
+			spent += payment.Amount
+		}
+	}
+	return spent
+}
+
+// budgetCheck is the spending of a budget before a payment.
+type budgetCheck struct {
+	budget *Budget
+	month  time.Time
+	spent  types.Money
+}
+
+// checkBudget fails when payment exceeds an enforced budget. The returned
+// check is nil when the account has no budget for the category.
+func (s *Service) checkBudget(payment *types.Payment) (*budgetCheck, error) {
+	budget := s.findBudget(payment.AccountID, payment.Category)
+	if budget == nil {
+		return nil, nil
+	}
+	month := budgetMonth(time.Unix(payment.Created, 0))
+	check := &budgetCheck{budget: budget, month: month, spent: s.spent(payment.AccountID, payment.Category, month)}
+	if budget.Enforce && check.spent+payment.Amount > budget.Limit {
+		return nil, ErrBudgetExceeded
+	}
+	return check, nil
+}
+
+// alertBudget publishes the alerts the committed payment reached.
+func (s *Service) alertBudget(check *budgetCheck, payment *types.Payment) {
+	if check == nil {
+		return
+	}
+	alerts := check.budget.Alerts
+	if len(alerts) == 0 {
+		alerts = DefaultBudgetAlerts
+	}
+	spent := check.spent + payment.Amount
+	for _, percent := range alerts {
+		threshold := check.budget.Limit * types.Money(percent) / 100
+		if check.spent < threshold && spent >= threshold {
+			s.publish(BudgetAlert{
+				EventMeta: s.eventMeta(payment.AccountID),
+				Budget:    *check.budget,
+				Month:     check.month,
+				Percent:   percent,
+				Spent:     spent,
+				PaymentID: payment.ID,
+			})
+		}
+	}
+}
+
+func budgetKey(accountID int64, category types.PaymentCategory) string {
+	return strconv.FormatInt(accountID, 10) + "|" + string(category)
+}
+
+func budgetsTable(budgets []*Budget) table {
+	return table{
+		columns: budgetColumns,
+		rows:    len(budgets),
+		fields:  func(row int) []string { return budgetFields(budgets[row]) },
+		value:   func(row int) interface{} { return budgets[row] },
+	}
+}
+
+func budgetFields(budget *Budget) []string {
+	alerts := make([]string, len(budget.Alerts))
+	for i, alert := range budget.Alerts {
+		alerts[i] = strconv.Itoa(alert)
+	}
+	return []string{
+		strconv.FormatInt(budget.AccountID, 10),
+		string(budget.Category),
+		strconv.FormatInt(int64(budget.Limit), 10),
+		strings.Join(alerts, ","),
+		strconv.FormatBool(budget.Enforce),
+	}
+}
+
+func parseBudgetFields(fields []string, value interface{}) error {
+	if len(fields) < 5 {
+		return ErrWrongLineFormat
+	}
+	accountID, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return err
+	}
+	limit, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return err
+	}
+	var alerts []int
+	if fields[3] != "" {
+		for _, field := range strings.Split(fields[3], ",") {
+			alert, err := strconv.Atoi(field)
+			if err != nil {
+				return err
+			}
+			alerts = append(alerts, alert)
+		}
+	}
+	enforce, err := strconv.ParseBool(fields[4])
+	if err != nil {
+		return err
+	}
+	*value.(*Budget) = Budget{
+		AccountID: accountID,
+		Category:  types.PaymentCategory(fields[1]),
+		Limit:     types.Money(limit),
+		Alerts:    alerts,
+		Enforce:   enforce,
+	}
+	return nil
+}
+
+func (s *Service) budgetRecord(index *importIndex) func(fields []string, data []byte) error {
+	return func(fields []string, data []byte) error {
+		budget := &Budget{}
+		err := decodeRecord(fields, data, budget, parseBudgetFields)
+		if err != nil {
+			s.log().Warn("skipped wrong record", "table", "budgets", "error", err)
+			return nil
+		}
+		s.upsertBudget(index, budget)
+		return nil
+	}
+}
+
+func (s *Service) upsertBudget(index *importIndex, budget *Budget) {
+	key := budgetKey(budget.AccountID, budget.Category)
+	s.changes.budget(key)
+	if i, ok := index.budgets[key]; ok {
+		s.budgets[i] = budget
+		return
+	}
+	index.budgets[key] = len(s.budgets)
+	s.budgets = append(s.budgets, budget)
+}
@@ -0,0 +1,125 @@
+package wallet
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// budgetScenario sets budget on an account with 10 000 and collects the
+// alerts.
+func budgetScenario(t *testing.T, budget Budget) (*testService, *[]BudgetAlert) {
+	s := newTestService(withClock(time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)))
+	s.addAccounts(t, 10_000, "1")
+	if err := s.SetBudget(budget); err != nil {
+		t.Fatal(err)
+	}
+	alerts := make([]BudgetAlert, 0)
+	s.Events().Subscribe(func(event Event) {
+		if alert, ok := event.(BudgetAlert); ok {
+			alerts = append(alerts, alert)
+		}
+	})
+	return s, &alerts
+}
+
+func TestService_Budgets(t *testing.T) {
+	s, alerts := budgetScenario(t, Budget{AccountID: 1, Category: "food", Limit: 1_000})
+	payment, err := s.Pay(1, 700, "food")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Pay(1, 500, "auto"); err != nil {
+		t.Fatal(err)
+	}
+	if len(*alerts) != 0 {
+		t.Fatalf("alerts below 80%%: %+v", *alerts)
+	}
+	if _, err := s.Repeat(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+	if len(*alerts) != 2 || (*alerts)[0].Percent != 80 || (*alerts)[1].Percent != 100 || (*alerts)[1].Spent != 1_400 {
+		t.Errorf("invalid alerts: %+v", *alerts)
+	}
+
+	if err := s.Reject(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+	statuses, err := s.Budgets(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	month := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if len(statuses) != 1 || statuses[0].Spent != 700 || statuses[0].Remaining != 300 || !statuses[0].Month.Equal(month) {
+		t.Errorf("invalid statuses: %+v", statuses)
+	}
+
+	*s.clock = time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	statuses, _ = s.Budgets(1)
+	if statuses[0].Spent != 0 {
+		t.Errorf("spending of the last month: %+v", statuses)
+	}
+}
+
+func TestService_Pay_budgetEnforced(t *testing.T) {
+	s, alerts := budgetScenario(t, Budget{AccountID: 1, Category: "food", Limit: 1_000, Alerts: []int{50}, Enforce: true})
+	payment, err := s.Pay(1, 600, "food")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Pay(1, 500, "food"); err != ErrBudgetExceeded {
+		t.Errorf("want: %v, got: %v", ErrBudgetExceeded, err)
+	}
+	if _, err := s.Repeat(payment.ID); err != ErrBudgetExceeded {
+		t.Errorf("want: %v, got: %v", ErrBudgetExceeded, err)
+	}
+	if account, _ := s.FindAccountByID(1); account.Balance != 9_400 || len(s.payments) != 1 {
+		t.Errorf("refused payment changed state: %d, %d payments", account.Balance, len(s.payments))
+	}
+	if _, err := s.Pay(1, 400, "food"); err != nil {
+		t.Errorf("payment up to the limit refused: %v", err)
+	}
+	if len(*alerts) != 1 || (*alerts)[0].Percent != 50 {
+		t.Errorf("invalid alerts: %+v", *alerts)
+	}
+
+	if err := s.SetBudget(Budget{AccountID: 1, Category: "food"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Pay(1, 500, "food"); err != nil {
+		t.Errorf("switched off budget enforced: %v", err)
+	}
+}
+
+func TestService_SetBudget_errors(t *testing.T) {
+	s := &Service{}
+	if err := s.SetBudget(Budget{AccountID: 1, Category: "food", Limit: 10}); err != ErrAccountNotFound {
+		t.Errorf("want: %v, got: %v", ErrAccountNotFound, err)
+	}
+	if err := s.SetBudget(Budget{AccountID: 1, Category: "food", Limit: -1}); err != ErrWrongBudget {
+		t.Errorf("want: %v, got: %v", ErrWrongBudget, err)
+	}
+	if err := s.SetBudget(Budget{AccountID: 1, Category: "food", Limit: 1, Alerts: []int{0}}); err != ErrWrongBudget {
+		t.Errorf("want: %v, got: %v", ErrWrongBudget, err)
+	}
+}
+
+func TestService_budgets_roundTrip(t *testing.T) {
+	for _, format := range []Format{FormatDump, FormatJSON, FormatCSV, FormatBinary} {
+		s, _ := budgetScenario(t, Budget{AccountID: 1, Category: "food|\"x\"", Limit: 1_000, Alerts: []int{50, 90}})
+		if err := s.SetBudget(Budget{AccountID: 1, Category: "auto", Limit: 10, Enforce: true}); err != nil {
+			t.Fatal(err)
+		}
+		dir := t.TempDir()
+		if err := s.ExportFormat(dir, format); err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		var got Service
+		if err := got.ImportFormat(dir, format); err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		if !reflect.DeepEqual(got.budgets, s.budgets) {
+			t.Errorf("format %d: budgets got: %v, want: %v", format, got.budgets, s.budgets)
+		}
+	}
+}
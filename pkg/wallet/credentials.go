@@ -0,0 +1,485 @@
+package wallet
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"strconv"
+	"time"
+)
+
+var ErrCredentialsNotSet = errors.New("credentials not set")
+var ErrCredentialsSet = errors.New("credentials already set")
+var ErrWeakPIN = errors.New("pin must have at least 4 characters")
+var ErrWrongPIN = errors.New("wrong pin")
+var ErrAccountLocked = errors.New("account locked")
+var ErrWrongResetCode = errors.New("wrong reset code")
+var ErrSessionRequired = errors.New("session required")
+var ErrInvalidSession = errors.New("invalid session")
+
+const (
+	minPINLength     = 4
+	maxPINAttempts   = 5
+	maxResetAttempts = 3
+	pinLockout       = 15 * time.Minute
+	sessionTTL       = 30 * time.Minute
+	resetCodeTTL     = 10 * time.Minute
+	pinSaltSize      = 16
+	pinHashSize      = 32
+)
+
+// pinIterations is the PBKDF2 cost of new hashes. Stored hashes keep the
+// cost they were made with.
+var pinIterations = 100_000
+
+var credentialColumns = []string{"account_id", "salt", "hash", "iterations", "failed_attempts", "locked_until"}
+
+// credential is the PIN or password of an account, hashed with
+// PBKDF2-HMAC-SHA256, and its lockout state.
+type credential struct {
+	AccountID      int64  `json:"account_id"`
+	Salt           string `json:"salt"`
+	Hash           string `json:"hash"`
+	Iterations     int    `json:"iterations"`
+	FailedAttempts int    `json:"failed_attempts"`
+	// LockedUntil is the Unix time in seconds verification is refused until.
+	LockedUntil int64 `json:"locked_until"`
+}
+
+// Session is an authenticated account. Its methods are the mutating
+// operations of the account and work until the session expires or logs out.
+type Session struct {
+	Token     string
+	AccountID int64
+	Expires   time.Time
+	s         *Service
+}
+
+type pinReset struct {
+	code     string
+	expires  time.Time
+	attempts int
+}
+
+func (s *Service) SetPIN(accountID int64, pin string) (err error) {
+	op := s.beginOperation("SetPIN", accountID, nil, auditTarget{accountID: accountID})
+	defer func() { op.end(err, auditTarget{accountID: accountID}) }()
+	_, err = s.FindAccountByID(accountID)
+	if err != nil {
+		return err
+	}
+	if s.findCredential(accountID) != nil {
+		return ErrCredentialsSet
+	}
+	c := &credential{AccountID: accountID}
+	err = c.set(pin)
+	if err != nil {
+		return err
+	}
+	s.credentials = append(s.credentials, c)
+	s.changes.credential(accountID)
+	return nil
+}
+
+// VerifyPIN locks the account for pinLockout after maxPINAttempts wrong PINs
+// in a row. A locked account fails with ErrAccountLocked even for the right
+// PIN.
+func (s *Service) VerifyPIN(accountID int64, pin string) (err error) {
+	op := s.beginOperation("VerifyPIN", accountID, nil, auditTarget{accountID: accountID})
+	defer func() { op.end(err, auditTarget{accountID: accountID}) }()
+	return s.verifyPIN(accountID, pin)
+}
+
+func (s *Service) verifyPIN(accountID int64, pin string) error {
+	c := s.findCredential(accountID)
+	if c == nil {
+		return ErrCredentialsNotSet
+	}
+	now := s.now().Unix()
+	if c.LockedUntil > now {
+		return ErrAccountLocked
+	}
+	s.changes.credential(accountID)
+	if !c.check(pin) {
+		c.FailedAttempts++
+		if c.FailedAttempts >= maxPINAttempts {
+			c.FailedAttempts = 0
+			c.LockedUntil = now + int64(pinLockout/time.Second)
+		}
+		return ErrWrongPIN
+	}
+	c.FailedAttempts = 0
+	c.LockedUntil = 0
+	return nil
+}
+
+// ChangePIN logs out every session of the account.
+func (s *Service) ChangePIN(accountID int64, oldPIN string, newPIN string) (err error) {
+	op := s.beginOperation("ChangePIN", accountID, nil, auditTarget{accountID: accountID})
+	defer func() { op.end(err, auditTarget{accountID: accountID}) }()
+	err = s.verifyPIN(accountID, oldPIN)
+	if err != nil {
+		return err
+	}
+	err = s.findCredential(accountID).set(newPIN)
+	if err != nil {
+		return err
+	}
+	s.logoutAccount(accountID)
+	return nil
+}
+
+// RequestPINReset returns a one-time code for ResetPIN. The caller delivers it
+// to the owner out of band, by SMS for example.
+func (s *Service) RequestPINReset(accountID int64) (code string, err error) {
+	op := s.beginOperation("RequestPINReset", accountID, nil, auditTarget{accountID: accountID})
+	defer func() { op.end(err, auditTarget{accountID: accountID}) }()
+	if s.findCredential(accountID) == nil {
+		return "", ErrCredentialsNotSet
+	}
+	random := make([]byte, 4)
+	_, err = rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	code = fmt.Sprintf("%06d", binary.BigEndian.Uint32(random)%1_000_000)
+	if s.pinResets == nil {
+		s.pinResets = make(map[int64]pinReset)
+	}
+	s.pinResets[accountID] = pinReset{code: code, expires: s.now().Add(resetCodeTTL)}
+	return code, nil
+}
+
+// ResetPIN sets a new PIN with a code from RequestPINReset, unlocks the
+// account and logs out its sessions. After maxResetAttempts wrong codes the
+// reset must be requested again.
+func (s *Service) ResetPIN(accountID int64, code string, newPIN string) (err error) {
+	op := s.beginOperation("ResetPIN", accountID, nil, auditTarget{accountID: accountID})
+	defer func() { op.end(err, auditTarget{accountID: accountID}) }()
+	reset, ok := s.pinResets[accountID]
+	if !ok || s.now().After(reset.expires) {
+		return ErrWrongResetCode
+	}
+	if subtle.ConstantTimeCompare([]byte(reset.code), []byte(code)) != 1 {
+		reset.attempts++
+		if reset.attempts >= maxResetAttempts {
+			delete(s.pinResets, accountID)
+		} else {
+			s.pinResets[accountID] = reset
+		}
+		return ErrWrongResetCode
+	}
+	c := s.findCredential(accountID)
+	if c == nil {
+		return ErrCredentialsNotSet
+	}
+	err = c.set(newPIN)
+	if err != nil {
+		return err
+	}
+	delete(s.pinResets, accountID)
+	s.changes.credential(accountID)
+	s.logoutAccount(accountID)
+	return nil
+}
+
+func (s *Service) Login(accountID int64, pin string) (session *Session, err error) {
+	op := s.beginOperation("Login", accountID, nil, auditTarget{})
+	defer func() { op.end(err, auditTarget{}) }()
+	err = s.verifyPIN(accountID, pin)
+	if err != nil {
+		return nil, err
+	}
+	random := make([]byte, 32)
+	_, err = rand.Read(random)
+	if err != nil {
+		return nil, err
+	}
+	session = &Session{
+		Token:     hex.EncodeToString(random),
+		AccountID: accountID,
+		Expires:   s.now().Add(sessionTTL),
+		s:         s,
+	}
+	if s.sessions == nil {
+		s.sessions = make(map[string]*Session)
+	}
+	s.sessions[tokenKey(session.Token)] = session
+	return session, nil
+}
+
+// Session resumes the session of a token returned by Login.
+func (s *Service) Session(token string) (*Session, error) {
+	session, ok := s.sessions[tokenKey(token)]
+	if !ok {
+		return nil, ErrInvalidSession
+	}
+	if !s.now().Before(session.Expires) {
+		delete(s.sessions, tokenKey(token))
+		return nil, ErrInvalidSession
+	}
+	return session, nil
+}
+
+func (s *Service) Logout(token string) (err error) {
+	session, ok := s.sessions[tokenKey(token)]
+	var accountID int64
+	if ok {
+		accountID = session.AccountID
+	}
+	op := s.beginOperation("Logout", accountID, nil, auditTarget{})
+	defer func() { op.end(err, auditTarget{}) }()
+	if !ok {
+		return ErrInvalidSession
+	}
+	delete(s.sessions, tokenKey(token))
+	return nil
+}
+
+// RequireSessions makes Pay, Repeat, FavoritePayment and PayFromFavorite fail
+// with ErrSessionRequired unless called through a Session of the account.
+func (s *Service) RequireSessions(require bool) {
+	s.requireSessions = require
+}
+
+func (s *Service) checkSession(accountID int64) error {
+	if !s.requireSessions || s.sessionAccountID == accountID {
+		return nil
+	}
+	return ErrSessionRequired
+}
+
+func (s *Service) logoutAccount(accountID int64) {
+	for key, session := range s.sessions {
+		if session.AccountID == accountID {
+			delete(s.sessions, key)
+		}
+	}
+}
+
+func (s *Service) findCredential(accountID int64) *credential {
+	for _, c := range s.credentials {
+		if c.AccountID == accountID {
+			return c
+		}
+	}
+	return nil
+}
+
+// enter checks the session is still valid and lets the operations of its
+// account through checkSession until the returned function is called.
+func (session *Session) enter() (func(), error) {
+	s := session.s
+	_, err := s.Session(session.Token)
+	if err != nil {
+		return nil, err
+	}
+	previous := s.sessionAccountID
+	s.sessionAccountID = session.AccountID
+	return func() { s.sessionAccountID = previous }, nil
+}
+
+func (session *Session) Pay(amount types.Money, category types.PaymentCategory) (*types.Payment, error) {
+	leave, err := session.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return session.s.Pay(session.AccountID, amount, category)
+}
+
+// Repeat, FavoritePayment and PayFromFavorite don't see payments and
+// favorites of other accounts.
+func (session *Session) Repeat(paymentID string) (*types.Payment, error) {
+	leave, err := session.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	payment, err := session.s.FindPaymentByID(paymentID)
+	if err != nil || payment.AccountID != session.AccountID {
+		return nil, ErrPaymentNotFound
+	}
+	return session.s.Repeat(paymentID)
+}
+
+func (session *Session) FavoritePayment(paymentID string, name string) (*types.Favorite, error) {
+	leave, err := session.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	payment, err := session.s.FindPaymentByID(paymentID)
+	if err != nil || payment.AccountID != session.AccountID {
+		return nil, ErrPaymentNotFound
+	}
+	return session.s.FavoritePayment(paymentID, name)
+}
+
+func (session *Session) PayFromFavorite(favoriteID string) (*types.Payment, error) {
+	leave, err := session.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	favorite, err := session.s.FindFavoriteByID(favoriteID)
+	if err != nil || favorite.AccountID != session.AccountID {
+		return nil, ErrFavoriteNotFound
+	}
+	return session.s.PayFromFavorite(favoriteID)
+}
+
+func (session *Session) ChangePIN(oldPIN string, newPIN string) error {
+	_, err := session.s.Session(session.Token)
+	if err != nil {
+		return err
+	}
+	return session.s.ChangePIN(session.AccountID, oldPIN, newPIN)
+}
+
+func (session *Session) Logout() error {
+	return session.s.Logout(session.Token)
+}
+
+func (c *credential) set(pin string) error {
+	if len(pin) < minPINLength {
+		return ErrWeakPIN
+	}
+	salt := make([]byte, pinSaltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return err
+	}
+	c.Salt = hex.EncodeToString(salt)
+	c.Iterations = pinIterations
+	c.Hash = hex.EncodeToString(pbkdf2SHA256([]byte(pin), salt, c.Iterations, pinHashSize))
+	c.FailedAttempts = 0
+	c.LockedUntil = 0
+	return nil
+}
+
+func (c *credential) check(pin string) bool {
+	salt, err := hex.DecodeString(c.Salt)
+	if err != nil {
+		return false
+	}
+	hash, err := hex.DecodeString(c.Hash)
+	if err != nil || c.Iterations <= 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare(pbkdf2SHA256([]byte(pin), salt, c.Iterations, len(hash)), hash) == 1
+}
+
+// pbkdf2SHA256 is PBKDF2 (RFC 8018) with HMAC-SHA256.
+func pbkdf2SHA256(password []byte, salt []byte, iterations int, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	key := make([]byte, 0, keyLen)
+	u := make([]byte, 0, sha256.Size)
+	t := make([]byte, sha256.Size)
+	var counter [4]byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		binary.BigEndian.PutUint32(counter[:], block)
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(counter[:])
+		u = prf.Sum(u[:0])
+		copy(t, u)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// tokenKey is how sessions are kept, so a dump of the memory doesn't hold
+// usable tokens.
+func tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return string(sum[:])
+}
+
+func credentialsTable(credentials []*credential) table {
+	return table{
+		columns: credentialColumns,
+		rows:    len(credentials),
+		fields:  func(row int) []string { return credentialFields(credentials[row]) },
+		value:   func(row int) interface{} { return credentials[row] },
+	}
+}
+
+func credentialFields(c *credential) []string {
+	return []string{
+		strconv.FormatInt(c.AccountID, 10),
+		c.Salt,
+		c.Hash,
+		strconv.Itoa(c.Iterations),
+		strconv.Itoa(c.FailedAttempts),
+		strconv.FormatInt(c.LockedUntil, 10),
+	}
+}
+
+func parseCredentialFields(fields []string, value interface{}) error {
+	if len(fields) < 6 {
+		return ErrWrongLineFormat
+	}
+	accountID, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return err
+	}
+	iterations, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return err
+	}
+	failed, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return err
+	}
+	lockedUntil, err := strconv.ParseInt(fields[5], 10, 64)
+	if err != nil {
+		return err
+	}
+	*value.(*credential) = credential{
+		AccountID:      accountID,
+		Salt:           fields[1],
+		Hash:           fields[2],
+		Iterations:     iterations,
+		FailedAttempts: failed,
+		LockedUntil:    lockedUntil,
+	}
+	return nil
+}
+
+func (s *Service) credentialRecord(index *importIndex) func(fields []string, data []byte) error {
+	return func(fields []string, data []byte) error {
+		c := &credential{}
+		err := decodeRecord(fields, data, c, parseCredentialFields)
+		if err != nil {
+			s.log().Warn("skipped wrong record", "table", "credentials", "error", err)
+			return nil
+		}
+		s.upsertCredential(index, c)
+		return nil
+	}
+}
+
+func (s *Service) upsertCredential(index *importIndex, c *credential) {
+	s.changes.credential(c.AccountID)
+	if i, ok := index.credentials[c.AccountID]; ok {
+		s.credentials[i] = c
+		return
+	}
+	index.credentials[c.AccountID] = len(s.credentials)
+	s.credentials = append(s.credentials, c)
+}
@@ -0,0 +1,280 @@
+package wallet
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// withFastPINs hashes the PINs of the test with a few iterations.
+func withFastPINs(t *testing.T) testOption {
+	return func(s *testService) {
+		iterations := pinIterations
+		pinIterations = 10
+		t.Cleanup(func() { pinIterations = iterations })
+	}
+}
+
+func newCredentialsTestService(t *testing.T, options ...testOption) *testService {
+	s := newTestService(append([]testOption{withClock(time.Unix(1700000000, 0)), withFastPINs(t)}, options...)...)
+	s.addAccounts(t, 1000, "123")
+	if err := s.SetPIN(1, "1234"); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func Test_pbkdf2SHA256(t *testing.T) {
+	// RFC 7914, section 11
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	got := hex.EncodeToString(pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1, 64))
+	if got != want {
+		t.Errorf("got: %v, want: %v", got, want)
+	}
+}
+
+func TestService_VerifyPIN_lockout(t *testing.T) {
+	s := newCredentialsTestService(t)
+	if err := s.SetPIN(1, "5678"); err != ErrCredentialsSet {
+		t.Errorf("want: %v, got: %v", ErrCredentialsSet, err)
+	}
+	if err := s.VerifyPIN(1, "1234"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxPINAttempts; i++ {
+		if err := s.VerifyPIN(1, "0000"); err != ErrWrongPIN {
+			t.Fatalf("attempt %d: want: %v, got: %v", i, ErrWrongPIN, err)
+		}
+	}
+	if err := s.VerifyPIN(1, "1234"); err != ErrAccountLocked {
+		t.Errorf("want: %v, got: %v", ErrAccountLocked, err)
+	}
+	*s.clock = s.clock.Add(pinLockout)
+	if err := s.VerifyPIN(1, "1234"); err != nil {
+		t.Errorf("lockout didn't end: %v", err)
+	}
+	if err := s.VerifyPIN(2, "1234"); err != ErrCredentialsNotSet {
+		t.Errorf("want: %v, got: %v", ErrCredentialsNotSet, err)
+	}
+}
+
+func TestService_ChangeAndResetPIN(t *testing.T) {
+	s := newCredentialsTestService(t)
+	session, err := s.Login(1, "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ChangePIN(1, "0000", "5678"); err != ErrWrongPIN {
+		t.Errorf("want: %v, got: %v", ErrWrongPIN, err)
+	}
+	if err := s.ChangePIN(1, "1234", "12"); err != ErrWeakPIN {
+		t.Errorf("want: %v, got: %v", ErrWeakPIN, err)
+	}
+	if err := s.ChangePIN(1, "1234", "5678"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Session(session.Token); err != ErrInvalidSession {
+		t.Errorf("session survived pin change: %v", err)
+	}
+
+	code, err := s.RequestPINReset(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ResetPIN(1, "wrong", "4321"); err != ErrWrongResetCode {
+		t.Errorf("want: %v, got: %v", ErrWrongResetCode, err)
+	}
+	*s.clock = s.clock.Add(resetCodeTTL + time.Second)
+	if err := s.ResetPIN(1, code, "4321"); err != ErrWrongResetCode {
+		t.Errorf("expired code: want: %v, got: %v", ErrWrongResetCode, err)
+	}
+	code, err = s.RequestPINReset(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ResetPIN(1, code, "4321"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ResetPIN(1, code, "9999"); err != ErrWrongResetCode {
+		t.Errorf("code used twice: %v", err)
+	}
+	if err := s.VerifyPIN(1, "4321"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestService_ResetPIN_attempts(t *testing.T) {
+	auditLog := NewAuditLog()
+	s := newCredentialsTestService(t, withAuditLog(auditLog))
+	session, err := s.Login(1, "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := s.RequestPINReset(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxResetAttempts; i++ {
+		if err := s.ResetPIN(1, "wrong", "4321"); err != ErrWrongResetCode {
+			t.Fatalf("attempt %d: want: %v, got: %v", i, ErrWrongResetCode, err)
+		}
+	}
+	if err := s.ResetPIN(1, code, "4321"); err != ErrWrongResetCode {
+		t.Errorf("code not voided: %v", err)
+	}
+	if err := session.Logout(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Logout(session.Token); err != ErrInvalidSession {
+		t.Errorf("want: %v, got: %v", ErrInvalidSession, err)
+	}
+
+	var operations []string
+	for _, entry := range auditLog.Query(1, time.Time{}, time.Time{}) {
+		if entry.Operation == "ResetPIN" || entry.Operation == "Logout" {
+			operations = append(operations, entry.Operation+" "+entry.Outcome)
+		}
+	}
+	want := []string{"ResetPIN wrong reset code", "ResetPIN wrong reset code", "ResetPIN wrong reset code",
+		"ResetPIN wrong reset code", "Logout ok"}
+	if !reflect.DeepEqual(operations, want) {
+		t.Errorf("got: %v, want: %v", operations, want)
+	}
+}
+
+func TestService_RequireSessions(t *testing.T) {
+	s := newCredentialsTestService(t)
+	other, err := s.addAccountWithBalance("456", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPayment, err := s.Pay(other.ID, 10, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RequireSessions(true)
+	if _, err := s.Pay(1, 10, "auto"); err != ErrSessionRequired {
+		t.Errorf("want: %v, got: %v", ErrSessionRequired, err)
+	}
+	if _, err := s.Login(1, "0000"); err != ErrWrongPIN {
+		t.Errorf("want: %v, got: %v", ErrWrongPIN, err)
+	}
+	session, err := s.Login(1, "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment, err := session.Pay(10, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	favorite, err := session.FavoritePayment(payment.ID, "fuel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.PayFromFavorite(favorite.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Repeat(otherPayment.ID); err != ErrPaymentNotFound {
+		t.Errorf("want: %v, got: %v", ErrPaymentNotFound, err)
+	}
+	if _, err := s.Repeat(payment.ID); err != ErrSessionRequired {
+		t.Errorf("want: %v, got: %v", ErrSessionRequired, err)
+	}
+
+	resumed, err := s.Session(session.Token)
+	if err != nil || resumed.AccountID != 1 {
+		t.Fatalf("invalid session: %v, %v", resumed, err)
+	}
+	*s.clock = s.clock.Add(sessionTTL)
+	if _, err := session.Pay(10, "auto"); err != ErrInvalidSession {
+		t.Errorf("want: %v, got: %v", ErrInvalidSession, err)
+	}
+	account, err := s.FindAccountByID(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance != 980 {
+		t.Errorf("invalid balance: %v", account.Balance)
+	}
+}
+
+func TestService_VerifyPIN_audited(t *testing.T) {
+	auditLog := NewAuditLog()
+	s := newCredentialsTestService(t, withAuditLog(auditLog))
+	for i := 0; i < maxPINAttempts; i++ {
+		if err := s.VerifyPIN(1, "0000"); err != ErrWrongPIN {
+			t.Fatalf("attempt %d: want: %v, got: %v", i, ErrWrongPIN, err)
+		}
+	}
+	if err := s.VerifyPIN(1, "1234"); err != ErrAccountLocked {
+		t.Errorf("want: %v, got: %v", ErrAccountLocked, err)
+	}
+	var outcomes []string
+	for _, entry := range auditLog.Query(1, time.Time{}, time.Time{}) {
+		if entry.Operation == "VerifyPIN" {
+			outcomes = append(outcomes, entry.Outcome)
+		}
+	}
+	if len(outcomes) != maxPINAttempts+1 || outcomes[len(outcomes)-1] != ErrAccountLocked.Error() {
+		t.Errorf("invalid audit: %v", outcomes)
+	}
+}
+
+func TestService_RequireSessions_splitsAndRequests(t *testing.T) {
+	s := newCredentialsTestService(t)
+	s.addAccounts(t, 100, "456")
+	s.RequireSessions(true)
+	request := SplitRequest{AccountID: 1, Total: 100, Category: "food", Shares: []SplitShare{{AccountID: 1}, {AccountID: 2}}}
+	if _, err := s.CreateSplit(request); err != ErrSessionRequired {
+		t.Errorf("want: %v, got: %v", ErrSessionRequired, err)
+	}
+	if _, err := s.RequestPayment(1, "456", 10, "food", ""); err != ErrSessionRequired {
+		t.Errorf("want: %v, got: %v", ErrSessionRequired, err)
+	}
+	session, err := s.Login(1, "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.AccountID = 2
+	split, err := session.CreateSplit(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if split.AccountID != 1 {
+		t.Errorf("split created for account %d", split.AccountID)
+	}
+	if err := s.CancelSplit(split.ID); err != ErrSessionRequired {
+		t.Errorf("want: %v, got: %v", ErrSessionRequired, err)
+	}
+	if err := session.CancelSplit(split.ID); err != nil {
+		t.Error(err)
+	}
+	if _, err := session.RequestPayment("456", 10, "food", "lunch"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestService_credentials_persisted(t *testing.T) {
+	for _, format := range []Format{FormatDump, FormatJSON, FormatCSV, FormatBinaryCompressed} {
+		s := newCredentialsTestService(t)
+		if err := s.VerifyPIN(1, "0000"); err != ErrWrongPIN {
+			t.Fatal(err)
+		}
+		dir := t.TempDir()
+		if err := s.ExportFormat(dir, format); err != nil {
+			t.Fatal(err)
+		}
+		var got Service
+		if err := got.ImportFormat(dir, format); err != nil {
+			t.Fatal(err)
+		}
+		if len(got.credentials) != 1 || got.credentials[0].FailedAttempts != 1 {
+			t.Fatalf("format %d: invalid credentials: %+v", format, got.credentials)
+		}
+		if err := got.VerifyPIN(1, "1234"); err != nil {
+			t.Errorf("format %d: %v", format, err)
+		}
+	}
+}
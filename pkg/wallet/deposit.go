@@ -0,0 +1,250 @@
+package wallet
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"sort"
+	"strconv"
+)
+
+var ErrDepositNotFound = errors.New("deposit not found")
+var ErrDepositReversed = errors.New("deposit already reversed")
+var ErrWrongDepositSource = errors.New("wrong deposit source")
+
+var depositColumns = []string{"id", "account_id", "amount", "source", "reference", "status", "created", "reversed"}
+
+// DepositFrom tops the account up from a cash terminal, a bank card or a
+// transfer. Cashback and redeemed points are credited by the rewards program
+// only. reference is the ID of the top-up in the source system, if it has
+// one.
+func (s *Service) DepositFrom(accountID int64, amount types.Money, source types.DepositSource,
+	reference string,
+) (result *types.Deposit, err error) {
+	op := s.beginOperation("Deposit", accountID, map[string]string{
+		"amount":    strconv.FormatInt(int64(amount), 10),
+		"source":    string(source),
+		"reference": reference,
+	}, auditTarget{accountID: accountID})
+	defer func() {
+		after := auditTarget{accountID: accountID}
+		if result != nil {
+			after.depositID = result.ID
+		}
+		op.end(err, after)
+	}()
+	if amount <= 0 {
+		return nil, ErrAmountMustBePositive
+	}
+	switch source {
+	case types.DepositSourceCashTerminal, types.DepositSourceBankCard, types.DepositSourceTransfer:
+	default:
+		return nil, ErrWrongDepositSource
+	}
+	account, err := s.FindAccountByID(accountID)
+	if err != nil {
+		return nil, err
+	}
+	return s.deposit(account, amount, source, reference), nil
+}
+
+func (s *Service) deposit(account *types.Account, amount types.Money, source types.DepositSource,
+	reference string,
+) *types.Deposit {
+	deposit := &types.Deposit{
+		ID:        uuid.New().String(),
+		AccountID: account.ID,
+		Amount:    amount,
+		Source:    source,
+		Reference: reference,
+		Status:    types.DepositStatusOk,
+		Created:   s.now().Unix(),
+	}
+	account.Balance += amount
+	s.deposits = append(s.deposits, deposit)
+	s.changes.account(account.ID)
+	s.changes.deposit(deposit.ID)
+	s.record(account, LedgerDeposit, amount, nil).DepositID = deposit.ID
+	s.publish(Deposited{EventMeta: s.eventMeta(account.ID), Deposit: *deposit, Amount: amount, Balance: account.Balance})
+	return deposit
+}
+
+func (s *Service) FindDepositByID(depositID string) (*types.Deposit, error) {
+	for _, deposit := range s.deposits {
+		if deposit.ID == depositID {
+			return deposit, nil
+		}
+	}
+	return nil, ErrDepositNotFound
+}
+
+// ReverseDeposit takes the money of a deposit back from the account, even if
+// the balance becomes negative.
+func (s *Service) ReverseDeposit(depositID string) (err error) {
+	target := s.depositAuditTarget(depositID)
+	op := s.beginOperation("ReverseDeposit", target.accountID, map[string]string{"deposit_id": depositID}, target)
+	defer func() { op.end(err, target) }()
+	deposit, err := s.FindDepositByID(depositID)
+	if err != nil {
+		return err
+	}
+	if deposit.Status == types.DepositStatusReversed {
+		return ErrDepositReversed
+	}
+	account, err := s.FindAccountByID(deposit.AccountID)
+	if err != nil {
+		return err
+	}
+	s.reverseDeposit(account, deposit)
+	return nil
+}
+
+func (s *Service) reverseDeposit(account *types.Account, deposit *types.Deposit) {
+	deposit.Status = types.DepositStatusReversed
+	deposit.Reversed = s.now().Unix()
+	account.Balance -= deposit.Amount
+	s.changes.account(account.ID)
+	s.changes.deposit(deposit.ID)
+	s.record(account, LedgerReversal, -deposit.Amount, nil).DepositID = deposit.ID
+	s.publish(DepositReversed{EventMeta: s.eventMeta(account.ID), Deposit: *deposit, Balance: account.Balance})
+}
+
+// depositAuditTarget is the deposit and its account.
+func (s *Service) depositAuditTarget(depositID string) auditTarget {
+	if s.auditLog == nil {
+		return auditTarget{}
+	}
+	target := auditTarget{depositID: depositID}
+	if deposit, err := s.FindDepositByID(depositID); err == nil {
+		target.accountID = deposit.AccountID
+	}
+	return target
+}
+
+// SumDeposits returns the money deposited and not reversed.
+func (s *Service) SumDeposits() types.Money {
+	amount := types.Money(0)
+	for _, deposit := range s.deposits {
+		if deposit.Status != types.DepositStatusReversed {
+			amount += deposit.Amount
+		}
+	}
+	return amount
+}
+
+// Transaction is a payment or a deposit in the history of an account,
+// exactly one of them is set.
+type Transaction struct {
+	Payment *types.Payment
+	Deposit *types.Deposit
+}
+
+func (t Transaction) Created() int64 {
+	if t.Deposit != nil {
+		return t.Deposit.Created
+	}
+	return t.Payment.Created
+}
+
+// ExportAccountTransactions is ExportAccountHistory with the deposits of the
+// account, ordered by time. It is a separate call so ExportAccountHistory
+// keeps returning the payments HistoryToFiles writes. Deposits are dumped by
+// Export and counted by Reconcile.
+func (s *Service) ExportAccountTransactions(accountID int64) ([]Transaction, error) {
+	payments, err := s.ExportAccountHistory(accountID)
+	if err != nil {
+		return nil, err
+	}
+	transactions := make([]Transaction, 0, len(payments))
+	for _, deposit := range s.deposits {
+		if deposit.AccountID == accountID {
+			copied := *deposit
+			transactions = append(transactions, Transaction{Deposit: &copied})
+		}
+	}
+	for i := range payments {
+		transactions = append(transactions, Transaction{Payment: &payments[i]})
+	}
+	sort.SliceStable(transactions, func(i, j int) bool {
+		return transactions[i].Created() < transactions[j].Created()
+	})
+	return transactions, nil
+}
+
+func depositsTable(deposits []*types.Deposit) table {
+	return table{
+		columns: depositColumns,
+		rows:    len(deposits),
+		fields:  func(row int) []string { return depositFields(deposits[row]) },
+		value:   func(row int) interface{} { return deposits[row] },
+	}
+}
+
+func depositFields(deposit *types.Deposit) []string {
+	return []string{
+		deposit.ID,
+		strconv.FormatInt(deposit.AccountID, 10),
+		strconv.FormatInt(int64(deposit.Amount), 10),
+		string(deposit.Source),
+		deposit.Reference,
+		string(deposit.Status),
+		strconv.FormatInt(deposit.Created, 10),
+		strconv.FormatInt(deposit.Reversed, 10),
+	}
+}
+
+func parseDepositFields(fields []string, value interface{}) error {
+	if len(fields) < 8 {
+		return ErrWrongLineFormat
+	}
+	accountID, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return err
+	}
+	amount, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return err
+	}
+	created, err := strconv.ParseInt(fields[6], 10, 64)
+	if err != nil {
+		return err
+	}
+	reversed, err := strconv.ParseInt(fields[7], 10, 64)
+	if err != nil {
+		return err
+	}
+	*value.(*types.Deposit) = types.Deposit{
+		ID:        fields[0],
+		AccountID: accountID,
+		Amount:    types.Money(amount),
+		Source:    types.DepositSource(fields[3]),
+		Reference: fields[4],
+		Status:    types.DepositStatus(fields[5]),
+		Created:   created,
+		Reversed:  reversed,
+	}
+	return nil
+}
+
+func (s *Service) depositRecord(index *importIndex) func(fields []string, data []byte) error {
+	return func(fields []string, data []byte) error {
+		deposit := &types.Deposit{}
+		err := decodeRecord(fields, data, deposit, parseDepositFields)
+		if err != nil {
+			s.log().Warn("skipped wrong record", "table", "deposits", "error", err)
+			return nil
+		}
+		s.upsertDeposit(index, deposit)
+		return nil
+	}
+}
+
+func (s *Service) upsertDeposit(index *importIndex, deposit *types.Deposit) {
+	s.changes.deposit(deposit.ID)
+	if i, ok := index.deposits[deposit.ID]; ok {
+		s.deposits[i] = deposit
+		return
+	}
+	index.deposits[deposit.ID] = len(s.deposits)
+	s.deposits = append(s.deposits, deposit)
+}
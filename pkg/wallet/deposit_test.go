@@ -0,0 +1,153 @@
+package wallet
+
+import (
+	"context"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestService_DepositFrom(t *testing.T) {
+	s := newTestService(withClock(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)))
+	s.addAccounts(t, 0, "1")
+	var events []Event
+	s.Events().Subscribe(func(event Event) { events = append(events, event) })
+	deposit, err := s.DepositFrom(1, 500, types.DepositSourceBankCard, "card-42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := types.Deposit{
+		ID:        deposit.ID,
+		AccountID: 1,
+		Amount:    500,
+		Source:    types.DepositSourceBankCard,
+		Reference: "card-42",
+		Status:    types.DepositStatusOk,
+		Created:   s.clock.Unix(),
+	}
+	if *deposit != want {
+		t.Errorf("got: %+v, want: %+v", *deposit, want)
+	}
+	if len(events) != 1 || events[0].(Deposited).Deposit.ID != deposit.ID {
+		t.Errorf("invalid events: %+v", events)
+	}
+	if _, err := s.DepositFrom(2, 500, types.DepositSourceBankCard, ""); err != ErrAccountNotFound {
+		t.Errorf("want: %v, got: %v", ErrAccountNotFound, err)
+	}
+	if _, err := s.DepositFrom(1, 0, types.DepositSourceBankCard, ""); err != ErrAmountMustBePositive {
+		t.Errorf("want: %v, got: %v", ErrAmountMustBePositive, err)
+	}
+	for _, source := range []types.DepositSource{"", types.DepositSourceCashback, types.DepositSourceRewards} {
+		if _, err := s.DepositFrom(1, 500, source, ""); err != ErrWrongDepositSource {
+			t.Errorf("source %q: want: %v, got: %v", source, ErrWrongDepositSource, err)
+		}
+	}
+	if err := s.Deposit(1, 100); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.deposits) != 2 || s.SumDeposits() != 600 || s.deposits[1].Source != types.DepositSourceCashTerminal {
+		t.Errorf("deposits: %d, sum: %d", len(s.deposits), s.SumDeposits())
+	}
+}
+
+func TestService_ReverseDeposit(t *testing.T) {
+	s := newTestService(withClock(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)))
+	s.addAccounts(t, 0, "1")
+	deposit, err := s.DepositFrom(1, 500, types.DepositSourceCashTerminal, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Pay(1, 400, "auto"); err != nil {
+		t.Fatal(err)
+	}
+	*s.clock = s.clock.Add(time.Hour)
+	if err := s.ReverseDeposit(deposit.ID); err != nil {
+		t.Fatal(err)
+	}
+	account, _ := s.FindAccountByID(1)
+	if account.Balance != -400 || deposit.Status != types.DepositStatusReversed || deposit.Reversed != s.clock.Unix() {
+		t.Errorf("balance: %d, deposit: %+v", account.Balance, deposit)
+	}
+	last := s.ledger[len(s.ledger)-1]
+	if last.Kind != LedgerReversal || last.Amount != -500 || last.DepositID != deposit.ID {
+		t.Errorf("invalid ledger entry: %+v", last)
+	}
+	if err := s.ReverseDeposit(deposit.ID); err != ErrDepositReversed {
+		t.Errorf("want: %v, got: %v", ErrDepositReversed, err)
+	}
+	if err := s.ReverseDeposit("x"); err != ErrDepositNotFound {
+		t.Errorf("want: %v, got: %v", ErrDepositNotFound, err)
+	}
+	if s.SumDeposits() != 0 {
+		t.Errorf("reversed deposit summed: %d", s.SumDeposits())
+	}
+	result, err := s.Reconcile(context.Background(), ReconcileOptions{})
+	if err != nil || len(result.Discrepancies) != 0 {
+		t.Errorf("reversal not reconciled: %+v, %v", result, err)
+	}
+	deposit.Status = types.DepositStatusOk
+	result, err = s.Reconcile(context.Background(), ReconcileOptions{})
+	if err != nil || len(result.Discrepancies) != 1 || result.Discrepancies[0].Difference != -500 {
+		t.Errorf("edited deposit not found: %+v, %v", result, err)
+	}
+}
+
+func TestService_ExportAccountTransactions(t *testing.T) {
+	s := newTestService(withClock(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)))
+	s.addAccounts(t, 0, "1")
+	if err := s.Deposit(1, 100); err != nil {
+		t.Fatal(err)
+	}
+	*s.clock = s.clock.Add(time.Hour)
+	payment, err := s.Pay(1, 50, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	*s.clock = s.clock.Add(time.Hour)
+	if err := s.Deposit(1, 10); err != nil {
+		t.Fatal(err)
+	}
+	transactions, err := s.ExportAccountTransactions(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transactions) != 3 || transactions[1].Payment == nil || transactions[1].Payment.ID != payment.ID ||
+		transactions[2].Deposit == nil || transactions[2].Deposit.Amount != 10 {
+		t.Errorf("invalid transactions: %+v", transactions)
+	}
+	if _, err := s.ExportAccountTransactions(2); err != ErrAccountNotFound {
+		t.Errorf("want: %v, got: %v", ErrAccountNotFound, err)
+	}
+}
+
+func TestService_deposits_roundTrip(t *testing.T) {
+	for _, format := range []Format{FormatDump, FormatJSON, FormatCSV, FormatBinary} {
+		s := newTestService(withClock(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)))
+		s.addAccounts(t, 0, "1")
+		deposit, err := s.DepositFrom(1, 500, types.DepositSourceTransfer, "ref|1;\"x\"")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.ReverseDeposit(deposit.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Deposit(1, 70); err != nil {
+			t.Fatal(err)
+		}
+		dir := t.TempDir()
+		if err := s.ExportFormat(dir, format); err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		var got Service
+		if err := got.ImportFormat(dir, format); err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		if !reflect.DeepEqual(got.deposits, s.deposits) {
+			t.Errorf("format %d: deposits got: %v, want: %v", format, got.deposits, s.deposits)
+		}
+		if !reflect.DeepEqual(got.ledger, s.ledger) {
+			t.Errorf("format %d: ledger got: %v, want: %v", format, got.ledger, s.ledger)
+		}
+	}
+}
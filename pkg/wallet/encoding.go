@@ -0,0 +1,111 @@
+package wallet
+
+import (
+	"io"
+	"strings"
+)
+
+// dumpHeader marks dumps written with escaped fields. Files without it are
+// read in the legacy format, where fields are split on separators as is.
+const dumpHeader = "#wallet-dump v2"
+
+func escapeField(field string) string {
+	if !strings.ContainsAny(field, "\\|;\n\r") {
+		return field
+	}
+	var b strings.Builder
+	b.Grow(len(field) + 4)
+	for i := 0; i < len(field); i++ {
+		switch c := field[i]; c {
+		case '\\', '|', ';':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func unescapeField(field string) string {
+	if !strings.Contains(field, "\\") {
+		return field
+	}
+	var b strings.Builder
+	b.Grow(len(field))
+	for i := 0; i < len(field); i++ {
+		c := field[i]
+		if c != '\\' || i == len(field)-1 {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch field[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		default:
+			b.WriteByte(field[i])
+		}
+	}
+	return b.String()
+}
+
+func joinFields(fields []string, sep byte) string {
+	escaped := make([]string, len(fields))
+	for i, field := range fields {
+		escaped[i] = escapeField(field)
+	}
+	return strings.Join(escaped, string(sep))
+}
+
+// splitRaw splits s on every sep that is not escaped, leaving the escapes
+// in place so the parts can be split again on another separator.
+func splitRaw(s string, sep byte) []string {
+	parts := make([]string, 0, strings.Count(s, string(sep))+1)
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func splitFields(line string, sep byte, escaped bool) []string {
+	if !escaped {
+		return strings.Split(line, string(sep))
+	}
+	fields := splitRaw(line, sep)
+	for i, field := range fields {
+		fields[i] = unescapeField(field)
+	}
+	return fields
+}
+
+// readDumpLines reads newline separated records and reports whether the
+// dump was written in the escaped format.
+func readDumpLines(reader io.Reader) ([]string, bool, error) {
+	data, err := readAll(reader)
+	if err != nil {
+		return nil, false, err
+	}
+	content := strings.ReplaceAll(string(data), "\r\n", "\n")
+	if content == "" {
+		return nil, false, nil
+	}
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	if lines[0] == dumpHeader {
+		return lines[1:], true, nil
+	}
+	return lines, false, nil
+}
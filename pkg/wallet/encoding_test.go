@@ -0,0 +1,168 @@
+package wallet
+
+import (
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+func Test_escapeField_roundTrip(t *testing.T) {
+	f := func(field string) bool {
+		escaped := escapeField(field)
+		return !strings.ContainsAny(escaped, "\n\r") && unescapeField(escaped) == field
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_joinFields_roundTrip(t *testing.T) {
+	f := func(first string, rest []string) bool {
+		fields := append([]string{first}, rest...)
+		for _, sep := range []byte{'|', ';'} {
+			if !reflect.DeepEqual(splitFields(joinFields(fields, sep), sep, true), fields) {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_splitRaw_nested(t *testing.T) {
+	f := func(records [][]string) bool {
+		lines := make([]string, 0, len(records))
+		for _, record := range records {
+			if len(record) == 0 {
+				record = []string{""}
+			}
+			lines = append(lines, joinFields(record, ';'))
+		}
+		joined := strings.Join(lines, "|")
+		if len(lines) == 0 {
+			return true
+		}
+		got := splitRaw(joined, '|')
+		if len(got) != len(lines) {
+			return false
+		}
+		for i, line := range got {
+			if line != lines[i] {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestService_Export_roundTripSpecialCharacters(t *testing.T) {
+	f := func(phone, name, category string, amount int64) bool {
+		dir := t.TempDir()
+		s := &Service{
+			accounts: []*types.Account{{ID: 1, Phone: types.Phone(phone), Balance: types.Money(amount)}},
+			payments: []*types.Payment{{
+				ID:        "p|1",
+				AccountID: 1,
+				Amount:    types.Money(amount),
+				Category:  types.PaymentCategory(category),
+				Status:    types.PaymentStatusOk,
+			}},
+			favorites: []*types.Favorite{{
+				ID:        "f;1",
+				AccountID: 1,
+				Name:      name,
+				Amount:    types.Money(amount),
+				Category:  types.PaymentCategory(category),
+			}},
+		}
+		if err := s.Export(dir); err != nil {
+			t.Log(err)
+			return false
+		}
+		var got Service
+		if err := got.Import(dir); err != nil {
+			t.Log(err)
+			return false
+		}
+		return reflect.DeepEqual(got.accounts, s.accounts) &&
+			reflect.DeepEqual(got.payments, s.payments) &&
+			reflect.DeepEqual(got.favorites, s.favorites)
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 50}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestService_ExportToFile_roundTripSpecialCharacters(t *testing.T) {
+	f := func(phones []string) bool {
+		file := path.Join(t.TempDir(), "accounts")
+		s := &Service{}
+		for i, phone := range phones {
+			s.accounts = append(s.accounts, &types.Account{ID: int64(i + 1), Phone: types.Phone(phone), Balance: types.Money(i)})
+		}
+		if err := s.ExportToFile(file); err != nil {
+			t.Log(err)
+			return false
+		}
+		var got Service
+		if err := got.ImportFromFile(file); err != nil {
+			t.Log(err)
+			return false
+		}
+		return reflect.DeepEqual(got.accounts, s.accounts)
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 50}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestService_Import_legacyFormat(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"accounts.dump":  "1|+992000000001|100\n2|+992000000002|200\n",
+		"payments.dump":  "p1|1|50|back\\slash|OK\n",
+		"favorites.dump": "f1|1|Mom\\Dad|50|back\\slash\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var s Service
+	if err := s.Import(dir); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.accounts) != 2 || s.accounts[1].Balance != 200 {
+		t.Fatalf("invalid accounts: %v", s.accounts)
+	}
+	if s.payments[0].Category != `back\slash` {
+		t.Errorf("legacy category changed: %q", s.payments[0].Category)
+	}
+	if s.favorites[0].Name != `Mom\Dad` {
+		t.Errorf("legacy name changed: %q", s.favorites[0].Name)
+	}
+}
+
+func TestService_ImportFromFile_legacyFormat(t *testing.T) {
+	file := path.Join(t.TempDir(), "accounts")
+	if err := ioutil.WriteFile(file, []byte("1;123;0|2;321;10|"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var s Service
+	if err := s.ImportFromFile(file); err != nil {
+		t.Fatal(err)
+	}
+	want := []*types.Account{{ID: 1, Phone: "123", Balance: 0}, {ID: 2, Phone: "321", Balance: 10}}
+	if !reflect.DeepEqual(s.accounts, want) {
+		t.Errorf("got: %v, want: %v", s.accounts, want)
+	}
+}
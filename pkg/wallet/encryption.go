@@ -0,0 +1,251 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+var ErrNoKeyProvider = errors.New("file is encrypted and no key provider is set")
+var ErrUnknownKey = errors.New("unknown encryption key")
+var ErrWrongKey = errors.New("wrong encryption key")
+var ErrDecryptionFailed = errors.New("decryption failed: wrong key or tampered file")
+var ErrWrongEncryptedFile = errors.New("wrong encrypted file")
+var ErrNotEncrypted = errors.New("file is not encrypted")
+
+// Encrypted files start with magic, version and the ID of the key used,
+// followed by the AES-GCM nonce and sealed data. The header is authenticated
+// as additional data, so changing the key ID is detected as tampering.
+const encryptionMagic = "WENC"
+const encryptionVersion = 1
+
+// dumpFileMode keeps dumps with phone numbers and balances private to the owner.
+const dumpFileMode = 0600
+
+// KeyProvider supplies AES keys (16, 24 or 32 bytes) by ID. New files are
+// encrypted with the current key, files are decrypted with whatever key ID
+// their header names, so a rotated provider keeps the old keys readable until
+// the next export re-encrypts everything with the new one.
+type KeyProvider interface {
+	CurrentKeyID() (string, error)
+	Key(id string) ([]byte, error)
+}
+
+// Keyring is an in-memory KeyProvider.
+type Keyring struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+func (k *Keyring) CurrentKeyID() (string, error) {
+	if _, ok := k.Keys[k.Current]; !ok {
+		return "", ErrUnknownKey
+	}
+	return k.Current, nil
+}
+
+func (k *Keyring) Key(id string) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// FileKeyProvider reads hex encoded keys from Dir/<id>.key.
+type FileKeyProvider struct {
+	Dir     string
+	Current string
+}
+
+func (p *FileKeyProvider) CurrentKeyID() (string, error) {
+	return p.Current, nil
+}
+
+func (p *FileKeyProvider) Key(id string) ([]byte, error) {
+	if !validKeyID(id) {
+		return nil, ErrUnknownKey
+	}
+	data, err := ioutil.ReadFile(path.Join(p.Dir, id+".key"))
+	if os.IsNotExist(err) {
+		return nil, ErrUnknownKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeKey(string(data))
+}
+
+// EnvKeyProvider reads hex encoded keys from the environment variables
+// Prefix+<id>, e.g. WALLET_KEY_2021.
+type EnvKeyProvider struct {
+	Prefix  string
+	Current string
+}
+
+func (p *EnvKeyProvider) CurrentKeyID() (string, error) {
+	return p.Current, nil
+}
+
+func (p *EnvKeyProvider) Key(id string) ([]byte, error) {
+	if !validKeyID(id) {
+		return nil, ErrUnknownKey
+	}
+	value, ok := os.LookupEnv(p.Prefix + id)
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return decodeKey(value)
+}
+
+func validKeyID(id string) bool {
+	return id != "" && len(id) <= 255 && !strings.ContainsAny(id, "/\\\x00") && id != "." && id != ".."
+}
+
+func decodeKey(value string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, ErrWrongKey
+}
+
+// SetKeyProvider turns on encryption of everything the service writes to
+// disk. Passing nil writes plaintext again. With a provider set, plaintext
+// files are rejected unless AllowPlaintext is on.
+func (s *Service) SetKeyProvider(keys KeyProvider) {
+	s.keys = keys
+}
+
+// AllowPlaintext lets a service with a KeyProvider read plaintext files, so
+// existing dumps can be migrated by importing and exporting them. Turn it off
+// again after the migration: anyone able to write to the dump directory could
+// replace an encrypted file with a forged plaintext one.
+func (s *Service) AllowPlaintext(allow bool) {
+	s.plaintext = allow
+}
+
+func (s *Service) writeFile(filename string, data []byte) error {
+	data, err := seal(s.keys, data)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filename, data, dumpFileMode)
+	if err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of files that already exist.
+	return os.Chmod(filename, dumpFileMode)
+}
+
+func (s *Service) readFile(filename string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return unseal(s.keys, s.plaintext, data)
+}
+
+// seal encrypts data when there are keys.
+func seal(keys KeyProvider, data []byte) ([]byte, error) {
+	if keys == nil {
+		return data, nil
+	}
+	return encrypt(keys, data)
+}
+
+// unseal decrypts data sealed with keys. Plaintext is accepted without keys,
+// or with them when plaintext is set.
+func unseal(keys KeyProvider, plaintext bool, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(encryptionMagic)) {
+		if keys != nil && !plaintext {
+			return nil, ErrNotEncrypted
+		}
+		return data, nil
+	}
+	if keys == nil {
+		return nil, ErrNoKeyProvider
+	}
+	return decrypt(keys, data)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+	return cipher.NewGCM(block)
+}
+
+func encrypt(keys KeyProvider, data []byte) ([]byte, error) {
+	id, err := keys.CurrentKeyID()
+	if err != nil {
+		return nil, err
+	}
+	if !validKeyID(id) {
+		return nil, ErrUnknownKey
+	}
+	key, err := keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	headerLength := len(encryptionMagic) + 2 + len(id)
+	out := make([]byte, headerLength+gcm.NonceSize(), headerLength+gcm.NonceSize()+len(data)+gcm.Overhead())
+	copy(out, encryptionMagic)
+	out[len(encryptionMagic)] = encryptionVersion
+	out[len(encryptionMagic)+1] = byte(len(id))
+	copy(out[len(encryptionMagic)+2:], id)
+	nonce := out[headerLength:]
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(out, nonce, data, out[:headerLength]), nil
+}
+
+func decrypt(keys KeyProvider, data []byte) ([]byte, error) {
+	if len(data) < len(encryptionMagic)+2 {
+		return nil, ErrWrongEncryptedFile
+	}
+	if data[len(encryptionMagic)] != encryptionVersion {
+		return nil, ErrWrongEncryptedFile
+	}
+	idLength := int(data[len(encryptionMagic)+1])
+	headerLength := len(encryptionMagic) + 2 + idLength
+	if len(data) < headerLength {
+		return nil, ErrWrongEncryptedFile
+	}
+	header := data[:headerLength]
+	key, err := keys.Key(string(header[len(encryptionMagic)+2:]))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < headerLength+gcm.NonceSize() {
+		return nil, ErrWrongEncryptedFile
+	}
+	nonce := data[headerLength : headerLength+gcm.NonceSize()]
+	plain, err := gcm.Open(nil, nonce, data[headerLength+gcm.NonceSize():], header)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return plain, nil
+}
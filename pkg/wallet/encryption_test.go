@@ -0,0 +1,184 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func newTestKeyring() *Keyring {
+	return &Keyring{
+		Current: "k1",
+		Keys: map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, 32),
+			"k2": bytes.Repeat([]byte{2}, 32),
+		},
+	}
+}
+
+func TestService_Export_encrypted(t *testing.T) {
+	for _, format := range []Format{FormatDump, FormatCSV, FormatJSON, FormatBinary} {
+		dir := t.TempDir()
+		s := newTestService(withFormatsData(), withKeys(newTestKeyring()))
+		if err := s.ExportFormat(dir, format); err != nil {
+			t.Fatal(err)
+		}
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range files {
+			if file.Mode().Perm() != dumpFileMode {
+				t.Errorf("%s: invalid mode %v", file.Name(), file.Mode())
+			}
+			data, err := ioutil.ReadFile(path.Join(dir, file.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(data, []byte(encryptionMagic)) || bytes.Contains(data, []byte("+992000000001")) {
+				t.Errorf("%s is not encrypted", file.Name())
+			}
+		}
+
+		got := newTestService(withKeys(newTestKeyring()))
+		if err := got.ImportFormat(dir, format); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.accounts, s.accounts) || !reflect.DeepEqual(got.payments, s.payments) {
+			t.Errorf("format %d: encrypted round trip changed data", format)
+		}
+	}
+}
+
+func TestService_Import_encryptedFailures(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestService(withFormatsData(), withKeys(newTestKeyring()))
+	if err := s.Export(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	var noKeys Service
+	if err := noKeys.Import(dir); err != ErrNoKeyProvider {
+		t.Errorf("without keys: want: %v, got: %v", ErrNoKeyProvider, err)
+	}
+
+	unknown := newTestService(withKeys(&Keyring{Current: "k2", Keys: map[string][]byte{"k2": bytes.Repeat([]byte{2}, 32)}}))
+	if err := unknown.Import(dir); err != ErrUnknownKey {
+		t.Errorf("unknown key: want: %v, got: %v", ErrUnknownKey, err)
+	}
+
+	wrong := newTestService(withKeys(&Keyring{Current: "k1", Keys: map[string][]byte{"k1": bytes.Repeat([]byte{9}, 32)}}))
+	if err := wrong.Import(dir); err != ErrDecryptionFailed {
+		t.Errorf("wrong key: want: %v, got: %v", ErrDecryptionFailed, err)
+	}
+
+	filename := path.Join(dir, "accounts.dump")
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 1
+	if err := ioutil.WriteFile(filename, data, dumpFileMode); err != nil {
+		t.Fatal(err)
+	}
+	tampered := newTestService(withKeys(newTestKeyring()))
+	if err := tampered.Import(dir); err != ErrDecryptionFailed {
+		t.Errorf("tampered file: want: %v, got: %v", ErrDecryptionFailed, err)
+	}
+}
+
+func TestService_Import_plaintext(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestService(withFormatsData())
+	if err := s.Export(dir); err != nil {
+		t.Fatal(err)
+	}
+	got := newTestService(withKeys(newTestKeyring()))
+	if err := got.Import(dir); err != ErrNotEncrypted {
+		t.Errorf("want: %v, got: %v", ErrNotEncrypted, err)
+	}
+	got.AllowPlaintext(true)
+	if err := got.Import(dir); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.accounts, s.accounts) {
+		t.Errorf("got: %v, want: %v", got.accounts, s.accounts)
+	}
+}
+
+func TestService_Export_keyRotation(t *testing.T) {
+	dir := t.TempDir()
+	keys := newTestKeyring()
+	s := newTestService(withFormatsData(), withKeys(keys))
+	if err := s.Export(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	keys.Current = "k2"
+	rotated := newTestService(withKeys(keys))
+	if err := rotated.Import(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := rotated.Export(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	delete(keys.Keys, "k1")
+	got := newTestService(withKeys(keys))
+	if err := got.Import(dir); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.accounts, s.accounts) {
+		t.Errorf("got: %v, want: %v", got.accounts, s.accounts)
+	}
+}
+
+func TestFileKeyProvider_Key(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{7}, 16)
+	if err := ioutil.WriteFile(path.Join(dir, "2021.key"), []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	provider := &FileKeyProvider{Dir: dir, Current: "2021"}
+	got, err := provider.Key("2021")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, key) {
+		t.Errorf("got: %x, want: %x", got, key)
+	}
+	if _, err := provider.Key("2022"); err != ErrUnknownKey {
+		t.Errorf("want: %v, got: %v", ErrUnknownKey, err)
+	}
+	if _, err := provider.Key("../2021"); err != ErrUnknownKey {
+		t.Errorf("want: %v, got: %v", ErrUnknownKey, err)
+	}
+}
+
+func TestEnvKeyProvider_Key(t *testing.T) {
+	key := bytes.Repeat([]byte{3}, 32)
+	if err := os.Setenv("WALLET_TEST_KEY_a", hex.EncodeToString(key)); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("WALLET_TEST_KEY_a")
+	if err := os.Setenv("WALLET_TEST_KEY_short", "0102"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("WALLET_TEST_KEY_short")
+
+	provider := &EnvKeyProvider{Prefix: "WALLET_TEST_KEY_", Current: "a"}
+	got, err := provider.Key("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, key) {
+		t.Errorf("got: %x, want: %x", got, key)
+	}
+	if _, err := provider.Key("short"); err != ErrWrongKey {
+		t.Errorf("want: %v, got: %v", ErrWrongKey, err)
+	}
+}
@@ -0,0 +1,302 @@
+package wallet
+
+import (
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"sync"
+	"time"
+)
+
+// EventMeta is embedded in every event.
+type EventMeta struct {
+	// Seq increases by one with every event of the Service.
+	Seq       uint64
+	AccountID int64
+	Time      time.Time
+}
+
+func (m EventMeta) Meta() EventMeta {
+	return m
+}
+
+type Event interface {
+	Meta() EventMeta
+}
+
+type AccountRegistered struct {
+	EventMeta
+	Account types.Account
+}
+
+type Deposited struct {
+	EventMeta
+	Deposit types.Deposit
+	Amount  types.Money
+	Balance types.Money
+}
+
+type DepositReversed struct {
+	EventMeta
+	Deposit types.Deposit
+	Balance types.Money
+}
+
+// BalanceAdjusted is a correction of the balance made by reconciliation.
+type BalanceAdjusted struct {
+	EventMeta
+	Amount  types.Money
+	Balance types.Money
+	Reason  string
+}
+
+// BudgetAlert is published when a payment makes the spending of the month
+// reach Percent of the limit of a budget.
+type BudgetAlert struct {
+	EventMeta
+	Budget    Budget
+	Month     time.Time
+	Percent   int
+	Spent     types.Money
+	PaymentID string
+}
+
+type RewardAwarded struct {
+	EventMeta
+	Reward Reward
+}
+
+// RewardReversed is published when the payment of a reward is rejected.
+type RewardReversed struct {
+	EventMeta
+	Reward Reward
+}
+
+type PointsRedeemed struct {
+	EventMeta
+	Reward  Reward
+	Deposit types.Deposit
+}
+
+type SplitCreated struct {
+	EventMeta
+	Split Split
+}
+
+// SplitPartPaid is published for the account paying its part, Balance is the
+// balance of that account.
+type SplitPartPaid struct {
+	EventMeta
+	Split   Split
+	Payment types.Payment
+	Balance types.Money
+}
+
+// SplitCompleted is published when the last part is paid and the bill with
+// it.
+type SplitCompleted struct {
+	EventMeta
+	Split Split
+}
+
+// SplitClosed is published when a split is cancelled, expires or the payment
+// of a part of a paid split is rejected, after the parts paid were refunded.
+type SplitClosed struct {
+	EventMeta
+	Split Split
+}
+
+// PaymentRequested is published for the account asked to pay.
+type PaymentRequested struct {
+	EventMeta
+	Request PaymentRequest
+}
+
+// PaymentRequestAccepted is published for the requester when the payment
+// and the deposit of an accepted request are made.
+type PaymentRequestAccepted struct {
+	EventMeta
+	Request PaymentRequest
+	Payment types.Payment
+	Deposit types.Deposit
+}
+
+// PaymentRequestClosed is published for the requester when a request is
+// declined or expires.
+type PaymentRequestClosed struct {
+	EventMeta
+	Request PaymentRequest
+}
+
+type PaymentCreated struct {
+	EventMeta
+	Payment types.Payment
+	Balance types.Money
+}
+
+type PaymentRejected struct {
+	EventMeta
+	Payment types.Payment
+	Balance types.Money
+}
+
+// PaymentApproved is published when a payment held for review is approved.
+type PaymentApproved struct {
+	EventMeta
+	Payment types.Payment
+	Balance types.Money
+}
+
+type PaymentRepeated struct {
+	EventMeta
+	OriginalID string
+	Payment    types.Payment
+	Balance    types.Money
+}
+
+type FavoriteCreated struct {
+	EventMeta
+	Favorite types.Favorite
+}
+
+// EventBus delivers the events of a Service to its subscribers in the order
+// they were published, so events of one account are never reordered. Sync
+// handlers run in Publish, async ones on a goroutine per subscriber.
+type EventBus struct {
+	mu          sync.Mutex
+	nextID      int
+	subscribers []*subscriber
+	// pending are the events published while another Publish delivers,
+	// that Publish delivers them in order once its event is done.
+	pending    []Event
+	delivering bool
+}
+
+type subscriber struct {
+	id      int
+	handler func(event Event)
+	queue   chan Event
+	done    chan struct{}
+	// mu keeps Publish from sending to a queue unsubscribe has closed.
+	mu     sync.Mutex
+	closed bool
+}
+
+// Subscribe calls handler for every event before the operation returns.
+// The returned function unsubscribes.
+func (b *EventBus) Subscribe(handler func(event Event)) func() {
+	return b.subscribe(&subscriber{handler: handler})
+}
+
+// SubscribeAsync queues events in a buffer of the given size and calls
+// handler from a separate goroutine. When the buffer is full Publish waits,
+// events are never dropped. Unsubscribing delivers the queued events first.
+func (b *EventBus) SubscribeAsync(handler func(event Event), buffer int) func() {
+	sub := &subscriber{
+		handler: handler,
+		queue:   make(chan Event, buffer),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(sub.done)
+		for event := range sub.queue {
+			sub.handler(event)
+		}
+	}()
+	return b.subscribe(sub)
+}
+
+func (b *EventBus) subscribe(sub *subscriber) func() {
+	b.mu.Lock()
+	b.nextID++
+	sub.id = b.nextID
+	b.subscribers = append(b.subscribers, sub)
+	b.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.unsubscribe(sub.id)
+			if sub.queue != nil {
+				sub.mu.Lock()
+				sub.closed = true
+				close(sub.queue)
+				sub.mu.Unlock()
+				<-sub.done
+			}
+		})
+	}
+}
+
+func (b *EventBus) unsubscribe(id int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	subscribers := make([]*subscriber, 0, len(b.subscribers))
+	for _, sub := range b.subscribers {
+		if sub.id != id {
+			subscribers = append(subscribers, sub)
+		}
+	}
+	b.subscribers = subscribers
+}
+
+// Publish delivers event to every subscriber. Sync handlers may call back
+// into the Service: the events they cause are queued and delivered after the
+// current event reached every subscriber, so each subscriber sees the events
+// in the order they were published. The lock isn't held while delivering, so
+// handlers may subscribe and unsubscribe.
+func (b *EventBus) Publish(event Event) {
+	b.mu.Lock()
+	b.pending = append(b.pending, event)
+	if b.delivering {
+		b.mu.Unlock()
+		return
+	}
+	b.delivering = true
+	for len(b.pending) > 0 {
+		event := b.pending[0]
+		b.pending = b.pending[1:]
+		subscribers := b.subscribers
+		b.mu.Unlock()
+
+		for _, sub := range subscribers {
+			sub.deliver(event)
+		}
+
+		b.mu.Lock()
+	}
+	b.pending = nil
+	b.delivering = false
+	b.mu.Unlock()
+}
+
+func (sub *subscriber) deliver(event Event) {
+	if sub.queue == nil {
+		sub.handler(event)
+		return
+	}
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if !sub.closed {
+		sub.queue <- event
+	}
+}
+
+// Events returns the bus the Service publishes its events on.
+func (s *Service) Events() *EventBus {
+	if s.events == nil {
+		s.events = &EventBus{}
+	}
+	return s.events
+}
+
+// publish is called once the state change is done, so subscribers see the
+// Service as the event describes it. Without a bus it does nothing.
+func (s *Service) publish(event Event) {
+	if s.events != nil {
+		s.events.Publish(event)
+	}
+}
+
+func (s *Service) eventMeta(accountID int64) EventMeta {
+	s.eventSeq++
+	return EventMeta{Seq: s.eventSeq, AccountID: accountID, Time: s.now()}
+}
@@ -0,0 +1,160 @@
+package wallet
+
+import (
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestService_Events_sync(t *testing.T) {
+	s := &Service{}
+	var events []Event
+	unsubscribe := s.Events().Subscribe(func(event Event) {
+		events = append(events, event)
+	})
+	account, err := s.RegisterAccount("123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deposit(account.ID, 100); err != nil {
+		t.Fatal(err)
+	}
+	payment, err := s.Pay(account.ID, 30, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Repeat(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reject(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.FavoritePayment(payment.ID, "fuel"); err != nil {
+		t.Fatal(err)
+	}
+	unsubscribe()
+	if err := s.Deposit(account.ID, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	var kinds []string
+	for i, event := range events {
+		if event.Meta().Seq != uint64(i+1) || event.Meta().AccountID != account.ID {
+			t.Errorf("invalid meta: %+v", event.Meta())
+		}
+		kinds = append(kinds, reflect.TypeOf(event).Name())
+	}
+	want := []string{"AccountRegistered", "Deposited", "PaymentCreated", "PaymentRepeated", "PaymentRejected", "FavoriteCreated"}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("got: %v, want: %v", kinds, want)
+	}
+	if rejected := events[4].(PaymentRejected); rejected.Payment.Status != types.PaymentStatusFail || rejected.Balance != 70 {
+		t.Errorf("invalid event: %+v", rejected)
+	}
+}
+
+func TestService_Events_afterCommit(t *testing.T) {
+	s := &Service{}
+	account, err := s.RegisterAccount("123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	published := 0
+	s.Events().Subscribe(func(event Event) {
+		published++
+		// The state the event describes is already visible.
+		got, err := s.FindAccountByID(account.ID)
+		if err != nil || got.Balance != event.(Deposited).Balance {
+			t.Errorf("event before commit: %+v", event)
+		}
+	})
+	if err := s.Deposit(account.ID, 50); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deposit(account.ID, -1); err != ErrAmountMustBePositive {
+		t.Errorf("want: %v, got: %v", ErrAmountMustBePositive, err)
+	}
+	if err := s.Deposit(42, 10); err != ErrAccountNotFound {
+		t.Errorf("want: %v, got: %v", ErrAccountNotFound, err)
+	}
+	if published != 1 {
+		t.Errorf("failed operations published events: %d", published)
+	}
+}
+
+func TestService_Events_async(t *testing.T) {
+	s := &Service{}
+	var mu sync.Mutex
+	byAccount := make(map[int64][]uint64)
+	unsubscribe := s.Events().SubscribeAsync(func(event Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		meta := event.Meta()
+		byAccount[meta.AccountID] = append(byAccount[meta.AccountID], meta.Seq)
+	}, 2)
+	for _, phone := range []types.Phone{"1", "2", "3"} {
+		if _, err := s.RegisterAccount(phone); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 30; i++ {
+		if err := s.Deposit(int64(i%3+1), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	unsubscribe()
+
+	total := 0
+	for accountID, seqs := range byAccount {
+		total += len(seqs)
+		for i := 1; i < len(seqs); i++ {
+			if seqs[i] <= seqs[i-1] {
+				t.Errorf("account %d: events out of order: %v", accountID, seqs)
+			}
+		}
+	}
+	if total != 33 {
+		t.Errorf("got %d events, want 33", total)
+	}
+}
+
+func TestService_Events_nestedInOrder(t *testing.T) {
+	s := &Service{}
+	account, err := s.RegisterAccount("123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Events().Subscribe(func(event Event) {
+		if deposited, ok := event.(Deposited); ok && deposited.Amount == 100 {
+			if _, err := s.Pay(account.ID, 10, "auto"); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+	var seqs []uint64
+	s.Events().Subscribe(func(event Event) {
+		seqs = append(seqs, event.Meta().Seq)
+	})
+	if err := s.Deposit(account.ID, 100); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(seqs, []uint64{2, 3}) {
+		t.Errorf("events out of order: %v", seqs)
+	}
+}
+
+func TestService_Events_subscribeFromHandler(t *testing.T) {
+	s := &Service{}
+	var unsubscribe func()
+	s.Events().SubscribeAsync(func(event Event) {
+		if unsubscribe == nil {
+			unsubscribe = s.Events().Subscribe(func(event Event) {})
+		}
+	}, 1)
+	for _, phone := range []types.Phone{"1", "2", "3"} {
+		if _, err := s.RegisterAccount(phone); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
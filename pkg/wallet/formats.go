@@ -0,0 +1,235 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+)
+
+var ErrUnknownFormat = errors.New("unknown format")
+var ErrWrongHeader = errors.New("wrong header")
+
+// Format selects the file encoding used by ExportFormat, ImportFormat and
+// HistoryToFilesFormat.
+type Format int
+
+const (
+	// FormatDump is the pipe-delimited .dump format.
+	FormatDump Format = iota
+	// FormatJSON writes one JSON object per line (JSON Lines).
+	FormatJSON
+	// FormatCSV writes RFC 4180 CSV with a header row.
+	FormatCSV
+	// FormatBinary writes a single varint encoded snapshot file.
+	FormatBinary
+	// FormatBinaryCompressed is FormatBinary compressed with DEFLATE.
+	FormatBinaryCompressed
+)
+
+var accountColumns = []string{"id", "phone", "balance"}
+var paymentColumns = []string{"id", "account_id", "amount", "category", "status", "created", "risk_hits"}
+var favoriteColumns = []string{"id", "account_id", "name", "amount", "category"}
+
+// paymentOptionalColumns may be missing from files written before they were
+// added.
+var paymentOptionalColumns = []string{"created", "risk_hits"}
+
+func (f Format) extension() string {
+	switch f {
+	case FormatJSON:
+		return ".jsonl"
+	case FormatCSV:
+		return ".csv"
+	case FormatBinary, FormatBinaryCompressed:
+		return ".snapshot"
+	default:
+		return ".dump"
+	}
+}
+
+func (f Format) binary() bool {
+	return f == FormatBinary || f == FormatBinaryCompressed
+}
+
+// table describes rows of one entity so every format can write them.
+type table struct {
+	columns []string
+	rows    int
+	fields  func(row int) []string
+	value   func(row int) interface{}
+}
+
+// writeTable returns the number of bytes of the encoded table.
+func (s *Service) writeTable(filename string, format Format, t table) (int, error) {
+	var buf bytes.Buffer
+	err := encodeTable(&buf, format, t)
+	if err != nil {
+		return 0, err
+	}
+	return buf.Len(), s.writeFile(filename, buf.Bytes())
+}
+
+func encodeTable(writer io.Writer, format Format, t table) error {
+	switch format {
+	case FormatDump:
+		_, err := io.WriteString(writer, dumpHeader+"\n")
+		if err != nil {
+			return err
+		}
+		for row := 0; row < t.rows; row++ {
+			_, err = io.WriteString(writer, joinFields(t.fields(row), '|')+"\n")
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case FormatCSV:
+		w := csv.NewWriter(writer)
+		err := w.Write(t.columns)
+		if err != nil {
+			return err
+		}
+		for row := 0; row < t.rows; row++ {
+			err = w.Write(t.fields(row))
+			if err != nil {
+				return err
+			}
+		}
+		w.Flush()
+		return w.Error()
+	case FormatJSON:
+		encoder := json.NewEncoder(writer)
+		for row := 0; row < t.rows; row++ {
+			err := encoder.Encode(t.value(row))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return ErrUnknownFormat
+}
+
+// readTable calls record for every row of the file. Text formats pass the
+// fields in column order, JSON passes the raw object. A missing file is not
+// an error, the same way Export skips empty collections. The optional columns
+// may be missing from a CSV header.
+func (s *Service) readTable(filename string, format Format, columns []string, optional []string,
+	record func(fields []string, data []byte) error,
+) error {
+	data, err := s.readFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return decodeTable(bytes.NewReader(data), format, columns, optional, record)
+}
+
+func decodeTable(reader io.Reader, format Format, columns []string, optional []string,
+	record func(fields []string, data []byte) error,
+) error {
+	switch format {
+	case FormatDump:
+		lines, escaped, err := readDumpLines(reader)
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			err = record(splitFields(line, '|', escaped), nil)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case FormatCSV:
+		r := csv.NewReader(reader)
+		r.FieldsPerRecord = -1
+		header, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		order, err := columnOrder(header, columns, optional)
+		if err != nil {
+			return err
+		}
+		for {
+			row, err := r.Read()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			fields := make([]string, len(columns))
+			for i, index := range order {
+				if index >= 0 && index < len(row) {
+					fields[i] = row[index]
+				}
+			}
+			err = record(fields, nil)
+			if err != nil {
+				return err
+			}
+		}
+	case FormatJSON:
+		decoder := json.NewDecoder(reader)
+		for {
+			var data json.RawMessage
+			err := decoder.Decode(&data)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = record(nil, data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return ErrUnknownFormat
+}
+
+// columnOrder maps every expected column to its position in the header, -1
+// for a missing optional column.
+func columnOrder(header []string, columns []string, optional []string) ([]int, error) {
+	order := make([]int, len(columns))
+	for i, column := range columns {
+		order[i] = -1
+		for index, name := range header {
+			if name == column {
+				order[i] = index
+				break
+			}
+		}
+		if order[i] == -1 && !containsString(optional, column) {
+			return nil, ErrWrongHeader
+		}
+	}
+	return order, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeRecord(fields []string, data []byte, value interface{}, parse func(fields []string, value interface{}) error) error {
+	if data != nil {
+		return json.Unmarshal(data, value)
+	}
+	return parse(fields, value)
+}
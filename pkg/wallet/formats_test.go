@@ -0,0 +1,149 @@
+package wallet
+
+import (
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// withFormatsData adds accounts, payments and favorites with the separators
+// and quotes of every format in their strings.
+func withFormatsData() testOption {
+	return func(s *testService) {
+		s.accounts = []*types.Account{
+			{ID: 1, Phone: "+992000000001", Balance: 100},
+			{ID: 2, Phone: "+992 \"000\", 2", Balance: -20},
+		}
+		s.payments = []*types.Payment{
+			{ID: "p1", AccountID: 1, Amount: 50, Category: "auto", Status: types.PaymentStatusOk},
+			{ID: "p2", AccountID: 2, Amount: 70, Category: "food,\ndrinks|bar", Status: types.PaymentStatusFail},
+		}
+		s.favorites = []*types.Favorite{
+			{ID: "f1", AccountID: 1, Name: "Mom|Rent; \"monthly\"", Amount: 50, Category: "rent"},
+		}
+	}
+}
+
+func TestService_ExportFormat_roundTrip(t *testing.T) {
+	for _, format := range []Format{FormatDump, FormatJSON, FormatCSV} {
+		s := newTestService(withFormatsData())
+		dir := t.TempDir()
+		if err := s.ExportFormat(dir, format); err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		var got Service
+		if err := got.ImportFormat(dir, format); err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		if !reflect.DeepEqual(got.accounts, s.accounts) {
+			t.Errorf("format %d: accounts got: %v, want: %v", format, got.accounts, s.accounts)
+		}
+		if !reflect.DeepEqual(got.payments, s.payments) {
+			t.Errorf("format %d: payments got: %v, want: %v", format, got.payments, s.payments)
+		}
+		if !reflect.DeepEqual(got.favorites, s.favorites) {
+			t.Errorf("format %d: favorites got: %v, want: %v", format, got.favorites, s.favorites)
+		}
+	}
+}
+
+func TestService_ExportFormat_csvHeader(t *testing.T) {
+	dir := t.TempDir()
+	if err := newTestService(withFormatsData()).ExportFormat(dir, FormatCSV); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path.Join(dir, "payments.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "id,account_id,amount,category,status,created,risk_hits\n") {
+		t.Errorf("invalid header: %q", data)
+	}
+}
+
+func TestService_ImportFormat_csvColumnOrder(t *testing.T) {
+	dir := t.TempDir()
+	content := "balance,phone,id\r\n10,123,1\r\n"
+	if err := ioutil.WriteFile(path.Join(dir, "accounts.csv"), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var s Service
+	if err := s.ImportFormat(dir, FormatCSV); err != nil {
+		t.Fatal(err)
+	}
+	want := []*types.Account{{ID: 1, Phone: "123", Balance: 10}}
+	if !reflect.DeepEqual(s.accounts, want) {
+		t.Errorf("got: %v, want: %v", s.accounts, want)
+	}
+}
+
+func TestService_ImportFormat_csvWithoutCreated(t *testing.T) {
+	dir := t.TempDir()
+	content := "id,account_id,amount,category,status\np1,1,50,auto,OK\n"
+	if err := ioutil.WriteFile(path.Join(dir, "payments.csv"), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var s Service
+	if err := s.ImportFormat(dir, FormatCSV); err != nil {
+		t.Fatal(err)
+	}
+	want := []*types.Payment{{ID: "p1", AccountID: 1, Amount: 50, Category: "auto", Status: types.PaymentStatusOk}}
+	if !reflect.DeepEqual(s.payments, want) {
+		t.Errorf("got: %v, want: %v", s.payments, want)
+	}
+}
+
+func TestService_ImportFormat_csvWrongHeader(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(path.Join(dir, "accounts.csv"), []byte("id,phone\n1,123\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var s Service
+	if err := s.ImportFormat(dir, FormatCSV); err != ErrWrongHeader {
+		t.Errorf("want: %v, got: %v", ErrWrongHeader, err)
+	}
+}
+
+func TestService_HistoryToFilesFormat(t *testing.T) {
+	payments := []types.Payment{
+		{ID: "p1", AccountID: 1, Amount: 10, Category: "auto", Status: types.PaymentStatusOk},
+		{ID: "p2", AccountID: 1, Amount: 20, Category: "auto", Status: types.PaymentStatusOk},
+		{ID: "p3", AccountID: 1, Amount: 30, Category: "auto", Status: types.PaymentStatusOk},
+	}
+	for _, format := range []Format{FormatDump, FormatJSON, FormatCSV} {
+		dir := t.TempDir()
+		var s Service
+		if err := s.HistoryToFilesFormat(payments, dir, 2, format); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]types.Payment, 0)
+		for _, name := range []string{"payments1", "payments2"} {
+			err := s.readTable(path.Join(dir, name+format.extension()), format, paymentColumns, paymentOptionalColumns,
+				func(fields []string, data []byte) error {
+					var payment types.Payment
+					err := decodeRecord(fields, data, &payment, parsePaymentFields)
+					got = append(got, payment)
+					return err
+				})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !reflect.DeepEqual(got, payments) {
+			t.Errorf("format %d: got: %v, want: %v", format, got, payments)
+		}
+	}
+}
+
+func TestColumnOrder_optionalPerTable(t *testing.T) {
+	header := []string{"id", "account_id", "amount", "category", "status"}
+	if _, err := columnOrder(header, paymentColumns, paymentOptionalColumns); err != nil {
+		t.Errorf("payments: %v", err)
+	}
+	if _, err := columnOrder(header, paymentColumns, nil); err != ErrWrongHeader {
+		t.Errorf("want: %v, got: %v", ErrWrongHeader, err)
+	}
+}
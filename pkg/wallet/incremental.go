@@ -0,0 +1,332 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+)
+
+var ErrWrongManifest = errors.New("wrong manifest")
+
+const manifestFile = "manifest"
+
+const (
+	manifestBase  = "base"
+	manifestDelta = "delta"
+)
+
+// changeSet remembers records created or modified since the last
+// incremental export.
+type changeSet struct {
+	accounts  map[int64]bool
+	payments  map[string]bool
+	favorites map[string]bool
+
+	credentials map[int64]bool
+	ledger      map[int64]bool
+	deposits    map[string]bool
+	budgets     map[string]bool
+	rewards     map[string]bool
+	accruals    map[int64]bool
+	splits      map[string]bool
+
+	paymentRequests map[string]bool
+}
+
+func (c *changeSet) account(id int64) {
+	if c.accounts == nil {
+		c.accounts = make(map[int64]bool)
+	}
+	c.accounts[id] = true
+}
+
+func (c *changeSet) payment(id string) {
+	if c.payments == nil {
+		c.payments = make(map[string]bool)
+	}
+	c.payments[id] = true
+}
+
+func (c *changeSet) favorite(id string) {
+	if c.favorites == nil {
+		c.favorites = make(map[string]bool)
+	}
+	c.favorites[id] = true
+}
+
+func (c *changeSet) credential(accountID int64) {
+	if c.credentials == nil {
+		c.credentials = make(map[int64]bool)
+	}
+	c.credentials[accountID] = true
+}
+
+func (c *changeSet) ledgerEntry(id int64) {
+	if c.ledger == nil {
+		c.ledger = make(map[int64]bool)
+	}
+	c.ledger[id] = true
+}
+
+func (c *changeSet) deposit(id string) {
+	if c.deposits == nil {
+		c.deposits = make(map[string]bool)
+	}
+	c.deposits[id] = true
+}
+
+func (c *changeSet) budget(key string) {
+	if c.budgets == nil {
+		c.budgets = make(map[string]bool)
+	}
+	c.budgets[key] = true
+}
+
+func (c *changeSet) reward(id string) {
+	if c.rewards == nil {
+		c.rewards = make(map[string]bool)
+	}
+	c.rewards[id] = true
+}
+
+func (c *changeSet) accrual(accountID int64) {
+	if c.accruals == nil {
+		c.accruals = make(map[int64]bool)
+	}
+	c.accruals[accountID] = true
+}
+
+func (c *changeSet) split(id string) {
+	if c.splits == nil {
+		c.splits = make(map[string]bool)
+	}
+	c.splits[id] = true
+}
+
+func (c *changeSet) paymentRequest(id string) {
+	if c.paymentRequests == nil {
+		c.paymentRequests = make(map[string]bool)
+	}
+	c.paymentRequests[id] = true
+}
+
+func (c *changeSet) empty() bool {
+	return len(c.accounts) == 0 && len(c.payments) == 0 && len(c.favorites) == 0 && len(c.credentials) == 0 &&
+		len(c.ledger) == 0 && len(c.deposits) == 0 && len(c.budgets) == 0 &&
+		len(c.rewards) == 0 && len(c.accruals) == 0 && len(c.splits) == 0 &&
+		len(c.paymentRequests) == 0
+}
+
+func (c *changeSet) reset() {
+	*c = changeSet{}
+}
+
+// manifestEntry is one snapshot in the chain. Import restores the last base
+// and applies every delta written after it in order.
+type manifestEntry struct {
+	Name   string
+	Kind   string
+	Format Format
+}
+
+// ExportIncremental writes the records created or modified since the previous
+// incremental export into a new delta under dir and appends it to the
+// manifest. The first call, when dir has no base yet, writes a full base.
+func (s *Service) ExportIncremental(dir string, format Format) error {
+	entries, err := s.readManifest(dir)
+	if err != nil {
+		return err
+	}
+	if lastBase(entries) == -1 {
+		return s.ExportBase(dir, format)
+	}
+	if s.changes.empty() {
+		return nil
+	}
+	return s.exportEntry(dir, entries, manifestDelta, format, s.changedRecords())
+}
+
+// ExportBase writes a full snapshot under dir and starts a new chain in the
+// manifest, so earlier bases and deltas are no longer needed by Import.
+func (s *Service) ExportBase(dir string, format Format) error {
+	entries, err := s.readManifest(dir)
+	if err != nil {
+		return err
+	}
+	return s.exportEntry(dir, entries, manifestBase, format, s)
+}
+
+func (s *Service) exportEntry(dir string, entries []manifestEntry, kind string, format Format, records *Service) error {
+	entry := manifestEntry{
+		Name:   fmt.Sprintf("%06d-%s", len(entries)+1, kind),
+		Kind:   kind,
+		Format: format,
+	}
+	entryDir := path.Join(dir, entry.Name)
+	// a failed export may have left files that aren't in the manifest
+	err := os.RemoveAll(entryDir)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(entryDir, 0700)
+	if err != nil {
+		return err
+	}
+	err = records.ExportFormat(entryDir, format)
+	if err != nil {
+		return err
+	}
+	err = s.writeManifest(dir, append(entries, entry))
+	if err != nil {
+		return err
+	}
+	s.changes.reset()
+	return nil
+}
+
+// changedRecords returns a service holding only the changed records, in the
+// order they have in s.
+func (s *Service) changedRecords() *Service {
+	delta := &Service{keys: s.keys, plaintext: s.plaintext}
+	for _, account := range s.accounts {
+		if s.changes.accounts[account.ID] {
+			delta.accounts = append(delta.accounts, account)
+		}
+	}
+	for _, payment := range s.payments {
+		if s.changes.payments[payment.ID] {
+			delta.payments = append(delta.payments, payment)
+		}
+	}
+	for _, favorite := range s.favorites {
+		if s.changes.favorites[favorite.ID] {
+			delta.favorites = append(delta.favorites, favorite)
+		}
+	}
+	for _, c := range s.credentials {
+		if s.changes.credentials[c.AccountID] {
+			delta.credentials = append(delta.credentials, c)
+		}
+	}
+	for _, deposit := range s.deposits {
+		if s.changes.deposits[deposit.ID] {
+			delta.deposits = append(delta.deposits, deposit)
+		}
+	}
+	for _, budget := range s.budgets {
+		if s.changes.budgets[budgetKey(budget.AccountID, budget.Category)] {
+			delta.budgets = append(delta.budgets, budget)
+		}
+	}
+	for _, reward := range s.rewards {
+		if s.changes.rewards[reward.ID] {
+			delta.rewards = append(delta.rewards, reward)
+		}
+	}
+	for _, accrual := range s.accruals {
+		if s.changes.accruals[accrual.AccountID] {
+			delta.accruals = append(delta.accruals, accrual)
+		}
+	}
+	for _, split := range s.splits {
+		if s.changes.splits[split.ID] {
+			delta.splits = append(delta.splits, split)
+		}
+	}
+	for _, request := range s.paymentRequests {
+		if s.changes.paymentRequests[request.ID] {
+			delta.paymentRequests = append(delta.paymentRequests, request)
+		}
+	}
+	for _, entry := range s.ledger {
+		if s.changes.ledger[entry.ID] {
+			delta.ledger = append(delta.ledger, entry)
+		}
+	}
+	return delta
+}
+
+// ImportIncremental restores the state written by ExportIncremental: the
+// last base in the manifest followed by its deltas in order.
+func (s *Service) ImportIncremental(dir string) (err error) {
+	op := s.beginOperation("ImportIncremental", 0, map[string]string{"dir": dir}, auditTarget{counts: true})
+	defer func() { op.end(err, auditTarget{counts: true}) }()
+	entries, err := s.readManifest(dir)
+	if err != nil {
+		return err
+	}
+	start := lastBase(entries)
+	if start == -1 {
+		return ErrWrongManifest
+	}
+	for _, entry := range entries[start:] {
+		err = s.importDir(context.Background(), path.Join(dir, entry.Name), entry.Format, ProgressOptions{})
+		if err != nil {
+			return err
+		}
+	}
+	s.changes.reset()
+	return nil
+}
+
+func lastBase(entries []manifestEntry) int {
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Kind == manifestBase {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *Service) readManifest(dir string) ([]manifestEntry, error) {
+	data, err := s.readFile(path.Join(dir, manifestFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	lines, escaped, err := readDumpLines(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]manifestEntry, 0, len(lines))
+	for _, line := range lines {
+		fields := splitFields(line, '|', escaped)
+		if len(fields) < 3 {
+			return nil, ErrWrongManifest
+		}
+		format, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, ErrWrongManifest
+		}
+		if path.Base(fields[0]) != fields[0] || fields[0] == ".." {
+			return nil, ErrWrongManifest
+		}
+		if fields[1] != manifestBase && fields[1] != manifestDelta {
+			return nil, ErrWrongManifest
+		}
+		entries = append(entries, manifestEntry{Name: fields[0], Kind: fields[1], Format: Format(format)})
+	}
+	return entries, nil
+}
+
+// writeManifest replaces the manifest atomically, so a crash never leaves a
+// manifest pointing at a half written entry.
+func (s *Service) writeManifest(dir string, entries []manifestEntry) error {
+	var buf bytes.Buffer
+	buf.WriteString(dumpHeader + "\n")
+	for _, entry := range entries {
+		buf.WriteString(joinFields([]string{entry.Name, entry.Kind, strconv.Itoa(int(entry.Format))}, '|') + "\n")
+	}
+	tmp := path.Join(dir, manifestFile+".tmp")
+	err := s.writeFile(tmp, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(dir, manifestFile))
+}
@@ -0,0 +1,122 @@
+package wallet
+
+import (
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestService_ExportIncremental(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestService()
+	account, payments, err := s.addAccount(defaultAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.addAccountWithBalance("+992000000002", 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ExportIncremental(dir, FormatDump); err != nil {
+		t.Fatal(err)
+	}
+
+	payment, err := s.Pay(account.ID, 100, "mobile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reject(payments[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.FavoritePayment(payment.ID, "mobile"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ExportIncremental(dir, FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path.Join(dir, "000002-delta", "accounts.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(data), "\n") != 1 || strings.Contains(string(data), string(other.Phone)) {
+		t.Errorf("delta must contain only the changed account: %s", data)
+	}
+	data, err = ioutil.ReadFile(path.Join(dir, "000002-delta", "payments.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(data), "\n") != 2 {
+		t.Errorf("delta must contain the new and the rejected payment: %s", data)
+	}
+
+	// nothing changed, no new delta
+	if err := s.ExportIncremental(dir, FormatDump); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := s.readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("invalid manifest: %v", entries)
+	}
+
+	var got Service
+	if err := got.ImportIncremental(dir); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.accounts, s.accounts) ||
+		!reflect.DeepEqual(got.payments, s.payments) ||
+		!reflect.DeepEqual(got.favorites, s.favorites) {
+		t.Errorf("incremental import differs from the exported service")
+	}
+	if !got.changes.empty() {
+		t.Errorf("imported service must start without changes")
+	}
+}
+
+func TestService_ExportBase_startsNewChain(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestService()
+	account, _, err := s.addAccount(defaultAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ExportIncremental(dir, FormatDump); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Pay(account.ID, 1, "auto"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ExportIncremental(dir, FormatDump); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ExportBase(dir, FormatBinary); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := s.readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastBase(entries) != 2 {
+		t.Fatalf("invalid manifest: %v", entries)
+	}
+
+	var got Service
+	if err := got.ImportIncremental(dir); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.payments, s.payments) {
+		t.Errorf("got: %v, want: %v", got.payments, s.payments)
+	}
+}
+
+func TestService_ImportIncremental_noManifest(t *testing.T) {
+	var s Service
+	if err := s.ImportIncremental(t.TempDir()); err != ErrWrongManifest {
+		t.Errorf("want: %v, got: %v", ErrWrongManifest, err)
+	}
+}
@@ -0,0 +1,317 @@
+package wallet
+
+import (
+	"errors"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var ErrInterestDisabled = errors.New("interest not configured")
+
+const (
+	// LedgerInterest and LedgerCharge are interest posted on positive
+	// balances and charged on negative ones.
+	LedgerInterest LedgerKind = "interest"
+	LedgerCharge   LedgerKind = "charge"
+)
+
+const dayLayout = "2006-01-02"
+
+var interestColumns = []string{"account_id", "type", "last_day", "credit", "overdraft"}
+
+// DayCount is the convention dividing an annual rate into daily ones.
+type DayCount int
+
+const (
+	// DayCountActual365 divides by 365 every year.
+	DayCountActual365 DayCount = iota
+	// DayCountActual360 divides by 360.
+	DayCountActual360
+	// DayCountActualActual divides by the days of the year, 365 or 366.
+	DayCountActualActual
+)
+
+func (d DayCount) yearDays(day time.Time) int64 {
+	switch d {
+	case DayCountActual360:
+		return 360
+	case DayCountActualActual:
+		return int64(time.Date(day.Year(), 12, 31, 0, 0, 0, 0, time.UTC).YearDay())
+	}
+	return 365
+}
+
+type InterestPosting int
+
+const (
+	// PostMonthly posts what accrued on the last day of every month.
+	PostMonthly InterestPosting = iota
+	PostDaily
+)
+
+// Rounding says how posted interest is rounded to types.Money. Interest is
+// rounded once when posted, never while it accrues.
+type Rounding int
+
+const (
+	// RoundHalfEven rounds halves to the even amount.
+	RoundHalfEven Rounding = iota
+	// RoundHalfUp rounds halves away from zero.
+	RoundHalfUp
+	// RoundDown truncates toward zero.
+	RoundDown
+)
+
+// InterestRate is a pair of annual rates in basis points.
+type InterestRate struct {
+	// Credit is paid on positive balances.
+	Credit int64
+	// Overdraft is charged on negative balances.
+	Overdraft int64
+}
+
+type InterestConfig struct {
+	// Rates are by account type, "" is the type of accounts without one.
+	Rates    map[string]InterestRate
+	DayCount DayCount
+	Posting  InterestPosting
+	Rounding Rounding
+}
+
+// interestAccrual is the interest of an account accrued and not posted yet,
+// kept as sums of balance times rate in basis points over the days.
+type interestAccrual struct {
+	AccountID int64  `json:"account_id"`
+	Type      string `json:"type"`
+	// LastDay is the last day accrued, empty before the first run.
+	LastDay   string `json:"last_day"`
+	Credit    int64  `json:"credit"`
+	Overdraft int64  `json:"overdraft"`
+}
+
+// InterestPosted is a posting of one account.
+type InterestPosted struct {
+	EventMeta
+	// Day is the last day of the posted period.
+	Day      time.Time
+	Interest types.Money
+	Charge   types.Money
+	Balance  types.Money
+}
+
+// EndOfDay is what a RunEndOfDay did.
+type EndOfDay struct {
+	// Days are the days closed by the run, in order.
+	Days     []time.Time
+	Postings []InterestPosted
+}
+
+// SetInterest configures interest accrual, nil stops it. Interest accrued
+// and not posted yet is kept.
+func (s *Service) SetInterest(config *InterestConfig) {
+	s.interest = config
+}
+
+// SetAccountType selects the rates of the account.
+func (s *Service) SetAccountType(accountID int64, accountType string) (err error) {
+	op := s.beginOperation("SetAccountType", accountID, map[string]string{"type": accountType},
+		auditTarget{accountID: accountID})
+	defer func() { op.end(err, auditTarget{accountID: accountID}) }()
+	_, err = s.FindAccountByID(accountID)
+	if err != nil {
+		return err
+	}
+	s.accrual(accountID).Type = accountType
+	s.changes.accrual(accountID)
+	return nil
+}
+
+func (s *Service) accrual(accountID int64) *interestAccrual {
+	for _, accrual := range s.accruals {
+		if accrual.AccountID == accountID {
+			return accrual
+		}
+	}
+	accrual := &interestAccrual{AccountID: accountID}
+	s.accruals = append(s.accruals, accrual)
+	return accrual
+}
+
+// RunEndOfDay accrues interest for every day before today, by the clock of
+// the Service, that wasn't accrued yet, and posts it at the end of posting
+// periods. Running it again the same day does nothing, and days missed by
+// earlier runs are caught up with the balances they ended with. Accounts
+// start accruing with the day before their first run.
+func (s *Service) RunEndOfDay() (result *EndOfDay, err error) {
+	op := s.beginOperation("RunEndOfDay", 0, nil, auditTarget{counts: true})
+	defer func() { op.end(err, auditTarget{counts: true}) }()
+	if s.interest == nil {
+		return nil, ErrInterestDisabled
+	}
+	now := s.now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	result = &EndOfDay{Days: make([]time.Time, 0), Postings: make([]InterestPosted, 0)}
+	closed := make(map[string]bool)
+	for _, account := range s.accounts {
+		accrual := s.accrual(account.ID)
+		day := today.AddDate(0, 0, -1)
+		if accrual.LastDay != "" {
+			last, err := time.Parse(dayLayout, accrual.LastDay)
+			if err != nil {
+				return nil, err
+			}
+			day = last.AddDate(0, 0, 1)
+		}
+		for ; day.Before(today); day = day.AddDate(0, 0, 1) {
+			rate := s.interest.Rates[accrual.Type]
+			balance := s.balanceAt(account, day.AddDate(0, 0, 1))
+			if balance > 0 {
+				accrual.Credit += int64(balance) * rate.Credit
+			} else {
+				accrual.Overdraft += int64(-balance) * rate.Overdraft
+			}
+			accrual.LastDay = day.Format(dayLayout)
+			s.changes.accrual(account.ID)
+			if !closed[accrual.LastDay] {
+				closed[accrual.LastDay] = true
+				result.Days = append(result.Days, day)
+			}
+			if s.interest.Posting == PostDaily || day.AddDate(0, 0, 1).Day() == 1 {
+				if posted := s.postInterest(account, accrual, day); posted != nil {
+					result.Postings = append(result.Postings, *posted)
+				}
+			}
+		}
+	}
+	sort.Slice(result.Days, func(i, j int) bool { return result.Days[i].Before(result.Days[j]) })
+	return result, nil
+}
+
+// balanceAt is the balance of the account at the moment end, derived back
+// from the current balance through the ledger.
+func (s *Service) balanceAt(account *types.Account, end time.Time) types.Money {
+	balance := account.Balance
+	for _, entry := range s.ledger {
+		if entry.AccountID == account.ID && entry.Time >= end.Unix() {
+			balance -= entry.Amount
+		}
+	}
+	return balance
+}
+
+// postInterest moves what accrued up to day to the balance, dated to the end
+// of day so that the balance of the following days includes it.
+func (s *Service) postInterest(account *types.Account, accrual *interestAccrual, day time.Time) *InterestPosted {
+	denominator := 10_000 * s.interest.DayCount.yearDays(day)
+	interest := types.Money(roundDiv(accrual.Credit, denominator, s.interest.Rounding))
+	charge := types.Money(roundDiv(accrual.Overdraft, denominator, s.interest.Rounding))
+	accrual.Credit, accrual.Overdraft = 0, 0
+	if interest == 0 && charge == 0 {
+		return nil
+	}
+	end := day.AddDate(0, 0, 1).Unix()
+	if interest != 0 {
+		account.Balance += interest
+		s.record(account, LedgerInterest, interest, nil).Time = end
+	}
+	if charge != 0 {
+		account.Balance -= charge
+		s.record(account, LedgerCharge, -charge, nil).Time = end
+	}
+	s.changes.account(account.ID)
+	posted := InterestPosted{
+		EventMeta: s.eventMeta(account.ID),
+		Day:       day,
+		Interest:  interest,
+		Charge:    charge,
+		Balance:   account.Balance,
+	}
+	s.publish(posted)
+	return &posted
+}
+
+// roundDiv divides a non-negative numerator.
+func roundDiv(numerator int64, denominator int64, rounding Rounding) int64 {
+	quotient, remainder := numerator/denominator, numerator%denominator
+	switch rounding {
+	case RoundHalfUp:
+		if 2*remainder >= denominator {
+			quotient++
+		}
+	case RoundHalfEven:
+		if 2*remainder > denominator || 2*remainder == denominator && quotient%2 == 1 {
+			quotient++
+		}
+	}
+	return quotient
+}
+
+func interestTable(accruals []*interestAccrual) table {
+	return table{
+		columns: interestColumns,
+		rows:    len(accruals),
+		fields:  func(row int) []string { return interestFields(accruals[row]) },
+		value:   func(row int) interface{} { return accruals[row] },
+	}
+}
+
+func interestFields(accrual *interestAccrual) []string {
+	return []string{
+		strconv.FormatInt(accrual.AccountID, 10),
+		accrual.Type,
+		accrual.LastDay,
+		strconv.FormatInt(accrual.Credit, 10),
+		strconv.FormatInt(accrual.Overdraft, 10),
+	}
+}
+
+func parseInterestFields(fields []string, value interface{}) error {
+	if len(fields) < 5 {
+		return ErrWrongLineFormat
+	}
+	accountID, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return err
+	}
+	credit, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return err
+	}
+	overdraft, err := strconv.ParseInt(fields[4], 10, 64)
+	if err != nil {
+		return err
+	}
+	*value.(*interestAccrual) = interestAccrual{
+		AccountID: accountID,
+		Type:      fields[1],
+		LastDay:   fields[2],
+		Credit:    credit,
+		Overdraft: overdraft,
+	}
+	return nil
+}
+
+func (s *Service) interestRecord(index *importIndex) func(fields []string, data []byte) error {
+	return func(fields []string, data []byte) error {
+		accrual := &interestAccrual{}
+		err := decodeRecord(fields, data, accrual, parseInterestFields)
+		if err != nil {
+			s.log().Warn("skipped wrong record", "table", "interest", "error", err)
+			return nil
+		}
+		s.upsertAccrual(index, accrual)
+		return nil
+	}
+}
+
+func (s *Service) upsertAccrual(index *importIndex, accrual *interestAccrual) {
+	s.changes.accrual(accrual.AccountID)
+	if i, ok := index.accruals[accrual.AccountID]; ok {
+		s.accruals[i] = accrual
+		return
+	}
+	index.accruals[accrual.AccountID] = len(s.accruals)
+	s.accruals = append(s.accruals, accrual)
+}
@@ -0,0 +1,153 @@
+package wallet
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestService_RunEndOfDay_monthly(t *testing.T) {
+	s := newTestService(withClock(time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)), withInterest(InterestConfig{
+		Rates: map[string]InterestRate{"savings": {Credit: 1_000}},
+	}))
+	s.addAccounts(t, 0, "1", "2")
+	if err := s.SetAccountType(1, "savings"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deposit(1, 365_000); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deposit(2, 365_000); err != nil {
+		t.Fatal(err)
+	}
+	*s.clock = s.clock.AddDate(0, 0, 1)
+	result, err := s.RunEndOfDay()
+	if err != nil || len(result.Days) != 1 || result.Days[0].Day() != 10 || len(result.Postings) != 0 {
+		t.Fatalf("first run: %+v, %v", result, err)
+	}
+	result, err = s.RunEndOfDay()
+	if err != nil || len(result.Days) != 0 || s.accrual(1).Credit != 365_000*1_000 {
+		t.Fatalf("second run the same day: %+v, %v", result, err)
+	}
+
+	*s.clock = time.Date(2024, 1, 20, 12, 0, 0, 0, time.UTC)
+	if _, err := s.Pay(1, 182_500, "auto"); err != nil {
+		t.Fatal(err)
+	}
+	*s.clock = time.Date(2024, 2, 1, 8, 0, 0, 0, time.UTC)
+	result, err = s.RunEndOfDay()
+	if err != nil || len(result.Days) != 21 {
+		t.Fatalf("catch up run: %+v, %v", result, err)
+	}
+	// 10 days of 365 000 and 12 days of 182 500 at 10%
+	if len(result.Postings) != 1 || result.Postings[0].Interest != 1_000+600 || result.Postings[0].AccountID != 1 {
+		t.Errorf("invalid postings: %+v", result.Postings)
+	}
+	if account, _ := s.FindAccountByID(1); account.Balance != 182_500+1_600 {
+		t.Errorf("interest not posted: %d", account.Balance)
+	}
+	entry := s.ledger[len(s.ledger)-1]
+	if entry.Kind != LedgerInterest || entry.Time != time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC).Unix() {
+		t.Errorf("invalid ledger entry: %+v", entry)
+	}
+	if accrual := s.accrual(1); accrual.Credit != 0 || accrual.LastDay != "2024-01-31" {
+		t.Errorf("accrual not reset: %+v", accrual)
+	}
+	reconciliation, err := s.Reconcile(context.Background(), ReconcileOptions{})
+	if err != nil || len(reconciliation.Discrepancies) != 0 {
+		t.Errorf("interest not reconciled: %+v, %v", reconciliation, err)
+	}
+}
+
+func TestService_RunEndOfDay_overdraftDaily(t *testing.T) {
+	s := newTestService(withClock(time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)), withInterest(InterestConfig{
+		Rates:    map[string]InterestRate{"": {Credit: 500, Overdraft: 1_825}},
+		Posting:  PostDaily,
+		Rounding: RoundHalfUp,
+	}))
+	s.addAccounts(t, 0, "1", "2")
+	if _, err := s.Pay(2, 1_000, "auto"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RunEndOfDay(); err != nil {
+		t.Fatal(err)
+	}
+	*s.clock = s.clock.AddDate(0, 0, 3)
+	result, err := s.RunEndOfDay()
+	if err != nil || len(result.Postings) != 3 {
+		t.Fatalf("%+v, %v", result, err)
+	}
+	// 1 000 at 18.25% is half a unit a day, rounded up
+	for _, posted := range result.Postings {
+		if posted.AccountID != 2 || posted.Charge != 1 || posted.Interest != 0 {
+			t.Errorf("invalid posting: %+v", posted)
+		}
+	}
+	if account, _ := s.FindAccountByID(2); account.Balance != -1_003 {
+		t.Errorf("charges not posted: %d", account.Balance)
+	}
+}
+
+func TestService_RunEndOfDay_disabled(t *testing.T) {
+	s := &Service{}
+	if _, err := s.RunEndOfDay(); err != ErrInterestDisabled {
+		t.Errorf("want: %v, got: %v", ErrInterestDisabled, err)
+	}
+}
+
+func Test_roundDiv(t *testing.T) {
+	tests := []struct {
+		numerator int64
+		rounding  Rounding
+		want      int64
+	}{
+		{25, RoundHalfEven, 2},
+		{35, RoundHalfEven, 4},
+		{36, RoundHalfEven, 4},
+		{25, RoundHalfUp, 3},
+		{24, RoundHalfUp, 2},
+		{29, RoundDown, 2},
+	}
+	for _, test := range tests {
+		if got := roundDiv(test.numerator, 10, test.rounding); got != test.want {
+			t.Errorf("roundDiv(%d, 10, %d) = %d, want: %d", test.numerator, test.rounding, got, test.want)
+		}
+	}
+}
+
+func TestDayCount_yearDays(t *testing.T) {
+	leap, common := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC)
+	if DayCountActualActual.yearDays(leap) != 366 || DayCountActualActual.yearDays(common) != 365 ||
+		DayCountActual365.yearDays(leap) != 365 || DayCountActual360.yearDays(leap) != 360 {
+		t.Error("invalid year days")
+	}
+}
+
+func TestService_interest_roundTrip(t *testing.T) {
+	for _, format := range []Format{FormatDump, FormatJSON, FormatCSV, FormatBinary} {
+		s := newTestService(withClock(time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)), withInterest(InterestConfig{Rates: map[string]InterestRate{"savings": {Credit: 700}}}))
+		s.addAccounts(t, 0, "1", "2")
+		if err := s.SetAccountType(1, "savings"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Deposit(1, 10_000); err != nil {
+			t.Fatal(err)
+		}
+		*s.clock = s.clock.AddDate(0, 0, 2)
+		if _, err := s.RunEndOfDay(); err != nil {
+			t.Fatal(err)
+		}
+		dir := t.TempDir()
+		if err := s.ExportFormat(dir, format); err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		var got Service
+		if err := got.ImportFormat(dir, format); err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		if !reflect.DeepEqual(got.accruals, s.accruals) {
+			t.Errorf("format %d: accruals got: %v, want: %v", format, got.accruals, s.accruals)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package wallet
+
+import (
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"strconv"
+)
+
+// LedgerKind tells what moved an account balance.
+type LedgerKind string
+
+const (
+	LedgerDeposit LedgerKind = "deposit"
+	LedgerPayment LedgerKind = "payment"
+	LedgerRefund  LedgerKind = "refund"
+	// LedgerReversal takes a deposit back.
+	LedgerReversal LedgerKind = "reversal"
+	// LedgerAdjustment corrects a balance found wrong by Reconcile.
+	LedgerAdjustment LedgerKind = "adjustment"
+	// LedgerSplit paid a part of a split bill, refunded it, or collected the
+	// parts to the account paying the bill before parts were payments. Only
+	// refunds of such parts are still recorded.
+	LedgerSplit LedgerKind = "split"
+)
+
+var ledgerColumns = []string{"id", "account_id", "time", "kind", "amount", "balance", "payment_id", "category", "reason", "deposit_id", "split_id"}
+
+// ledgerOptionalColumns may be missing from files written before they were
+// added.
+var ledgerOptionalColumns = []string{"reason", "deposit_id", "split_id"}
+
+// LedgerEntry is one change of an account balance. Amount is positive when
+// money comes in and negative when it goes out, Balance is the balance right
+// after the change.
+type LedgerEntry struct {
+	ID        int64 `json:"id"`
+	AccountID int64 `json:"account_id"`
+	// Time is the Unix time in seconds of the change.
+	Time      int64                 `json:"time"`
+	Kind      LedgerKind            `json:"kind"`
+	Amount    types.Money           `json:"amount"`
+	Balance   types.Money           `json:"balance"`
+	PaymentID string                `json:"payment_id,omitempty"`
+	Category  types.PaymentCategory `json:"category,omitempty"`
+	// Reason is why an adjustment was made.
+	Reason    string `json:"reason,omitempty"`
+	DepositID string `json:"deposit_id,omitempty"`
+	SplitID   string `json:"split_id,omitempty"`
+}
+
+// record appends the change of the balance of account, which has already
+// been applied, to the ledger. payment is nil for changes not made by a
+// payment.
+func (s *Service) record(account *types.Account, kind LedgerKind, amount types.Money,
+	payment *types.Payment,
+) *LedgerEntry {
+	s.nextLedgerID++
+	entry := &LedgerEntry{
+		ID:        s.nextLedgerID,
+		AccountID: account.ID,
+		Time:      s.now().Unix(),
+		Kind:      kind,
+		Amount:    amount,
+		Balance:   account.Balance,
+	}
+	if payment != nil {
+		entry.PaymentID = payment.ID
+		entry.Category = payment.Category
+	}
+	s.ledger = append(s.ledger, entry)
+	s.changes.ledgerEntry(entry.ID)
+	return entry
+}
+
+// Ledger returns the balance changes of the account in the order they were
+// made.
+func (s *Service) Ledger(accountID int64) ([]LedgerEntry, error) {
+	_, err := s.FindAccountByID(accountID)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]LedgerEntry, 0)
+	for _, entry := range s.ledger {
+		if entry.AccountID == accountID {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries, nil
+}
+
+func ledgerTable(ledger []*LedgerEntry) table {
+	return table{
+		columns: ledgerColumns,
+		rows:    len(ledger),
+		fields:  func(row int) []string { return ledgerFields(ledger[row]) },
+		value:   func(row int) interface{} { return ledger[row] },
+	}
+}
+
+func ledgerFields(entry *LedgerEntry) []string {
+	return []string{
+		strconv.FormatInt(entry.ID, 10),
+		strconv.FormatInt(entry.AccountID, 10),
+		strconv.FormatInt(entry.Time, 10),
+		string(entry.Kind),
+		strconv.FormatInt(int64(entry.Amount), 10),
+		strconv.FormatInt(int64(entry.Balance), 10),
+		entry.PaymentID,
+		string(entry.Category),
+		entry.Reason,
+		entry.DepositID,
+		entry.SplitID,
+	}
+}
+
+func parseLedgerFields(fields []string, value interface{}) error {
+	if len(fields) < 8 {
+		return ErrWrongLineFormat
+	}
+	numbers := make([]int64, 0, 5)
+	for _, i := range []int{0, 1, 2, 4, 5} {
+		n, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil {
+			return err
+		}
+		numbers = append(numbers, n)
+	}
+	reason, depositID, splitID := "", "", ""
+	if len(fields) > 8 {
+		reason = fields[8]
+	}
+	if len(fields) > 9 {
+		depositID = fields[9]
+	}
+	if len(fields) > 10 {
+		splitID = fields[10]
+	}
+	*value.(*LedgerEntry) = LedgerEntry{
+		ID:        numbers[0],
+		AccountID: numbers[1],
+		Time:      numbers[2],
+		Kind:      LedgerKind(fields[3]),
+		Amount:    types.Money(numbers[3]),
+		Balance:   types.Money(numbers[4]),
+		PaymentID: fields[6],
+		Category:  types.PaymentCategory(fields[7]),
+		Reason:    reason,
+		DepositID: depositID,
+		SplitID:   splitID,
+	}
+	return nil
+}
+
+func (s *Service) ledgerRecord(index *importIndex) func(fields []string, data []byte) error {
+	return func(fields []string, data []byte) error {
+		entry := &LedgerEntry{}
+		err := decodeRecord(fields, data, entry, parseLedgerFields)
+		if err != nil {
+			s.log().Warn("skipped wrong record", "table", "ledger", "error", err)
+			return nil
+		}
+		s.upsertLedgerEntry(index, entry)
+		return nil
+	}
+}
+
+func (s *Service) upsertLedgerEntry(index *importIndex, entry *LedgerEntry) {
+	s.changes.ledgerEntry(entry.ID)
+	if i, ok := index.ledger[entry.ID]; ok {
+		s.ledger[i] = entry
+		return
+	}
+	index.ledger[entry.ID] = len(s.ledger)
+	s.ledger = append(s.ledger, entry)
+	if entry.ID > s.nextLedgerID {
+		s.nextLedgerID = entry.ID
+	}
+}
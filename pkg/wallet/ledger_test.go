@@ -0,0 +1,84 @@
+package wallet
+
+import (
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestService_record(t *testing.T) {
+	s := newTestService(withClock(time.Unix(1700000000, 0)))
+	account, err := s.addAccountWithBalance("1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account.Balance = 300
+	deposit := s.record(account, LedgerDeposit, 300, nil)
+	account.Balance = 250
+	payment := &types.Payment{ID: "p1", AccountID: account.ID, Amount: 50, Category: "food"}
+	paid := s.record(account, LedgerPayment, -50, payment)
+
+	want := []*LedgerEntry{
+		{ID: 1, AccountID: 1, Time: 1700000000, Kind: LedgerDeposit, Amount: 300, Balance: 300},
+		{ID: 2, AccountID: 1, Time: 1700000000, Kind: LedgerPayment, Amount: -50, Balance: 250, PaymentID: "p1", Category: "food"},
+	}
+	if !reflect.DeepEqual(s.ledger, want) || s.ledger[0] != deposit || s.ledger[1] != paid {
+		t.Errorf("got: %+v, want: %+v", s.ledger, want)
+	}
+	if !s.changes.ledger[1] || !s.changes.ledger[2] {
+		t.Errorf("entries not tracked: %v", s.changes.ledger)
+	}
+}
+
+func TestService_Ledger_order(t *testing.T) {
+	s := newTestService(withClock(time.Unix(1700000000, 0)))
+	s.addAccounts(t, 1_000, "1", "2")
+	payment, err := s.Pay(1, 100, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deposit(2, 500); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reject(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := s.Ledger(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []LedgerKind
+	var balances []types.Money
+	for i, entry := range entries {
+		if i > 0 && entry.ID <= entries[i-1].ID {
+			t.Errorf("entries out of order: %+v", entries)
+		}
+		kinds = append(kinds, entry.Kind)
+		balances = append(balances, entry.Balance)
+	}
+	if !reflect.DeepEqual(kinds, []LedgerKind{LedgerDeposit, LedgerPayment, LedgerRefund}) ||
+		!reflect.DeepEqual(balances, []types.Money{1_000, 900, 1_000}) {
+		t.Errorf("invalid entries: %+v", entries)
+	}
+	if _, err := s.Ledger(3); err != ErrAccountNotFound {
+		t.Errorf("want: %v, got: %v", ErrAccountNotFound, err)
+	}
+
+	// Imported entries keep their IDs and new ones follow them.
+	dir := t.TempDir()
+	if err := s.ExportFormat(dir, FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	got := newTestService()
+	if err := got.ImportFormat(dir, FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	if err := got.Deposit(1, 10); err != nil {
+		t.Fatal(err)
+	}
+	if last := got.ledger[len(got.ledger)-1]; last.ID != int64(len(s.ledger))+1 {
+		t.Errorf("invalid ID after import: %+v", last)
+	}
+}
@@ -0,0 +1,114 @@
+package wallet
+
+import (
+	"context"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"log/slog"
+	"strings"
+)
+
+// piiKeys are attribute keys whose values never reach the log as is.
+var piiKeys = map[string]bool{
+	"phone":    true,
+	"balance":  true,
+	"pin":      true,
+	"password": true,
+	"secret":   true,
+	"token":    true,
+}
+
+const redacted = "[REDACTED]"
+
+// SetLogger sets the logger of the Service, its records go through
+// NewRedactingHandler. Nil restores slog.Default.
+func (s *Service) SetLogger(logger *slog.Logger) {
+	s.logger = nil
+	if logger != nil {
+		s.logger = slog.New(NewRedactingHandler(logger.Handler()))
+	}
+}
+
+func (s *Service) log() *slog.Logger {
+	if s.logger != nil {
+		return s.logger
+	}
+	return slog.New(NewRedactingHandler(slog.Default().Handler()))
+}
+
+// NewRedactingHandler masks personal data before handler sees it: values
+// of keys such as phone or secret, phones and accounts of any key.
+func NewRedactingHandler(handler slog.Handler) slog.Handler {
+	if _, ok := handler.(*redactingHandler); ok {
+		return handler
+	}
+	return &redactingHandler{handler: handler}
+}
+
+type redactingHandler struct {
+	handler slog.Handler
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, record slog.Record) error {
+	clean := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		clean.AddAttrs(redactAttr(attr))
+		return true
+	})
+	return h.handler.Handle(ctx, clean)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clean := make([]slog.Attr, 0, len(attrs))
+	for _, attr := range attrs {
+		clean = append(clean, redactAttr(attr))
+	}
+	return &redactingHandler{handler: h.handler.WithAttrs(clean)}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{handler: h.handler.WithGroup(name)}
+}
+
+func redactAttr(attr slog.Attr) slog.Attr {
+	value := attr.Value.Resolve()
+	switch {
+	case value.Kind() == slog.KindGroup:
+		attrs := value.Group()
+		clean := make([]slog.Attr, 0, len(attrs))
+		for _, a := range attrs {
+			clean = append(clean, redactAttr(a))
+		}
+		return slog.Attr{Key: attr.Key, Value: slog.GroupValue(clean...)}
+	case strings.EqualFold(attr.Key, "phone"):
+		return slog.String(attr.Key, maskPhone(value.String()))
+	case piiKeys[strings.ToLower(attr.Key)]:
+		return slog.String(attr.Key, redacted)
+	}
+	if value.Kind() != slog.KindAny {
+		return slog.Attr{Key: attr.Key, Value: value}
+	}
+	switch v := value.Any().(type) {
+	case types.Phone:
+		return slog.String(attr.Key, maskPhone(string(v)))
+	case types.Account:
+		return slog.Group(attr.Key, slog.Int64("id", v.ID))
+	case *types.Account:
+		if v != nil {
+			return slog.Group(attr.Key, slog.Int64("id", v.ID))
+		}
+	}
+	return slog.Attr{Key: attr.Key, Value: value}
+}
+
+// maskPhone keeps the last two digits, enough to tell phones apart in
+// support requests.
+func maskPhone(phone string) string {
+	if len(phone) <= 2 {
+		return "**"
+	}
+	return strings.Repeat("*", len(phone)-2) + phone[len(phone)-2:]
+}
@@ -0,0 +1,61 @@
+package wallet
+
+import (
+	"bytes"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"io/ioutil"
+	"log/slog"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestNewRedactingHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(NewRedactingHandler(slog.NewTextHandler(&buf, nil)))
+	account := &types.Account{ID: 7, Phone: "+992000000001", Balance: 100}
+	logger.With("secret", "s3cr3t").Info("test",
+		"phone", "+992985410248",
+		"owner", types.Phone("+992000000002"),
+		"account", account,
+		slog.Group("request", "pin", "1234", "amount", 10),
+	)
+	got := buf.String()
+	for _, leaked := range []string{"s3cr3t", "+992985410248", "+992000000002", "+992000000001", "1234"} {
+		if strings.Contains(got, leaked) {
+			t.Errorf("%q leaked: %s", leaked, got)
+		}
+	}
+	for _, kept := range []string{"phone=***********48", "account.id=7", "request.amount=10"} {
+		if !strings.Contains(got, kept) {
+			t.Errorf("%q missing: %s", kept, got)
+		}
+	}
+}
+
+func TestService_SetLogger(t *testing.T) {
+	dir := t.TempDir()
+	content := dumpHeader + "\n1|+992000000001|100\nwrong|+992000000002|x\n"
+	if err := ioutil.WriteFile(path.Join(dir, "accounts.dump"), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	var s Service
+	s.SetLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	if err := s.Import(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RegisterAccount("+992000000001"); err != ErrPhoneRegistered {
+		t.Errorf("want: %v, got: %v", ErrPhoneRegistered, err)
+	}
+	got := buf.String()
+	if strings.Contains(got, "+99200000000") {
+		t.Errorf("phone leaked: %s", got)
+	}
+	for _, want := range []string{"level=WARN msg=\"skipped wrong record\" table=accounts",
+		"msg=\"operation done\" operation=Import", "msg=\"operation failed\" operation=RegisterAccount"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%q missing: %s", want, got)
+		}
+	}
+}
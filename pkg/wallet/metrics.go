@@ -0,0 +1,255 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics receives the measurements of a Service. Implementations must be
+// safe for concurrent use.
+type Metrics interface {
+	// Operation is called once per call of a mutating method.
+	Operation(operation string, err error, duration time.Duration)
+	// Payment is called for every payment made, repeated ones included.
+	Payment(category types.PaymentCategory, amount types.Money)
+}
+
+func (s *Service) SetMetrics(metrics Metrics) {
+	s.metrics = metrics
+}
+
+func (s *Service) observePayment(payment *types.Payment) {
+	if s.metrics != nil {
+		s.metrics.Payment(payment.Category, payment.Amount)
+	}
+}
+
+// errorKinds name the errors of the package in metric labels, any other
+// error is "other".
+var errorKinds = []struct {
+	err  error
+	kind string
+}{
+	{ErrAccountNotFound, "account_not_found"},
+	{ErrPhoneRegistered, "phone_registered"},
+	{ErrAmountMustBePositive, "amount_not_positive"},
+	{ErrPaymentNotFound, "payment_not_found"},
+	{ErrFavoriteNotFound, "favorite_not_found"},
+	{ErrPaymentAlreadyRejected, "payment_already_rejected"},
+	{ErrWrongLineFormat, "wrong_format"},
+	{ErrWrongHeader, "wrong_format"},
+	{ErrUnknownFormat, "wrong_format"},
+	{ErrWrongSnapshot, "wrong_format"},
+	{ErrWrongManifest, "wrong_format"},
+	{ErrUnsupportedSnapshotVersion, "wrong_format"},
+	{ErrSnapshotStringTooLong, "wrong_format"},
+	{ErrWrongCursor, "wrong_cursor"},
+	{ErrDecryptionFailed, "decryption"},
+	{ErrWrongKey, "decryption"},
+	{ErrUnknownKey, "decryption"},
+	{ErrNoKeyProvider, "decryption"},
+	{ErrWrongEncryptedFile, "decryption"},
+	{ErrNotEncrypted, "decryption"},
+	{ErrWrongWebhookURL, "wrong_webhook_url"},
+	{ErrWebhookNotFound, "webhook_not_found"},
+	{ErrDeliveryNotFound, "delivery_not_found"},
+	{ErrAuditTampered, "audit_tampered"},
+	{ErrCredentialsNotSet, "credentials_not_set"},
+	{ErrCredentialsSet, "credentials_set"},
+	{ErrWeakPIN, "weak_pin"},
+	{ErrWrongPIN, "wrong_pin"},
+	{ErrAccountLocked, "account_locked"},
+	{ErrWrongResetCode, "wrong_reset_code"},
+	{ErrSessionRequired, "session_required"},
+	{ErrInvalidSession, "invalid_session"},
+	{ErrPermissionDenied, "permission_denied"},
+	{ErrPaymentBlocked, "payment_blocked"},
+	{ErrPaymentNotInReview, "payment_not_in_review"},
+	{ErrWrongPeriod, "wrong_period"},
+	{ErrReasonRequired, "reason_required"},
+	{ErrDepositNotFound, "deposit_not_found"},
+	{ErrDepositReversed, "deposit_reversed"},
+	{ErrWrongDepositSource, "wrong_deposit_source"},
+	{ErrWrongBudget, "wrong_budget"},
+	{ErrBudgetExceeded, "budget_exceeded"},
+	{ErrRewardsDisabled, "rewards_disabled"},
+	{ErrNotEnoughPoints, "not_enough_points"},
+	{ErrInterestDisabled, "interest_disabled"},
+	{ErrSplitNotFound, "split_not_found"},
+	{ErrWrongSplit, "wrong_split"},
+	{ErrSplitClosed, "split_closed"},
+	{ErrSplitExpired, "split_expired"},
+	{ErrNotInSplit, "not_in_split"},
+	{ErrPartPaid, "part_paid"},
+	{ErrPaymentRequestNotFound, "payment_request_not_found"},
+	{ErrPaymentRequestClosed, "payment_request_closed"},
+	{ErrPaymentRequestExpired, "payment_request_expired"},
+	{ErrWrongPaymentRequest, "wrong_payment_request"},
+}
+
+func ErrorKind(err error) string {
+	for _, known := range errorKinds {
+		if errors.Is(err, known.err) {
+			return known.kind
+		}
+	}
+	return "other"
+}
+
+var defaultLatencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// MetricsRegistry keeps the metrics in memory and serves them in the
+// Prometheus text format.
+type MetricsRegistry struct {
+	mu         sync.Mutex
+	operations map[string]int64
+	failures   map[[2]string]int64
+	payments   map[types.PaymentCategory]int64
+	amounts    map[types.PaymentCategory]types.Money
+	latencies  map[string]*histogram
+}
+
+type histogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{
+		operations: make(map[string]int64),
+		failures:   make(map[[2]string]int64),
+		payments:   make(map[types.PaymentCategory]int64),
+		amounts:    make(map[types.PaymentCategory]types.Money),
+		latencies:  make(map[string]*histogram),
+	}
+}
+
+func (r *MetricsRegistry) Operation(operation string, err error, duration time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.operations[operation]++
+	if err != nil {
+		r.failures[[2]string{operation, ErrorKind(err)}]++
+	}
+	h := r.latencies[operation]
+	if h == nil {
+		h = &histogram{counts: make([]int64, len(defaultLatencyBuckets))}
+		r.latencies[operation] = h
+	}
+	seconds := duration.Seconds()
+	for i, bound := range defaultLatencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func (r *MetricsRegistry) Payment(category types.PaymentCategory, amount types.Money) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.payments[category]++
+	r.amounts[category] += amount
+}
+
+// ServeHTTP writes every metric in the Prometheus text exposition format.
+func (r *MetricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = r.WriteText(w)
+}
+
+func (r *MetricsRegistry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var b strings.Builder
+
+	b.WriteString("# HELP wallet_operations_total Calls of mutating operations.\n")
+	b.WriteString("# TYPE wallet_operations_total counter\n")
+	for _, operation := range sortedKeys(r.operations) {
+		fmt.Fprintf(&b, "wallet_operations_total{operation=%s} %d\n", quoteLabel(operation), r.operations[operation])
+	}
+
+	b.WriteString("# HELP wallet_operation_failures_total Failed operations by error kind.\n")
+	b.WriteString("# TYPE wallet_operation_failures_total counter\n")
+	failures := make([][2]string, 0, len(r.failures))
+	for key := range r.failures {
+		failures = append(failures, key)
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		if failures[i][0] != failures[j][0] {
+			return failures[i][0] < failures[j][0]
+		}
+		return failures[i][1] < failures[j][1]
+	})
+	for _, key := range failures {
+		fmt.Fprintf(&b, "wallet_operation_failures_total{operation=%s,kind=%s} %d\n",
+			quoteLabel(key[0]), quoteLabel(key[1]), r.failures[key])
+	}
+
+	categories := make([]string, 0, len(r.payments))
+	for category := range r.payments {
+		categories = append(categories, string(category))
+	}
+	sort.Strings(categories)
+	b.WriteString("# HELP wallet_payments_total Payments by category.\n")
+	b.WriteString("# TYPE wallet_payments_total counter\n")
+	for _, category := range categories {
+		fmt.Fprintf(&b, "wallet_payments_total{category=%s} %d\n",
+			quoteLabel(category), r.payments[types.PaymentCategory(category)])
+	}
+	b.WriteString("# HELP wallet_payment_amount_total Paid amount by category.\n")
+	b.WriteString("# TYPE wallet_payment_amount_total counter\n")
+	for _, category := range categories {
+		fmt.Fprintf(&b, "wallet_payment_amount_total{category=%s} %d\n",
+			quoteLabel(category), r.amounts[types.PaymentCategory(category)])
+	}
+
+	b.WriteString("# HELP wallet_operation_duration_seconds Latency of mutating operations.\n")
+	b.WriteString("# TYPE wallet_operation_duration_seconds histogram\n")
+	operations := make([]string, 0, len(r.latencies))
+	for operation := range r.latencies {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+	for _, operation := range operations {
+		h := r.latencies[operation]
+		label := quoteLabel(operation)
+		for i, bound := range defaultLatencyBuckets {
+			fmt.Fprintf(&b, "wallet_operation_duration_seconds_bucket{operation=%s,le=\"%s\"} %d\n",
+				label, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(&b, "wallet_operation_duration_seconds_bucket{operation=%s,le=\"+Inf\"} %d\n", label, h.count)
+		fmt.Fprintf(&b, "wallet_operation_duration_seconds_sum{operation=%s} %s\n",
+			label, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(&b, "wallet_operation_duration_seconds_count{operation=%s} %d\n", label, h.count)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func quoteLabel(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	return `"` + value + `"`
+}
@@ -0,0 +1,93 @@
+package wallet
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsRegistry(t *testing.T) {
+	metrics := NewMetricsRegistry()
+	s := &Service{}
+	s.SetMetrics(metrics)
+	account, err := s.RegisterAccount("123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deposit(account.ID, 100); err != nil {
+		t.Fatal(err)
+	}
+	payment, err := s.Pay(account.ID, 30, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Repeat(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Pay(account.ID, 5, `fo"od`); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deposit(42, 10); err != ErrAccountNotFound {
+		t.Fatal(err)
+	}
+	if err := s.Reject("none"); err != ErrPaymentNotFound {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(metrics)
+	defer server.Close()
+	response, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(response.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("invalid content type: %s", response.Header.Get("Content-Type"))
+	}
+	got := string(body)
+	for _, want := range []string{
+		`wallet_operations_total{operation="Deposit"} 2`,
+		`wallet_operations_total{operation="Pay"} 2`,
+		`wallet_operation_failures_total{operation="Deposit",kind="account_not_found"} 1`,
+		`wallet_operation_failures_total{operation="Reject",kind="payment_not_found"} 1`,
+		`wallet_payments_total{category="auto"} 2`,
+		`wallet_payment_amount_total{category="auto"} 60`,
+		`wallet_payment_amount_total{category="fo\"od"} 5`,
+		`wallet_operation_duration_seconds_bucket{operation="Pay",le="+Inf"} 2`,
+		`wallet_operation_duration_seconds_count{operation="Repeat"} 1`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%s missing:\n%s", want, got)
+		}
+	}
+}
+
+func TestErrorKind(t *testing.T) {
+	if ErrorKind(ErrPhoneRegistered) != "phone_registered" || ErrorKind(ErrWrongHeader) != "wrong_format" {
+		t.Errorf("invalid kinds")
+	}
+	for _, err := range []error{
+		ErrUnsupportedSnapshotVersion, ErrSnapshotStringTooLong, ErrWrongCursor, ErrNoKeyProvider, ErrWrongEncryptedFile, ErrNotEncrypted,
+		ErrWrongWebhookURL, ErrWebhookNotFound, ErrDeliveryNotFound, ErrAuditTampered,
+		ErrCredentialsNotSet, ErrCredentialsSet, ErrWeakPIN, ErrWrongPIN, ErrAccountLocked, ErrWrongResetCode,
+		ErrSessionRequired, ErrInvalidSession, ErrPaymentAlreadyRejected, ErrPermissionDenied,
+		ErrPaymentBlocked, ErrPaymentNotInReview, ErrWrongPeriod,
+		ErrReasonRequired, ErrDepositNotFound, ErrDepositReversed, ErrWrongDepositSource, ErrWrongBudget, ErrBudgetExceeded,
+		ErrRewardsDisabled, ErrNotEnoughPoints, ErrInterestDisabled,
+		ErrSplitNotFound, ErrWrongSplit, ErrSplitClosed, ErrSplitExpired, ErrNotInSplit, ErrPartPaid,
+		ErrPaymentRequestNotFound, ErrPaymentRequestClosed, ErrPaymentRequestExpired, ErrWrongPaymentRequest,
+	} {
+		if ErrorKind(err) == "other" {
+			t.Errorf("%v has no kind", err)
+		}
+	}
+	if ErrorKind(errors.New("boom")) != "other" {
+		t.Errorf("unknown errors must be other")
+	}
+}
@@ -0,0 +1,70 @@
+package wallet
+
+import (
+	"time"
+)
+
+// operationRecord follows one call of a mutating method: it is appended to
+// the audit log, reported to the metrics and logged.
+type operationRecord struct {
+	s     *Service
+	start time.Time
+	entry AuditEntry
+}
+
+// beginOperation captures the state before an operation, end records it
+// once it returned. Both do nothing when there is no audit log, metrics or
+// logger to record to.
+func (s *Service) beginOperation(operation string, accountID int64, params map[string]string,
+	before auditTarget,
+) *operationRecord {
+	if s.auditLog == nil && s.metrics == nil && s.logger == nil {
+		return nil
+	}
+	r := &operationRecord{s: s, start: time.Now(), entry: AuditEntry{
+		Time:      s.now().UTC(),
+		Actor:     s.actor,
+		Operation: operation,
+		AccountID: accountID,
+		Params:    params,
+	}}
+	if s.auditLog != nil {
+		r.entry.Before = s.auditState(before)
+	}
+	return r
+}
+
+func (r *operationRecord) end(err error, after auditTarget) {
+	if r == nil {
+		return
+	}
+	s := r.s
+	duration := time.Since(r.start)
+	if r.entry.AccountID == 0 {
+		r.entry.AccountID = after.accountID
+	}
+	if s.metrics != nil {
+		s.metrics.Operation(r.entry.Operation, err, duration)
+	}
+	if s.logger != nil {
+		attrs := []interface{}{"operation", r.entry.Operation, "account_id", r.entry.AccountID,
+			"actor", r.entry.Actor, "duration", duration}
+		if err != nil {
+			s.log().Info("operation failed", append(attrs, "error", err)...)
+		} else {
+			s.log().Debug("operation done", attrs...)
+		}
+	}
+	if s.auditLog == nil {
+		return
+	}
+	r.entry.Outcome = "ok"
+	if err != nil {
+		r.entry.Outcome = err.Error()
+	}
+	r.entry.After = s.auditState(after)
+	err = s.auditLog.append(r.entry)
+	if err != nil {
+		s.log().Error("audit log append failed", "operation", r.entry.Operation, "error", err)
+	}
+}
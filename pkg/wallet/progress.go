@@ -0,0 +1,199 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+)
+
+// defaultPartSize is the number of payments per part reported by
+// SumPaymentsWithProgress when ProgressOptions.PartSize is not set.
+const defaultPartSize = 100_000
+
+type ProgressOptions struct {
+	// PartSize is the number of payments per part of a scan. Zero keeps the
+	// default: one part per goroutine, or defaultPartSize for
+	// SumPaymentsWithProgress.
+	PartSize int
+	// Report is called after every finished part. Calls never overlap.
+	Report func(progress Progress)
+}
+
+func (o ProgressOptions) partSize(n int, goroutines int) int {
+	if o.PartSize > 0 {
+		return o.PartSize
+	}
+	return partSizeFor(n, goroutines)
+}
+
+// progressReporter accumulates finished parts. A nil reporter does nothing,
+// so operations report unconditionally.
+type progressReporter struct {
+	mu       sync.Mutex
+	report   func(progress Progress)
+	progress Progress
+}
+
+func newProgressReporter(report func(progress Progress), parts int, totalRecords int, totalBytes int64) *progressReporter {
+	if report == nil {
+		return nil
+	}
+	return &progressReporter{
+		report: report,
+		progress: Progress{
+			Parts:        parts,
+			TotalRecords: totalRecords,
+			TotalBytes:   totalBytes,
+		},
+	}
+}
+
+func (r *progressReporter) part(part int, records int, bytes int64, result types.Money) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.progress.Done++
+	r.progress.Records += records
+	r.progress.Bytes += bytes
+	progress := r.progress
+	progress.Part = part
+	progress.Result = result
+	r.report(progress)
+}
+
+// ExportWithProgress is ExportFormat reporting every written file as a part.
+// ctx is checked before each file.
+func (s *Service) ExportWithProgress(ctx context.Context, dir string, format Format, options ProgressOptions) error {
+	if format.binary() {
+		records := len(s.accounts) + len(s.payments) + len(s.favorites)
+		report := newProgressReporter(options.Report, 1, records, 0)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := exportSnapshot(dir, s, format)
+		if err != nil {
+			return err
+		}
+		for _, t := range s.exportTables() {
+			if !t.sidecar {
+				continue
+			}
+			written, err := s.writeTable(path.Join(dir, t.name+FormatDump.extension()), FormatDump, t.table)
+			if err != nil {
+				return err
+			}
+			n += written
+		}
+		report.part(0, records, int64(n), 0)
+		return nil
+	}
+
+	tables := s.exportTables()
+	records := 0
+	for _, t := range tables {
+		records += t.table.rows
+	}
+	report := newProgressReporter(options.Report, len(tables), records, 0)
+	for i, t := range tables {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := s.writeTable(path.Join(dir, t.name+format.extension()), format, t.table)
+		if err != nil {
+			return err
+		}
+		report.part(i, t.table.rows, int64(n), 0)
+	}
+	return nil
+}
+
+// ImportWithProgress is ImportFormat reporting every read file as a part.
+// The total number of records isn't known before reading, TotalBytes is.
+func (s *Service) ImportWithProgress(ctx context.Context, dir string, format Format, options ProgressOptions) (err error) {
+	op := s.beginOperation("Import", 0, map[string]string{"dir": dir, "format": strconv.Itoa(int(format))},
+		auditTarget{counts: true})
+	defer func() { op.end(err, auditTarget{counts: true}) }()
+	return s.importDir(ctx, dir, format, options)
+}
+
+func (s *Service) importDir(ctx context.Context, dir string, format Format, options ProgressOptions) error {
+	if format.binary() {
+		filename := path.Join(dir, "wallet"+format.extension())
+		size := fileSize(filename)
+		report := newProgressReporter(options.Report, 1, 0, size)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		data, err := s.readFile(filename)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		before := len(s.accounts) + len(s.payments) + len(s.favorites)
+		err = s.readSnapshot(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		for _, t := range s.importTables(s.newImportIndex()) {
+			if !t.optional {
+				continue
+			}
+			err = s.readTable(path.Join(dir, t.name+FormatDump.extension()), FormatDump, t.columns,
+				t.optionalColumns, t.record)
+			if err != nil {
+				return err
+			}
+		}
+		report.part(0, len(s.accounts)+len(s.payments)+len(s.favorites)-before, size, 0)
+		return nil
+	}
+
+	tables := make([]importTable, 0)
+	for _, t := range s.importTables(s.newImportIndex()) {
+		if _, err := os.Stat(path.Join(dir, t.name+format.extension())); t.optional && os.IsNotExist(err) {
+			continue
+		}
+		tables = append(tables, t)
+	}
+	sizes := make([]int64, len(tables))
+	totalBytes := int64(0)
+	for i, t := range tables {
+		sizes[i] = fileSize(path.Join(dir, t.name+format.extension()))
+		totalBytes += sizes[i]
+	}
+	report := newProgressReporter(options.Report, len(tables), 0, totalBytes)
+	for i, t := range tables {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		records := 0
+		record := t.record
+		err := s.readTable(path.Join(dir, t.name+format.extension()), format, t.columns, t.optionalColumns,
+			func(fields []string, data []byte) error {
+				records++
+				return record(fields, data)
+			})
+		if err != nil {
+			return err
+		}
+		report.part(i, records, sizes[i], 0)
+	}
+	return nil
+}
+
+// fileSize returns the size of filename on disk, zero if it doesn't exist.
+func fileSize(filename string) int64 {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
@@ -0,0 +1,125 @@
+package wallet
+
+import (
+	"context"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"testing"
+)
+
+func TestService_SumPaymentsWithProgressContext_parts(t *testing.T) {
+	s := newTestService(withScanPayments(25))
+	var total types.Money
+	last := Progress{}
+	for progress := range s.SumPaymentsWithProgressContext(context.Background(), ProgressOptions{PartSize: 10}) {
+		total += progress.Result
+		if progress.Parts != 3 || progress.TotalRecords != 25 {
+			t.Errorf("invalid totals: %+v", progress)
+		}
+		if progress.Done != last.Done+1 || progress.Records <= last.Records {
+			t.Errorf("progress went back: %+v after %+v", progress, last)
+		}
+		last = progress
+	}
+	if total != s.SumPayments(1) {
+		t.Errorf("got: %v, want: %v", total, s.SumPayments(1))
+	}
+	if last.Done != 3 || last.Records != 25 {
+		t.Errorf("invalid last progress: %+v", last)
+	}
+}
+
+func TestService_SumPaymentsWithProgress_empty(t *testing.T) {
+	var s Service
+	for progress := range s.SumPaymentsWithProgress() {
+		t.Errorf("unexpected progress: %+v", progress)
+	}
+}
+
+func TestService_SumPaymentsWithProgressContext_canceled(t *testing.T) {
+	s := newTestService(withScanPayments(100))
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := s.SumPaymentsWithProgressContext(ctx, ProgressOptions{PartSize: 1})
+	<-ch
+	cancel()
+	received := 1
+	for range ch {
+		received++
+	}
+	if received == 100 {
+		t.Errorf("canceled scan reported every part")
+	}
+}
+
+func TestService_FilterPaymentsByFnWithProgress(t *testing.T) {
+	s := newTestService(withScanPayments(30))
+	var reports []Progress
+	got, err := s.FilterPaymentsByFnWithProgress(context.Background(), func(payment types.Payment) bool {
+		return payment.AccountID == 1
+	}, 3, ProgressOptions{PartSize: 4, Report: func(progress Progress) {
+		reports = append(reports, progress)
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 15 {
+		t.Errorf("invalid payments: %v", got)
+	}
+	if len(reports) != 8 || reports[7].Records != 30 || reports[7].Parts != 8 {
+		t.Errorf("invalid reports: %+v", reports)
+	}
+}
+
+func TestService_ExportImportWithProgress(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestService(withFormatsData())
+	var export []Progress
+	err := s.ExportWithProgress(context.Background(), dir, FormatCSV, ProgressOptions{Report: func(progress Progress) {
+		export = append(export, progress)
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(export) != 3 || export[2].Records != 5 || export[2].TotalRecords != 5 || export[2].Bytes == 0 {
+		t.Errorf("invalid export progress: %+v", export)
+	}
+
+	var got Service
+	var imported []Progress
+	err = got.ImportWithProgress(context.Background(), dir, FormatCSV, ProgressOptions{Report: func(progress Progress) {
+		imported = append(imported, progress)
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != 3 || imported[2].Records != 5 || imported[2].Bytes != imported[2].TotalBytes {
+		t.Errorf("invalid import progress: %+v", imported)
+	}
+}
+
+func TestService_ExportWithProgress_canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s := newTestService(withFormatsData())
+	if err := s.ExportWithProgress(ctx, t.TempDir(), FormatDump, ProgressOptions{}); err != context.Canceled {
+		t.Errorf("want: %v, got: %v", context.Canceled, err)
+	}
+}
+
+func TestService_HistoryToFilesWithProgress(t *testing.T) {
+	s := newTestService(withScanPayments(7))
+	history, err := s.ExportAccountHistory(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reports []Progress
+	err = s.HistoryToFilesWithProgress(context.Background(), history, t.TempDir(), 2, FormatJSON,
+		ProgressOptions{Report: func(progress Progress) {
+			reports = append(reports, progress)
+		}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 2 || reports[1].Parts != 2 || reports[1].Records != 4 {
+		t.Errorf("invalid reports: %+v", reports)
+	}
+}
@@ -0,0 +1,233 @@
+package wallet
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrWrongCursor = errors.New("wrong cursor")
+
+// PaymentSort is the field payments of a query are ordered by. Payments with
+// equal fields are ordered by ID, so every order is total.
+type PaymentSort int
+
+const (
+	SortByCreated PaymentSort = iota
+	SortByAmount
+	SortByCategory
+	SortByAccount
+)
+
+type PaymentQuery struct {
+	// AccountID limits the payments to one account, zero matches every account.
+	AccountID int64
+	// Categories and Statuses match any of their values, empty matches all.
+	Categories []types.PaymentCategory
+	Statuses   []types.PaymentStatus
+	// MinAmount and MaxAmount are inclusive bounds, nil is unbounded.
+	MinAmount *types.Money
+	MaxAmount *types.Money
+	// From is inclusive and To exclusive, a zero time is unbounded.
+	From time.Time
+	To   time.Time
+	// CategoryContains matches categories containing it, ignoring case.
+	CategoryContains string
+
+	SortBy     PaymentSort
+	Descending bool
+	// Limit is the page size, zero returns every remaining payment.
+	Limit int
+	// Cursor is NextCursor of the previous page, empty for the first page.
+	Cursor string
+}
+
+type PaymentPage struct {
+	Payments []types.Payment
+	// Total is the number of payments matching the query on all pages.
+	Total int
+	// NextCursor is empty on the last page.
+	NextCursor string
+}
+
+// paymentCursor keeps the sort key and ID of the last payment of a page, so
+// pages don't shift when payments are added before the cursor. Category is
+// the only text key, the others are kept in Number.
+type paymentCursor struct {
+	SortBy     PaymentSort `json:"s"`
+	Descending bool        `json:"d"`
+	Number     int64       `json:"n,omitempty"`
+	Text       string      `json:"t,omitempty"`
+	ID         string      `json:"i"`
+}
+
+// payment returns a payment that compares with others the same way as the one
+// the cursor was made from.
+func (c *paymentCursor) payment() types.Payment {
+	payment := types.Payment{ID: c.ID}
+	switch c.SortBy {
+	case SortByAmount:
+		payment.Amount = types.Money(c.Number)
+	case SortByCategory:
+		payment.Category = types.PaymentCategory(c.Text)
+	case SortByAccount:
+		payment.AccountID = c.Number
+	default:
+		payment.Created = c.Number
+	}
+	return payment
+}
+
+// QueryPayments returns one page of the payments matching query. The order
+// doesn't depend on goroutines, and no matches is an empty page, not an error.
+func (s *Service) QueryPayments(ctx context.Context, query PaymentQuery, goroutines int) (PaymentPage, error) {
+	cursor, err := query.cursor()
+	if err != nil {
+		return PaymentPage{}, err
+	}
+	matches, err := s.filterPayments(ctx, query.Match, goroutines, ProgressOptions{})
+	if err != nil {
+		return PaymentPage{}, err
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return query.compare(matches[i], matches[j]) < 0
+	})
+
+	start := 0
+	if cursor != nil {
+		last := cursor.payment()
+		start = sort.Search(len(matches), func(i int) bool {
+			return query.compare(last, matches[i]) < 0
+		})
+	}
+	end := len(matches)
+	if query.Limit > 0 && start+query.Limit < end {
+		end = start + query.Limit
+	}
+	page := PaymentPage{
+		Payments: matches[start:end],
+		Total:    len(matches),
+	}
+	if end < len(matches) {
+		page.NextCursor = query.nextCursor(matches[end-1])
+	}
+	return page, nil
+}
+
+// Match reports whether payment passes every filter of the query, ignoring
+// sorting and pagination.
+func (q PaymentQuery) Match(payment types.Payment) bool {
+	if q.AccountID != 0 && payment.AccountID != q.AccountID {
+		return false
+	}
+	if len(q.Categories) > 0 && !containsCategory(q.Categories, payment.Category) {
+		return false
+	}
+	if len(q.Statuses) > 0 && !containsStatus(q.Statuses, payment.Status) {
+		return false
+	}
+	if q.MinAmount != nil && payment.Amount < *q.MinAmount {
+		return false
+	}
+	if q.MaxAmount != nil && payment.Amount > *q.MaxAmount {
+		return false
+	}
+	if !q.From.IsZero() && payment.Created < q.From.Unix() {
+		return false
+	}
+	if !q.To.IsZero() && payment.Created >= q.To.Unix() {
+		return false
+	}
+	if q.CategoryContains != "" &&
+		!strings.Contains(strings.ToLower(string(payment.Category)), strings.ToLower(q.CategoryContains)) {
+		return false
+	}
+	return true
+}
+
+func (q PaymentQuery) compare(a types.Payment, b types.Payment) int {
+	result := 0
+	switch q.SortBy {
+	case SortByAmount:
+		result = compareInt(int64(a.Amount), int64(b.Amount))
+	case SortByCategory:
+		result = strings.Compare(string(a.Category), string(b.Category))
+	case SortByAccount:
+		result = compareInt(a.AccountID, b.AccountID)
+	default:
+		result = compareInt(a.Created, b.Created)
+	}
+	if result == 0 {
+		result = strings.Compare(a.ID, b.ID)
+	}
+	if q.Descending {
+		return -result
+	}
+	return result
+}
+
+func (q PaymentQuery) nextCursor(last types.Payment) string {
+	cursor := paymentCursor{SortBy: q.SortBy, Descending: q.Descending, ID: last.ID}
+	switch q.SortBy {
+	case SortByAmount:
+		cursor.Number = int64(last.Amount)
+	case SortByCategory:
+		cursor.Text = string(last.Category)
+	case SortByAccount:
+		cursor.Number = last.AccountID
+	default:
+		cursor.Number = last.Created
+	}
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// cursor decodes q.Cursor, a cursor of a query sorted differently is wrong.
+func (q PaymentQuery) cursor() (*paymentCursor, error) {
+	if q.Cursor == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, ErrWrongCursor
+	}
+	cursor := &paymentCursor{}
+	err = json.Unmarshal(data, cursor)
+	if err != nil || cursor.SortBy != q.SortBy || cursor.Descending != q.Descending {
+		return nil, ErrWrongCursor
+	}
+	return cursor, nil
+}
+
+func compareInt(a int64, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func containsCategory(categories []types.PaymentCategory, category types.PaymentCategory) bool {
+	for _, c := range categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+func containsStatus(statuses []types.PaymentStatus, status types.PaymentStatus) bool {
+	for _, st := range statuses {
+		if st == status {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package wallet
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// withQueryPayments adds payments of three accounts with repeating amounts
+// and two payments per second.
+func withQueryPayments() testOption {
+	return func(s *testService) {
+		categories := []types.PaymentCategory{"auto", "Food", "mobile", "fast food"}
+		statuses := []types.PaymentStatus{types.PaymentStatusOk, types.PaymentStatusFail, types.PaymentStatusInProgress}
+		for i := 0; i < 60; i++ {
+			s.payments = append(s.payments, &types.Payment{
+				ID:        strconv.Itoa(100 + i),
+				AccountID: int64(i%3 + 1),
+				Amount:    types.Money((i * 7) % 50),
+				Category:  categories[i%len(categories)],
+				Status:    statuses[i%len(statuses)],
+				Created:   int64(1000 + i/2),
+			})
+		}
+	}
+}
+
+func TestService_QueryPayments_filters(t *testing.T) {
+	s := newTestService(withQueryPayments())
+	min, max := types.Money(10), types.Money(30)
+	query := PaymentQuery{
+		AccountID:        1,
+		Statuses:         []types.PaymentStatus{types.PaymentStatusOk},
+		MinAmount:        &min,
+		MaxAmount:        &max,
+		From:             time.Unix(1005, 0),
+		To:               time.Unix(1025, 0),
+		CategoryContains: "FOOD",
+	}
+	page, err := s.QueryPayments(context.Background(), query, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := 0
+	for _, payment := range s.payments {
+		p := *payment
+		if p.AccountID == 1 && p.Status == types.PaymentStatusOk && p.Amount >= min && p.Amount <= max &&
+			p.Created >= 1005 && p.Created < 1025 && (p.Category == "Food" || p.Category == "fast food") {
+			want++
+		}
+	}
+	if want == 0 || page.Total != want || len(page.Payments) != want || page.NextCursor != "" {
+		t.Errorf("got %d of %d payments, want %d: %v", len(page.Payments), page.Total, want, page)
+	}
+}
+
+func TestService_QueryPayments_empty(t *testing.T) {
+	s := newTestService(withQueryPayments())
+	page, err := s.QueryPayments(context.Background(), PaymentQuery{Categories: []types.PaymentCategory{"none"}}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 0 || len(page.Payments) != 0 || page.NextCursor != "" {
+		t.Errorf("invalid page: %v", page)
+	}
+}
+
+func TestService_QueryPayments_pages(t *testing.T) {
+	s := newTestService(withQueryPayments())
+	ctx := context.Background()
+	for _, sortBy := range []PaymentSort{SortByCreated, SortByAmount, SortByCategory, SortByAccount} {
+		for _, descending := range []bool{false, true} {
+			query := PaymentQuery{SortBy: sortBy, Descending: descending}
+			all, err := s.QueryPayments(ctx, query, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 1; i < len(all.Payments); i++ {
+				if query.compare(all.Payments[i-1], all.Payments[i]) >= 0 {
+					t.Fatalf("sort %d: payments out of order: %v", sortBy, all.Payments)
+				}
+			}
+			for _, goroutines := range []int{1, 3, 8} {
+				query.Limit = 7
+				query.Cursor = ""
+				var got []types.Payment
+				for {
+					page, err := s.QueryPayments(ctx, query, goroutines)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if page.Total != len(s.payments) || len(page.Payments) > 7 {
+						t.Fatalf("invalid page: %v", page)
+					}
+					got = append(got, page.Payments...)
+					if page.NextCursor == "" {
+						break
+					}
+					query.Cursor = page.NextCursor
+				}
+				if !reflect.DeepEqual(got, all.Payments) {
+					t.Errorf("sort %d, desc %v, goroutines %d: pages differ from the full result",
+						sortBy, descending, goroutines)
+				}
+			}
+		}
+	}
+}
+
+func TestService_QueryPayments_wrongCursor(t *testing.T) {
+	s := newTestService(withQueryPayments())
+	ctx := context.Background()
+	page, err := s.QueryPayments(ctx, PaymentQuery{Limit: 5}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []PaymentQuery{
+		{Cursor: "not a cursor"},
+		{Cursor: page.NextCursor, SortBy: SortByAmount},
+		{Cursor: page.NextCursor, Descending: true},
+	} {
+		if _, err := s.QueryPayments(ctx, query, 2); err != ErrWrongCursor {
+			t.Errorf("want: %v, got: %v", ErrWrongCursor, err)
+		}
+	}
+}
+
+func TestService_QueryPayments_cursorKeepsSortKey(t *testing.T) {
+	s := newTestService(withQueryPayments())
+	page, err := s.QueryPayments(context.Background(), PaymentQuery{SortBy: SortByCategory, Limit: 5}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := base64.RawURLEncoding.DecodeString(page.NextCursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cursor map[string]interface{}
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		t.Fatal(err)
+	}
+	last := page.Payments[len(page.Payments)-1]
+	want := map[string]interface{}{"s": float64(SortByCategory), "d": false, "t": string(last.Category), "i": last.ID}
+	if !reflect.DeepEqual(cursor, want) {
+		t.Errorf("got: %v, want: %v", cursor, want)
+	}
+}
+
+func TestService_Pay_created(t *testing.T) {
+	s := &Service{}
+	now := time.Unix(1700000000, 0)
+	s.SetClock(func() time.Time { return now })
+	account, err := s.RegisterAccount("123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment, err := s.Pay(account.ID, 10, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Hour)
+	repeated, err := s.Repeat(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.Created != 1700000000 || repeated.Created != 1700003600 {
+		t.Errorf("invalid times: %d, %d", payment.Created, repeated.Created)
+	}
+	page, err := s.QueryPayments(context.Background(), PaymentQuery{To: time.Unix(1700003600, 0)}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 1 || page.Payments[0].ID != payment.ID {
+		t.Errorf("invalid page: %v", page)
+	}
+}
@@ -0,0 +1,602 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"time"
+)
+
+var ErrPermissionDenied = errors.New("permission denied")
+
+type Role string
+
+const (
+	RoleCustomer Role = "customer"
+	RoleSupport  Role = "support"
+	RoleAdmin    Role = "admin"
+)
+
+// Principal is who calls the Service. AccountID is the own account of a
+// customer.
+type Principal struct {
+	ID        string
+	Role      Role
+	AccountID int64
+}
+
+// permission says who besides admins may call an operation. Customers may
+// only touch their own account, and never move money into it themselves:
+// deposits and refunds are up to admins. Support only reads.
+type permission struct {
+	support  bool
+	customer bool
+}
+
+var permissions = map[string]permission{
+	"RegisterAccount":           {},
+	"Deposit":                   {},
+	"Pay":                       {customer: true},
+	"Reject":                    {},
+	"Repeat":                    {customer: true},
+	"FavoritePayment":           {customer: true},
+	"PayFromFavorite":           {customer: true},
+	"ChangePIN":                 {customer: true},
+	"RequestPINReset":           {},
+	"ResetPIN":                  {},
+	"Import":                    {},
+	"Export":                    {support: true},
+	"FindAccountByID":           {support: true, customer: true},
+	"FindPaymentByID":           {support: true, customer: true},
+	"FindFavoriteByID":          {support: true, customer: true},
+	"ExportAccountHistory":      {support: true, customer: true},
+	"QueryPayments":             {support: true, customer: true},
+	"SumPayments":               {support: true},
+	"ApprovePayment":            {},
+	"PaymentsInReview":          {support: true},
+	"Reconcile":                 {support: true},
+	"AdjustBalance":             {},
+	"ReverseDeposit":            {},
+	"ExportAccountTransactions": {support: true, customer: true},
+	"Ledger":                    {support: true, customer: true},
+	"Statement":                 {support: true, customer: true},
+	"SetBudget":                 {customer: true},
+	"Budgets":                   {support: true, customer: true},
+	"RedeemPoints":              {customer: true},
+	"Rewards":                   {support: true, customer: true},
+	"SetAccountType":            {},
+	"RunEndOfDay":               {},
+	"CreateSplit":               {customer: true},
+	"PaySplitPart":              {customer: true},
+	"CancelSplit":               {customer: true},
+	"Splits":                    {support: true, customer: true},
+	"ExpireSplits":              {},
+	"RequestPayment":            {customer: true},
+	"AnswerPaymentRequest":      {customer: true},
+	"PaymentRequests":           {support: true, customer: true},
+	"ExpirePaymentRequests":     {},
+}
+
+// Authorized is the Service as seen by a principal: every method checks the
+// permission first, and denied calls are recorded like failed operations.
+type Authorized struct {
+	s         *Service
+	principal Principal
+}
+
+func (s *Service) As(principal Principal) *Authorized {
+	return &Authorized{s: s, principal: principal}
+}
+
+func (a *Authorized) Principal() Principal {
+	return a.principal
+}
+
+// allowed reports whether the principal may call operation on accountID,
+// zero when the operation isn't about one account.
+func (a *Authorized) allowed(operation string, accountID int64) bool {
+	p, ok := permissions[operation]
+	if !ok {
+		return false
+	}
+	switch a.principal.Role {
+	case RoleAdmin:
+		return true
+	case RoleSupport:
+		return p.support
+	case RoleCustomer:
+		return p.customer && accountID != 0 && accountID == a.principal.AccountID
+	}
+	return false
+}
+
+// enter checks the permission and records the call under the principal
+// until the returned function is called.
+func (a *Authorized) enter(operation string, accountID int64) (func(), error) {
+	s := a.s
+	actor := s.actor
+	s.actor = string(a.principal.Role) + ":" + a.principal.ID
+	leave := func() { s.actor = actor }
+	if !a.allowed(operation, accountID) {
+		op := s.beginOperation(operation, accountID, map[string]string{
+			"principal": a.principal.ID,
+			"role":      string(a.principal.Role),
+		}, auditTarget{})
+		op.end(ErrPermissionDenied, auditTarget{})
+		s.log().Warn("permission denied", "operation", operation, "principal", a.principal.ID,
+			"role", string(a.principal.Role), "account_id", accountID)
+		leave()
+		return nil, ErrPermissionDenied
+	}
+	return leave, nil
+}
+
+// paymentAccount is the account of a payment, zero if there is no such
+// payment, so that the Service reports it.
+func (a *Authorized) paymentAccount(paymentID string) int64 {
+	payment, err := a.s.FindPaymentByID(paymentID)
+	if err != nil {
+		return a.principal.AccountID
+	}
+	return payment.AccountID
+}
+
+func (a *Authorized) favoriteAccount(favoriteID string) int64 {
+	favorite, err := a.s.FindFavoriteByID(favoriteID)
+	if err != nil {
+		return a.principal.AccountID
+	}
+	return favorite.AccountID
+}
+
+func (a *Authorized) depositAccount(depositID string) int64 {
+	deposit, err := a.s.FindDepositByID(depositID)
+	if err != nil {
+		return a.principal.AccountID
+	}
+	return deposit.AccountID
+}
+
+func (a *Authorized) splitAccount(splitID string) int64 {
+	split, err := a.s.FindSplitByID(splitID)
+	if err != nil {
+		return a.principal.AccountID
+	}
+	return split.AccountID
+}
+
+// paymentRequestPayer is the account asked to pay a request.
+func (a *Authorized) paymentRequestPayer(requestID string) int64 {
+	request, err := a.s.FindPaymentRequestByID(requestID)
+	if err != nil {
+		return a.principal.AccountID
+	}
+	payer, err := a.s.findAccountByPhone(request.Phone)
+	if err != nil {
+		return a.principal.AccountID
+	}
+	return payer.ID
+}
+
+func (a *Authorized) RegisterAccount(phone types.Phone) (*types.Account, error) {
+	leave, err := a.enter("RegisterAccount", 0)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return a.s.RegisterAccount(phone)
+}
+
+func (a *Authorized) Deposit(accountID int64, amount types.Money) error {
+	leave, err := a.enter("Deposit", accountID)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	return a.s.Deposit(accountID, amount)
+}
+
+func (a *Authorized) DepositFrom(accountID int64, amount types.Money, source types.DepositSource,
+	reference string,
+) (*types.Deposit, error) {
+	leave, err := a.enter("Deposit", accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return a.s.DepositFrom(accountID, amount, source, reference)
+}
+
+func (a *Authorized) ReverseDeposit(depositID string) error {
+	leave, err := a.enter("ReverseDeposit", a.depositAccount(depositID))
+	if err != nil {
+		return err
+	}
+	defer leave()
+	return a.s.ReverseDeposit(depositID)
+}
+
+func (a *Authorized) Pay(accountID int64, amount types.Money, category types.PaymentCategory) (*types.Payment, error) {
+	leave, err := a.enter("Pay", accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return a.s.Pay(accountID, amount, category)
+}
+
+func (a *Authorized) Reject(paymentID string) error {
+	leave, err := a.enter("Reject", a.paymentAccount(paymentID))
+	if err != nil {
+		return err
+	}
+	defer leave()
+	return a.s.Reject(paymentID)
+}
+
+func (a *Authorized) Repeat(paymentID string) (*types.Payment, error) {
+	leave, err := a.enter("Repeat", a.paymentAccount(paymentID))
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return a.s.Repeat(paymentID)
+}
+
+func (a *Authorized) FavoritePayment(paymentID string, name string) (*types.Favorite, error) {
+	leave, err := a.enter("FavoritePayment", a.paymentAccount(paymentID))
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return a.s.FavoritePayment(paymentID, name)
+}
+
+func (a *Authorized) PayFromFavorite(favoriteID string) (*types.Payment, error) {
+	leave, err := a.enter("PayFromFavorite", a.favoriteAccount(favoriteID))
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return a.s.PayFromFavorite(favoriteID)
+}
+
+func (a *Authorized) ChangePIN(accountID int64, oldPIN string, newPIN string) error {
+	leave, err := a.enter("ChangePIN", accountID)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	return a.s.ChangePIN(accountID, oldPIN, newPIN)
+}
+
+func (a *Authorized) RequestPINReset(accountID int64) (string, error) {
+	leave, err := a.enter("RequestPINReset", accountID)
+	if err != nil {
+		return "", err
+	}
+	defer leave()
+	return a.s.RequestPINReset(accountID)
+}
+
+func (a *Authorized) ResetPIN(accountID int64, code string, newPIN string) error {
+	leave, err := a.enter("ResetPIN", accountID)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	return a.s.ResetPIN(accountID, code, newPIN)
+}
+
+func (a *Authorized) ImportFormat(dir string, format Format) error {
+	leave, err := a.enter("Import", 0)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	return a.s.ImportFormat(dir, format)
+}
+
+func (a *Authorized) ExportFormat(dir string, format Format) error {
+	leave, err := a.enter("Export", 0)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	return a.s.ExportFormat(dir, format)
+}
+
+func (a *Authorized) FindAccountByID(accountID int64) (*types.Account, error) {
+	leave, err := a.enter("FindAccountByID", accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	account, err := a.s.FindAccountByID(accountID)
+	if err != nil {
+		return nil, err
+	}
+	result := *account
+	return &result, nil
+}
+
+func (a *Authorized) FindPaymentByID(paymentID string) (*types.Payment, error) {
+	leave, err := a.enter("FindPaymentByID", a.paymentAccount(paymentID))
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	payment, err := a.s.FindPaymentByID(paymentID)
+	if err != nil {
+		return nil, err
+	}
+	result := *payment
+	result.RiskHits = append([]string(nil), payment.RiskHits...)
+	return &result, nil
+}
+
+func (a *Authorized) FindFavoriteByID(favoriteID string) (*types.Favorite, error) {
+	leave, err := a.enter("FindFavoriteByID", a.favoriteAccount(favoriteID))
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	favorite, err := a.s.FindFavoriteByID(favoriteID)
+	if err != nil {
+		return nil, err
+	}
+	result := *favorite
+	return &result, nil
+}
+
+func (a *Authorized) ExportAccountHistory(accountID int64) ([]types.Payment, error) {
+	leave, err := a.enter("ExportAccountHistory", accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return a.s.ExportAccountHistory(accountID)
+}
+
+func (a *Authorized) ExportAccountTransactions(accountID int64) ([]Transaction, error) {
+	leave, err := a.enter("ExportAccountTransactions", accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return a.s.ExportAccountTransactions(accountID)
+}
+
+func (a *Authorized) Ledger(accountID int64) ([]LedgerEntry, error) {
+	leave, err := a.enter("Ledger", accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return a.s.Ledger(accountID)
+}
+
+func (a *Authorized) Statement(accountID int64, from time.Time, to time.Time) (*Statement, error) {
+	leave, err := a.enter("Statement", accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return a.s.Statement(accountID, from, to)
+}
+
+// QueryPayments limits customers to queries of their own account.
+func (a *Authorized) QueryPayments(ctx context.Context, query PaymentQuery, goroutines int) (PaymentPage, error) {
+	leave, err := a.enter("QueryPayments", query.AccountID)
+	if err != nil {
+		return PaymentPage{}, err
+	}
+	defer leave()
+	return a.s.QueryPayments(ctx, query, goroutines)
+}
+
+func (a *Authorized) SumPayments(goroutines int) (types.Money, error) {
+	leave, err := a.enter("SumPayments", 0)
+	if err != nil {
+		return 0, err
+	}
+	defer leave()
+	return a.s.SumPayments(goroutines), nil
+}
+
+func (a *Authorized) ApprovePayment(paymentID string) error {
+	leave, err := a.enter("ApprovePayment", a.paymentAccount(paymentID))
+	if err != nil {
+		return err
+	}
+	defer leave()
+	return a.s.ApprovePayment(paymentID)
+}
+
+func (a *Authorized) PaymentsInReview() ([]types.Payment, error) {
+	leave, err := a.enter("PaymentsInReview", 0)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return a.s.PaymentsInReview(), nil
+}
+
+// Reconcile lets support only report discrepancies, adjusting them is
+// AdjustBalance.
+func (a *Authorized) Reconcile(ctx context.Context, options ReconcileOptions) (*Reconciliation, error) {
+	operation := "Reconcile"
+	if options.Adjust {
+		operation = "AdjustBalance"
+	}
+	leave, err := a.enter(operation, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return a.s.Reconcile(ctx, options)
+}
+
+func (a *Authorized) AdjustBalance(accountID int64, amount types.Money, reason string) (*LedgerEntry, error) {
+	leave, err := a.enter("AdjustBalance", accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return a.s.AdjustBalance(accountID, amount, reason)
+}
+
+func (a *Authorized) SetBudget(budget Budget) error {
+	leave, err := a.enter("SetBudget", budget.AccountID)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	return a.s.SetBudget(budget)
+}
+
+func (a *Authorized) Budgets(accountID int64) ([]BudgetStatus, error) {
+	leave, err := a.enter("Budgets", accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return a.s.Budgets(accountID)
+}
+
+func (a *Authorized) RedeemPoints(accountID int64, points int64) (*types.Deposit, error) {
+	leave, err := a.enter("RedeemPoints", accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return a.s.RedeemPoints(accountID, points)
+}
+
+func (a *Authorized) Points(accountID int64) (int64, error) {
+	leave, err := a.enter("Rewards", accountID)
+	if err != nil {
+		return 0, err
+	}
+	defer leave()
+	return a.s.Points(accountID)
+}
+
+func (a *Authorized) Rewards(accountID int64) ([]Reward, error) {
+	leave, err := a.enter("Rewards", accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return a.s.Rewards(accountID)
+}
+
+func (a *Authorized) SetAccountType(accountID int64, accountType string) error {
+	leave, err := a.enter("SetAccountType", accountID)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	return a.s.SetAccountType(accountID, accountType)
+}
+
+func (a *Authorized) RunEndOfDay() (*EndOfDay, error) {
+	leave, err := a.enter("RunEndOfDay", 0)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return a.s.RunEndOfDay()
+}
+
+func (a *Authorized) CreateSplit(request SplitRequest) (*Split, error) {
+	leave, err := a.enter("CreateSplit", request.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return a.s.CreateSplit(request)
+}
+
+func (a *Authorized) PaySplitPart(splitID string, accountID int64) error {
+	leave, err := a.enter("PaySplitPart", accountID)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	return a.s.PaySplitPart(splitID, accountID)
+}
+
+func (a *Authorized) CancelSplit(splitID string) error {
+	leave, err := a.enter("CancelSplit", a.splitAccount(splitID))
+	if err != nil {
+		return err
+	}
+	defer leave()
+	return a.s.CancelSplit(splitID)
+}
+
+func (a *Authorized) Splits(accountID int64) ([]Split, error) {
+	leave, err := a.enter("Splits", accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return a.s.Splits(accountID)
+}
+
+func (a *Authorized) ExpireSplits() ([]Split, error) {
+	leave, err := a.enter("ExpireSplits", 0)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return a.s.ExpireSplits()
+}
+
+func (a *Authorized) RequestPayment(accountID int64, phone types.Phone, amount types.Money,
+	category types.PaymentCategory, memo string,
+) (*PaymentRequest, error) {
+	leave, err := a.enter("RequestPayment", accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return a.s.RequestPayment(accountID, phone, amount, category, memo)
+}
+
+func (a *Authorized) AcceptPaymentRequest(requestID string) (*types.Payment, error) {
+	leave, err := a.enter("AnswerPaymentRequest", a.paymentRequestPayer(requestID))
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return a.s.AcceptPaymentRequest(requestID)
+}
+
+func (a *Authorized) DeclinePaymentRequest(requestID string) error {
+	leave, err := a.enter("AnswerPaymentRequest", a.paymentRequestPayer(requestID))
+	if err != nil {
+		return err
+	}
+	defer leave()
+	return a.s.DeclinePaymentRequest(requestID)
+}
+
+func (a *Authorized) PaymentRequests(accountID int64) ([]PaymentRequest, []PaymentRequest, error) {
+	leave, err := a.enter("PaymentRequests", accountID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer leave()
+	return a.s.PaymentRequests(accountID)
+}
+
+func (a *Authorized) ExpirePaymentRequests() ([]PaymentRequest, error) {
+	leave, err := a.enter("ExpirePaymentRequests", 0)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return a.s.ExpirePaymentRequests()
+}
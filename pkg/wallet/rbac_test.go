@@ -0,0 +1,139 @@
+package wallet
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// newRBACTestService audits to the returned log only after the fixture
+// setup, the payment is of account 2.
+func newRBACTestService(t *testing.T) (*testService, *AuditLog, string) {
+	s := newTestService()
+	s.addAccounts(t, 100, "1", "2")
+	payment, err := s.Pay(2, 10, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditLog := NewAuditLog()
+	s.SetAuditLog(auditLog)
+	return s, auditLog, payment.ID
+}
+
+func TestAuthorized_customer(t *testing.T) {
+	s, auditLog, otherPayment := newRBACTestService(t)
+	customer := s.As(Principal{ID: "alice", Role: RoleCustomer, AccountID: 1})
+
+	payment, err := customer.Pay(1, 10, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := customer.Reject(payment.ID); err != ErrPermissionDenied {
+		t.Errorf("want: %v, got: %v", ErrPermissionDenied, err)
+	}
+	if err := customer.Deposit(1, 10); err != ErrPermissionDenied {
+		t.Errorf("want: %v, got: %v", ErrPermissionDenied, err)
+	}
+	if _, err := customer.Pay(2, 10, "auto"); err != ErrPermissionDenied {
+		t.Errorf("want: %v, got: %v", ErrPermissionDenied, err)
+	}
+	if err := customer.Reject(otherPayment); err != ErrPermissionDenied {
+		t.Errorf("want: %v, got: %v", ErrPermissionDenied, err)
+	}
+	if _, err := customer.FindPaymentByID(otherPayment); err != ErrPermissionDenied {
+		t.Errorf("want: %v, got: %v", ErrPermissionDenied, err)
+	}
+	if _, err := customer.QueryPayments(context.Background(), PaymentQuery{}, 1); err != ErrPermissionDenied {
+		t.Errorf("want: %v, got: %v", ErrPermissionDenied, err)
+	}
+	if _, err := customer.FindPaymentByID("none"); err != ErrPaymentNotFound {
+		t.Errorf("want: %v, got: %v", ErrPaymentNotFound, err)
+	}
+	page, err := customer.QueryPayments(context.Background(), PaymentQuery{AccountID: 1}, 1)
+	if err != nil || page.Total != 1 {
+		t.Errorf("invalid page: %v, %v", page, err)
+	}
+	account, err := customer.FindAccountByID(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account.Balance = 1_000_000
+	found, err := customer.FindPaymentByID(payment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found.Amount = 0
+	if account, _ := s.FindAccountByID(1); account.Balance != 90 || payment.Amount != 10 {
+		t.Errorf("lookups returned live records: %d, %d", account.Balance, payment.Amount)
+	}
+
+	denied := 0
+	for _, entry := range auditLog.Entries() {
+		if entry.Actor != "customer:alice" {
+			t.Errorf("invalid actor: %+v", entry)
+		}
+		if entry.Outcome == ErrPermissionDenied.Error() {
+			denied++
+		}
+	}
+	if denied != 6 {
+		t.Errorf("got %d denied entries, want 6", denied)
+	}
+	if s.actor != "" {
+		t.Errorf("actor leaked: %q", s.actor)
+	}
+}
+
+func TestAuthorized_support(t *testing.T) {
+	s, auditLog, payment := newRBACTestService(t)
+	support := s.As(Principal{ID: "bob", Role: RoleSupport})
+	if _, err := support.FindPaymentByID(payment); err != nil {
+		t.Error(err)
+	}
+	if _, err := support.ExportAccountHistory(2); err != nil {
+		t.Error(err)
+	}
+	if _, err := support.SumPayments(2); err != nil {
+		t.Error(err)
+	}
+	if err := support.Deposit(1, 100); err != ErrPermissionDenied {
+		t.Errorf("want: %v, got: %v", ErrPermissionDenied, err)
+	}
+	if err := support.Reject(payment); err != ErrPermissionDenied {
+		t.Errorf("want: %v, got: %v", ErrPermissionDenied, err)
+	}
+	if err := support.ImportFormat(t.TempDir(), FormatJSON); err != ErrPermissionDenied {
+		t.Errorf("want: %v, got: %v", ErrPermissionDenied, err)
+	}
+	entries := auditLog.Query(1, time.Time{}, time.Time{})
+	if len(entries) != 1 || entries[0].Operation != "Deposit" || entries[0].Actor != "support:bob" {
+		t.Errorf("invalid entries: %+v", entries)
+	}
+	account, err := s.FindAccountByID(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance != 100 {
+		t.Errorf("denied deposit changed balance: %v", account.Balance)
+	}
+}
+
+func TestService_Reject_twice(t *testing.T) {
+	s, _, payment := newRBACTestService(t)
+	if err := s.Reject(payment); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reject(payment); err != ErrPaymentAlreadyRejected {
+		t.Errorf("want: %v, got: %v", ErrPaymentAlreadyRejected, err)
+	}
+	if account, _ := s.FindAccountByID(2); account.Balance != 100 {
+		t.Errorf("refunded twice: %d", account.Balance)
+	}
+}
+
+func TestAuthorized_unknownRole(t *testing.T) {
+	s, _, _ := newRBACTestService(t)
+	if _, err := s.As(Principal{ID: "x"}).FindAccountByID(1); err != ErrPermissionDenied {
+		t.Errorf("want: %v, got: %v", ErrPermissionDenied, err)
+	}
+}
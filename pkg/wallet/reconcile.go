@@ -0,0 +1,159 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"strconv"
+)
+
+var ErrReasonRequired = errors.New("reason required")
+
+type ReconcileOptions struct {
+	// Goroutines scan the payments in parallel.
+	Goroutines int
+	// Adjust writes an adjustment bringing every wrong balance back to the
+	// expected one, with Reason recorded in the ledger and the audit log.
+	Adjust bool
+	Reason string
+}
+
+// Discrepancy is an account whose balance isn't what its history implies.
+type Discrepancy struct {
+	AccountID int64
+	Balance   types.Money
+	Expected  types.Money
+	// Difference is Balance less Expected.
+	Difference types.Money
+	// Deposits, Payments and Ledger are the records of the account the
+	// expected balance was computed from.
+	Deposits []types.Deposit
+	Payments []types.Payment
+	Ledger   []LedgerEntry
+	// Adjustment is the correcting entry when ReconcileOptions.Adjust is set.
+	Adjustment *LedgerEntry
+}
+
+type Reconciliation struct {
+	Accounts      int
+	Discrepancies []Discrepancy
+}
+
+// Reconcile compares every balance with the one expected from the history of
+// the account: its deposits that weren't reversed, less its payments that
+// didn't fail, plus its other ledger entries. Deposit, reversal, payment and
+// refund entries are already counted by the deposits and payments, and
+// adjustment entries are corrections rather than history, so those kinds are
+// skipped. Accounts with history made before the ledger existed show up as
+// discrepancies.
+func (s *Service) Reconcile(ctx context.Context, options ReconcileOptions) (*Reconciliation, error) {
+	if options.Adjust && options.Reason == "" {
+		return nil, ErrReasonRequired
+	}
+	size := partSizeFor(len(s.payments), options.Goroutines)
+	parts := make([]map[int64]types.Money, scanParts(len(s.payments), size))
+	err := scanPayments(ctx, s.payments, options.Goroutines, size,
+		func(part int, payments []*types.Payment) error {
+			spent := make(map[int64]types.Money)
+			for _, payment := range payments {
+				if payment.Status != types.PaymentStatusFail {
+					spent[payment.AccountID] += payment.Amount
+				}
+			}
+			parts[part] = spent
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	expected := make(map[int64]types.Money, len(s.accounts))
+	for _, spent := range parts {
+		for accountID, amount := range spent {
+			expected[accountID] -= amount
+		}
+	}
+	for _, deposit := range s.deposits {
+		if deposit.Status != types.DepositStatusReversed {
+			expected[deposit.AccountID] += deposit.Amount
+		}
+	}
+	for _, entry := range s.ledger {
+		switch entry.Kind {
+		case LedgerDeposit, LedgerReversal, LedgerPayment, LedgerRefund, LedgerAdjustment:
+		default:
+			expected[entry.AccountID] += entry.Amount
+		}
+	}
+
+	result := &Reconciliation{Accounts: len(s.accounts), Discrepancies: make([]Discrepancy, 0)}
+	for _, account := range s.accounts {
+		if account.Balance == expected[account.ID] {
+			continue
+		}
+		discrepancy := Discrepancy{
+			AccountID:  account.ID,
+			Balance:    account.Balance,
+			Expected:   expected[account.ID],
+			Difference: account.Balance - expected[account.ID],
+			Deposits:   make([]types.Deposit, 0),
+			Payments:   make([]types.Payment, 0),
+			Ledger:     make([]LedgerEntry, 0),
+		}
+		for _, deposit := range s.deposits {
+			if deposit.AccountID == account.ID {
+				discrepancy.Deposits = append(discrepancy.Deposits, *deposit)
+			}
+		}
+		for _, entry := range s.ledger {
+			if entry.AccountID == account.ID {
+				discrepancy.Ledger = append(discrepancy.Ledger, *entry)
+			}
+		}
+		for _, payment := range s.payments {
+			if payment.AccountID == account.ID {
+				discrepancy.Payments = append(discrepancy.Payments, *payment)
+			}
+		}
+		result.Discrepancies = append(result.Discrepancies, discrepancy)
+	}
+	if !options.Adjust {
+		return result, nil
+	}
+	for i := range result.Discrepancies {
+		d := &result.Discrepancies[i]
+		d.Adjustment, err = s.AdjustBalance(d.AccountID, -d.Difference, options.Reason)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// AdjustBalance changes the balance by amount outside of deposits and
+// payments, leaving an adjustment in the ledger.
+func (s *Service) AdjustBalance(accountID int64, amount types.Money, reason string) (result *LedgerEntry, err error) {
+	op := s.beginOperation("AdjustBalance", accountID, map[string]string{
+		"amount": strconv.FormatInt(int64(amount), 10),
+		"reason": reason,
+	}, auditTarget{accountID: accountID})
+	defer func() { op.end(err, auditTarget{accountID: accountID}) }()
+	if reason == "" {
+		return nil, ErrReasonRequired
+	}
+	account, err := s.FindAccountByID(accountID)
+	if err != nil {
+		return nil, err
+	}
+	account.Balance += amount
+	s.changes.account(account.ID)
+	entry := s.record(account, LedgerAdjustment, amount, nil)
+	entry.Reason = reason
+	s.publish(BalanceAdjusted{
+		EventMeta: s.eventMeta(account.ID),
+		Amount:    amount,
+		Balance:   account.Balance,
+		Reason:    reason,
+	})
+	copied := *entry
+	return &copied, nil
+}
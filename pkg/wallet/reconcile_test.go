@@ -0,0 +1,86 @@
+package wallet
+
+import (
+	"context"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"testing"
+)
+
+// reconcileScenario makes three accounts with ten payments each and a
+// rejected payment of account 2.
+func reconcileScenario(t *testing.T) (*testService, *types.Payment) {
+	s := newTestService()
+	s.addAccounts(t, 1_000, "1", "2", "3")
+	for accountID := int64(1); accountID <= 3; accountID++ {
+		for i := 0; i < 10; i++ {
+			if _, err := s.Pay(accountID, 10, "auto"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	payment, err := s.Pay(2, 300, "food")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reject(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+	return s, payment
+}
+
+func TestService_Reconcile(t *testing.T) {
+	for _, goroutines := range []int{0, 1, 4, 100} {
+		s, payment := reconcileScenario(t)
+		result, err := s.Reconcile(context.Background(), ReconcileOptions{Goroutines: goroutines})
+		if err != nil || result.Accounts != 3 || len(result.Discrepancies) != 0 {
+			t.Fatalf("goroutines %d: %+v, %v", goroutines, result, err)
+		}
+
+		s.accounts[1].Balance += payment.Amount
+		s.accounts[2].Balance = 5
+		result, err = s.Reconcile(context.Background(), ReconcileOptions{Goroutines: goroutines})
+		if err != nil || len(result.Discrepancies) != 2 {
+			t.Fatalf("goroutines %d: %+v, %v", goroutines, result, err)
+		}
+		d := result.Discrepancies[0]
+		if d.AccountID != 2 || d.Expected != 900 || d.Difference != 300 || len(d.Ledger) != 13 || len(d.Payments) != 11 {
+			t.Errorf("goroutines %d: invalid discrepancy: %+v", goroutines, d)
+		}
+		if d = result.Discrepancies[1]; d.AccountID != 3 || d.Difference != -895 || d.Adjustment != nil {
+			t.Errorf("goroutines %d: invalid discrepancy: %+v", goroutines, d)
+		}
+	}
+}
+
+func TestService_Reconcile_adjust(t *testing.T) {
+	s, payment := reconcileScenario(t)
+	auditLog := NewAuditLog()
+	s.SetAuditLog(auditLog)
+	s.accounts[1].Balance += payment.Amount
+	options := ReconcileOptions{Goroutines: 2, Adjust: true}
+	if _, err := s.Reconcile(context.Background(), options); err != ErrReasonRequired {
+		t.Fatalf("want: %v, got: %v", ErrReasonRequired, err)
+	}
+	options.Reason = "unrecorded credit"
+	result, err := s.Reconcile(context.Background(), options)
+	if err != nil || len(result.Discrepancies) != 1 {
+		t.Fatalf("%+v, %v", result, err)
+	}
+	adjustment := result.Discrepancies[0].Adjustment
+	if adjustment == nil || adjustment.Amount != -300 || adjustment.Balance != 900 || adjustment.Reason != "unrecorded credit" {
+		t.Errorf("invalid adjustment: %+v", adjustment)
+	}
+	if account, _ := s.FindAccountByID(2); account.Balance != 900 {
+		t.Errorf("balance not adjusted: %d", account.Balance)
+	}
+	entries := auditLog.Entries()
+	last := entries[len(entries)-1]
+	if last.Operation != "AdjustBalance" || last.Params["reason"] != "unrecorded credit" || last.AccountID != 2 {
+		t.Errorf("invalid audit entry: %+v", last)
+	}
+
+	result, err = s.Reconcile(context.Background(), ReconcileOptions{})
+	if err != nil || len(result.Discrepancies) != 0 {
+		t.Errorf("adjusted accounts still differ: %+v, %v", result, err)
+	}
+}
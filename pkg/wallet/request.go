@@ -0,0 +1,399 @@
+package wallet
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"strconv"
+	"time"
+)
+
+var ErrPaymentRequestNotFound = errors.New("payment request not found")
+var ErrPaymentRequestClosed = errors.New("payment request not pending")
+var ErrPaymentRequestExpired = errors.New("payment request expired")
+var ErrWrongPaymentRequest = errors.New("wrong payment request")
+
+// PaymentRequestTTL is how long a payment request waits for an answer.
+var PaymentRequestTTL = 7 * 24 * time.Hour
+
+type PaymentRequestStatus string
+
+const (
+	PaymentRequestStatusPending  PaymentRequestStatus = "PENDING"
+	PaymentRequestStatusAccepted PaymentRequestStatus = "ACCEPTED"
+	PaymentRequestStatusDeclined PaymentRequestStatus = "DECLINED"
+	PaymentRequestStatusExpired  PaymentRequestStatus = "EXPIRED"
+)
+
+var paymentRequestColumns = []string{"id", "account_id", "phone", "amount", "category", "memo", "status",
+	"payment_id", "deposit_id", "created", "expires"}
+
+// PaymentRequest asks the account registered with Phone to pay Amount to
+// AccountID. Accepting it makes a payment of the payer and a TRANSFER deposit
+// of the requester, PaymentID and DepositID. DepositID stays empty while the
+// payment is in review.
+type PaymentRequest struct {
+	ID        string                `json:"id"`
+	AccountID int64                 `json:"account_id"`
+	Phone     types.Phone           `json:"phone"`
+	Amount    types.Money           `json:"amount"`
+	Category  types.PaymentCategory `json:"category"`
+	Memo      string                `json:"memo,omitempty"`
+	Status    PaymentRequestStatus  `json:"status"`
+	PaymentID string                `json:"payment_id,omitempty"`
+	DepositID string                `json:"deposit_id,omitempty"`
+	Created   int64                 `json:"created"`
+	Expires   int64                 `json:"expires"`
+}
+
+// RequestPayment asks the account of phone to pay amount to the account.
+func (s *Service) RequestPayment(accountID int64, phone types.Phone, amount types.Money,
+	category types.PaymentCategory, memo string,
+) (result *PaymentRequest, err error) {
+	op := s.beginOperation("RequestPayment", accountID, map[string]string{
+		"phone":    string(phone),
+		"amount":   strconv.FormatInt(int64(amount), 10),
+		"category": string(category),
+	}, auditTarget{accountID: accountID})
+	defer func() { op.end(err, auditTarget{accountID: accountID}) }()
+	if amount <= 0 {
+		return nil, ErrAmountMustBePositive
+	}
+	account, err := s.FindAccountByID(accountID)
+	if err != nil {
+		return nil, err
+	}
+	payer, err := s.findAccountByPhone(phone)
+	if err != nil {
+		return nil, err
+	}
+	if payer.ID == account.ID {
+		return nil, ErrWrongPaymentRequest
+	}
+	err = s.checkSession(account.ID)
+	if err != nil {
+		return nil, err
+	}
+	now := s.now()
+	request := &PaymentRequest{
+		ID:        uuid.New().String(),
+		AccountID: account.ID,
+		Phone:     phone,
+		Amount:    amount,
+		Category:  category,
+		Memo:      memo,
+		Status:    PaymentRequestStatusPending,
+		Created:   now.Unix(),
+		Expires:   now.Add(PaymentRequestTTL).Unix(),
+	}
+	s.paymentRequests = append(s.paymentRequests, request)
+	s.changes.paymentRequest(request.ID)
+	s.publish(PaymentRequested{EventMeta: s.eventMeta(payer.ID), Request: *request})
+	return request, nil
+}
+
+func (s *Service) findAccountByPhone(phone types.Phone) (*types.Account, error) {
+	for _, account := range s.accounts {
+		if account.Phone == phone {
+			return account, nil
+		}
+	}
+	return nil, ErrAccountNotFound
+}
+
+func (s *Service) FindPaymentRequestByID(requestID string) (*PaymentRequest, error) {
+	for _, request := range s.paymentRequests {
+		if request.ID == requestID {
+			return request, nil
+		}
+	}
+	return nil, ErrPaymentRequestNotFound
+}
+
+// PaymentRequests returns the requests the account was asked to pay and
+// those it made, in the order they were made.
+func (s *Service) PaymentRequests(accountID int64) (incoming []PaymentRequest, outgoing []PaymentRequest, err error) {
+	account, err := s.FindAccountByID(accountID)
+	if err != nil {
+		return nil, nil, err
+	}
+	incoming, outgoing = make([]PaymentRequest, 0), make([]PaymentRequest, 0)
+	for _, request := range s.paymentRequests {
+		if request.Phone == account.Phone {
+			incoming = append(incoming, *request)
+		}
+		if request.AccountID == accountID {
+			outgoing = append(outgoing, *request)
+		}
+	}
+	return incoming, outgoing, nil
+}
+
+// pendingPaymentRequest finds a request that can still be answered and its
+// payer.
+func (s *Service) pendingPaymentRequest(requestID string) (*PaymentRequest, *types.Account, error) {
+	request, err := s.FindPaymentRequestByID(requestID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if request.Status != PaymentRequestStatusPending {
+		return nil, nil, ErrPaymentRequestClosed
+	}
+	if s.now().Unix() >= request.Expires {
+		return nil, nil, ErrPaymentRequestExpired
+	}
+	payer, err := s.findAccountByPhone(request.Phone)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = s.checkSession(payer.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return request, payer, nil
+}
+
+// AcceptPaymentRequest pays the request the way Pay does, budgets and risk
+// rules included, and deposits the amount to the requester. When the payment
+// is held for review the deposit waits for ApprovePayment.
+func (s *Service) AcceptPaymentRequest(requestID string) (result *types.Payment, err error) {
+	target := s.paymentRequestAuditTarget(requestID)
+	op := s.beginOperation("AcceptPaymentRequest", target.accountID, map[string]string{"request_id": requestID}, target)
+	defer func() {
+		after := auditTarget{accountID: target.accountID}
+		if result != nil {
+			after.paymentID = result.ID
+		}
+		op.end(err, after)
+	}()
+	request, payer, err := s.pendingPaymentRequest(requestID)
+	if err != nil {
+		return nil, err
+	}
+	requester, err := s.FindAccountByID(request.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	payment, err := s.pay(payer, request.Amount, request.Category)
+	if err != nil {
+		return nil, err
+	}
+	request.Status = PaymentRequestStatusAccepted
+	request.PaymentID = payment.ID
+	s.changes.paymentRequest(request.ID)
+	if !inReview(payment) {
+		s.transfer(requester, request, payment)
+	}
+	return payment, nil
+}
+
+// transfer deposits the amount of an accepted request paid by payment to the
+// requester.
+func (s *Service) transfer(requester *types.Account, request *PaymentRequest, payment *types.Payment) {
+	deposit := s.deposit(requester, request.Amount, types.DepositSourceTransfer, payment.ID)
+	request.DepositID = deposit.ID
+	s.changes.paymentRequest(request.ID)
+	s.publish(PaymentRequestAccepted{
+		EventMeta: s.eventMeta(requester.ID),
+		Request:   *request,
+		Payment:   *payment,
+		Deposit:   *deposit,
+	})
+}
+
+// DeclinePaymentRequest closes the request without paying it.
+func (s *Service) DeclinePaymentRequest(requestID string) (err error) {
+	target := s.paymentRequestAuditTarget(requestID)
+	op := s.beginOperation("DeclinePaymentRequest", target.accountID, map[string]string{"request_id": requestID}, target)
+	defer func() { op.end(err, target) }()
+	request, _, err := s.pendingPaymentRequest(requestID)
+	if err != nil {
+		return err
+	}
+	s.closePaymentRequest(request, PaymentRequestStatusDeclined)
+	return nil
+}
+
+// ExpirePaymentRequests closes the pending requests past their expiry and
+// returns them.
+func (s *Service) ExpirePaymentRequests() (result []PaymentRequest, err error) {
+	op := s.beginOperation("ExpirePaymentRequests", 0, nil, auditTarget{counts: true})
+	defer func() { op.end(err, auditTarget{counts: true}) }()
+	now := s.now().Unix()
+	result = make([]PaymentRequest, 0)
+	for _, request := range s.paymentRequests {
+		if request.Status == PaymentRequestStatusPending && now >= request.Expires {
+			s.closePaymentRequest(request, PaymentRequestStatusExpired)
+			result = append(result, *request)
+		}
+	}
+	return result, nil
+}
+
+func (s *Service) closePaymentRequest(request *PaymentRequest, status PaymentRequestStatus) {
+	request.Status = status
+	s.changes.paymentRequest(request.ID)
+	s.publish(PaymentRequestClosed{EventMeta: s.eventMeta(request.AccountID), Request: *request})
+}
+
+// approveTransfer makes the deposit of a request whose payment was held for
+// review.
+func (s *Service) approveTransfer(payment *types.Payment) {
+	for _, request := range s.paymentRequests {
+		if request.PaymentID != payment.ID || request.DepositID != "" {
+			continue
+		}
+		requester, err := s.FindAccountByID(request.AccountID)
+		if err != nil {
+			s.log().Warn("transfer not deposited", "request_id", request.ID, "account_id", request.AccountID, "error", err)
+			continue
+		}
+		s.transfer(requester, request, payment)
+	}
+}
+
+// reverseTransfer takes back the deposit of a request paid by a rejected
+// payment.
+func (s *Service) reverseTransfer(payment *types.Payment) {
+	for _, request := range s.paymentRequests {
+		if request.PaymentID != payment.ID || request.DepositID == "" {
+			continue
+		}
+		deposit, err := s.FindDepositByID(request.DepositID)
+		if err != nil || deposit.Status == types.DepositStatusReversed {
+			continue
+		}
+		account, err := s.FindAccountByID(deposit.AccountID)
+		if err != nil {
+			continue
+		}
+		s.reverseDeposit(account, deposit)
+	}
+}
+
+// paymentRequestAuditTarget is the account asked to pay the request.
+func (s *Service) paymentRequestAuditTarget(requestID string) auditTarget {
+	if s.auditLog == nil {
+		return auditTarget{}
+	}
+	target := auditTarget{}
+	if request, err := s.FindPaymentRequestByID(requestID); err == nil {
+		if payer, err := s.findAccountByPhone(request.Phone); err == nil {
+			target.accountID = payer.ID
+		}
+	}
+	return target
+}
+
+func paymentRequestsTable(requests []*PaymentRequest) table {
+	return table{
+		columns: paymentRequestColumns,
+		rows:    len(requests),
+		fields:  func(row int) []string { return paymentRequestFields(requests[row]) },
+		value:   func(row int) interface{} { return requests[row] },
+	}
+}
+
+func paymentRequestFields(request *PaymentRequest) []string {
+	return []string{
+		request.ID,
+		strconv.FormatInt(request.AccountID, 10),
+		string(request.Phone),
+		strconv.FormatInt(int64(request.Amount), 10),
+		string(request.Category),
+		request.Memo,
+		string(request.Status),
+		request.PaymentID,
+		request.DepositID,
+		strconv.FormatInt(request.Created, 10),
+		strconv.FormatInt(request.Expires, 10),
+	}
+}
+
+func parsePaymentRequestFields(fields []string, value interface{}) error {
+	if len(fields) < 11 {
+		return ErrWrongLineFormat
+	}
+	accountID, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return err
+	}
+	amount, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return err
+	}
+	created, err := strconv.ParseInt(fields[9], 10, 64)
+	if err != nil {
+		return err
+	}
+	expires, err := strconv.ParseInt(fields[10], 10, 64)
+	if err != nil {
+		return err
+	}
+	*value.(*PaymentRequest) = PaymentRequest{
+		ID:        fields[0],
+		AccountID: accountID,
+		Phone:     types.Phone(fields[2]),
+		Amount:    types.Money(amount),
+		Category:  types.PaymentCategory(fields[4]),
+		Memo:      fields[5],
+		Status:    PaymentRequestStatus(fields[6]),
+		PaymentID: fields[7],
+		DepositID: fields[8],
+		Created:   created,
+		Expires:   expires,
+	}
+	return nil
+}
+
+func (s *Service) paymentRequestRecord(index *importIndex) func(fields []string, data []byte) error {
+	return func(fields []string, data []byte) error {
+		request := &PaymentRequest{}
+		err := decodeRecord(fields, data, request, parsePaymentRequestFields)
+		if err != nil {
+			s.log().Warn("skipped wrong record", "table", "payment_requests", "error", err)
+			return nil
+		}
+		s.upsertPaymentRequest(index, request)
+		return nil
+	}
+}
+
+func (s *Service) upsertPaymentRequest(index *importIndex, request *PaymentRequest) {
+	s.changes.paymentRequest(request.ID)
+	if i, ok := index.paymentRequests[request.ID]; ok {
+		s.paymentRequests[i] = request
+		return
+	}
+	index.paymentRequests[request.ID] = len(s.paymentRequests)
+	s.paymentRequests = append(s.paymentRequests, request)
+}
+
+func (session *Session) RequestPayment(phone types.Phone, amount types.Money, category types.PaymentCategory,
+	memo string,
+) (*PaymentRequest, error) {
+	leave, err := session.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return session.s.RequestPayment(session.AccountID, phone, amount, category, memo)
+}
+
+func (session *Session) AcceptPaymentRequest(requestID string) (*types.Payment, error) {
+	leave, err := session.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return session.s.AcceptPaymentRequest(requestID)
+}
+
+func (session *Session) DeclinePaymentRequest(requestID string) error {
+	leave, err := session.enter()
+	if err != nil {
+		return err
+	}
+	defer leave()
+	return session.s.DeclinePaymentRequest(requestID)
+}
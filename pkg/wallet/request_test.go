@@ -0,0 +1,179 @@
+package wallet
+
+import (
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestService_AcceptPaymentRequest(t *testing.T) {
+	s := newTestService(withClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)))
+	s.addAccounts(t, 10_000, "1", "2")
+	monitor := NewAMLMonitor(AMLConfig{Threshold: 5_000, Window: time.Hour})
+	monitor.Attach(s.Service)
+	if _, err := s.RequestPayment(1, "1", 100, "dinner", ""); err != ErrWrongPaymentRequest {
+		t.Errorf("want: %v, got: %v", ErrWrongPaymentRequest, err)
+	}
+	if _, err := s.RequestPayment(1, "3", 100, "dinner", ""); err != ErrAccountNotFound {
+		t.Errorf("want: %v, got: %v", ErrAccountNotFound, err)
+	}
+	request, err := s.RequestPayment(1, "2", 6_000, "dinner", "Friday")
+	if err != nil {
+		t.Fatal(err)
+	}
+	incoming, outgoing, err := s.PaymentRequests(2)
+	if err != nil || len(incoming) != 1 || incoming[0].ID != request.ID || len(outgoing) != 0 {
+		t.Errorf("invalid requests: %v, %v, %v", incoming, outgoing, err)
+	}
+
+	payment, err := s.AcceptPaymentRequest(request.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.AccountID != 2 || payment.Amount != 6_000 || payment.Category != "dinner" {
+		t.Errorf("invalid payment: %+v", payment)
+	}
+	deposit, err := s.FindDepositByID(request.DepositID)
+	if err != nil || deposit.AccountID != 1 || deposit.Source != types.DepositSourceTransfer || deposit.Reference != payment.ID {
+		t.Errorf("invalid deposit: %+v, %v", deposit, err)
+	}
+	if request.Status != PaymentRequestStatusAccepted || request.PaymentID != payment.ID {
+		t.Errorf("invalid request: %+v", request)
+	}
+	if _, err := s.AcceptPaymentRequest(request.ID); err != ErrPaymentRequestClosed {
+		t.Errorf("want: %v, got: %v", ErrPaymentRequestClosed, err)
+	}
+	if len(monitor.Cases(1)) != 1 || len(monitor.Cases(2)) != 1 {
+		t.Errorf("transfer not monitored: %v, %v", monitor.Cases(1), monitor.Cases(2))
+	}
+
+	if err := s.Reject(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, accountID := range []int64{1, 2} {
+		if account, _ := s.FindAccountByID(accountID); account.Balance != 10_000 {
+			t.Errorf("account %d balance: %d", accountID, account.Balance)
+		}
+	}
+}
+
+func TestService_AcceptPaymentRequest_review(t *testing.T) {
+	s := newTestService(withClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)),
+		withRiskEngine(NewRiskEngine(NewCategoryRule{Decision: RiskReview})))
+	s.addAccounts(t, 10_000, "1", "2")
+	approved, err := s.RequestPayment(1, "2", 600, "dinner", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected, err := s.RequestPayment(1, "2", 400, "taxi", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, request := range []*PaymentRequest{approved, rejected} {
+		if _, err := s.AcceptPaymentRequest(request.ID); err != nil {
+			t.Fatal(err)
+		}
+		if request.Status != PaymentRequestStatusAccepted || request.DepositID != "" {
+			t.Errorf("deposited before review: %+v", request)
+		}
+	}
+	if account, _ := s.FindAccountByID(1); account.Balance != 10_000 {
+		t.Errorf("requester balance in review: %d", account.Balance)
+	}
+
+	if err := s.ApprovePayment(approved.PaymentID); err != nil {
+		t.Fatal(err)
+	}
+	deposit, err := s.FindDepositByID(approved.DepositID)
+	if err != nil || deposit.AccountID != 1 || deposit.Amount != 600 || deposit.Reference != approved.PaymentID {
+		t.Errorf("invalid deposit: %+v, %v", deposit, err)
+	}
+	if err := s.Reject(rejected.PaymentID); err != nil {
+		t.Fatal(err)
+	}
+	if rejected.DepositID != "" {
+		t.Errorf("rejected payment deposited: %+v", rejected)
+	}
+	for accountID, balance := range map[int64]types.Money{1: 10_600, 2: 9_400} {
+		if account, _ := s.FindAccountByID(accountID); account.Balance != balance {
+			t.Errorf("account %d balance: %d, want: %d", accountID, account.Balance, balance)
+		}
+	}
+}
+
+func TestService_DeclinePaymentRequest(t *testing.T) {
+	s := newTestService(withClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)))
+	s.addAccounts(t, 10_000, "1", "2")
+	declined, err := s.RequestPayment(1, "2", 100, "dinner", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiring, err := s.RequestPayment(2, "1", 100, "dinner", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeclinePaymentRequest(declined.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeclinePaymentRequest(declined.ID); err != ErrPaymentRequestClosed {
+		t.Errorf("want: %v, got: %v", ErrPaymentRequestClosed, err)
+	}
+
+	*s.clock = s.clock.Add(PaymentRequestTTL)
+	if _, err := s.AcceptPaymentRequest(expiring.ID); err != ErrPaymentRequestExpired {
+		t.Errorf("want: %v, got: %v", ErrPaymentRequestExpired, err)
+	}
+	expired, err := s.ExpirePaymentRequests()
+	if err != nil || len(expired) != 1 || expired[0].ID != expiring.ID || expired[0].Status != PaymentRequestStatusExpired {
+		t.Errorf("invalid expired requests: %+v, %v", expired, err)
+	}
+	if declined.Status != PaymentRequestStatusDeclined || len(s.payments) != 0 {
+		t.Errorf("invalid request: %+v", declined)
+	}
+}
+
+func TestAuthorized_AcceptPaymentRequest(t *testing.T) {
+	s := newTestService(withClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)))
+	s.addAccounts(t, 10_000, "1", "2")
+	request, err := s.RequestPayment(1, "2", 100, "dinner", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requester := s.As(Principal{ID: "alice", Role: RoleCustomer, AccountID: 1})
+	if _, err := requester.AcceptPaymentRequest(request.ID); err != ErrPermissionDenied {
+		t.Errorf("want: %v, got: %v", ErrPermissionDenied, err)
+	}
+	payer := s.As(Principal{ID: "bob", Role: RoleCustomer, AccountID: 2})
+	if _, err := payer.AcceptPaymentRequest(request.ID); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestService_paymentRequests_roundTrip(t *testing.T) {
+	for _, format := range []Format{FormatDump, FormatJSON, FormatCSV, FormatBinary} {
+		s := newTestService(withClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)))
+		s.addAccounts(t, 10_000, "1", "2")
+		request, err := s.RequestPayment(1, "2", 100, "dinner", "pizza; drinks | tip")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.AcceptPaymentRequest(request.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.RequestPayment(2, "1", 50, "taxi", ""); err != nil {
+			t.Fatal(err)
+		}
+		dir := t.TempDir()
+		if err := s.ExportFormat(dir, format); err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		var got Service
+		if err := got.ImportFormat(dir, format); err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		if !reflect.DeepEqual(got.paymentRequests, s.paymentRequests) {
+			t.Errorf("format %d: requests got: %v, want: %v", format, got.paymentRequests, s.paymentRequests)
+		}
+	}
+}
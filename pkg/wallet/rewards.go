@@ -0,0 +1,307 @@
+package wallet
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"math"
+	"math/bits"
+	"strconv"
+)
+
+var ErrRewardsDisabled = errors.New("rewards program not set")
+var ErrNotEnoughPoints = errors.New("not enough points")
+
+type RewardStatus string
+
+const (
+	RewardStatusOk       RewardStatus = "OK"
+	RewardStatusReversed RewardStatus = "REVERSED"
+)
+
+var rewardColumns = []string{"id", "account_id", "payment_id", "deposit_id", "cashback", "points", "status", "created"}
+
+// RewardRule rewards payments of Category, of any category when it is
+// empty, of at least MinAmount.
+type RewardRule struct {
+	Category  types.PaymentCategory
+	MinAmount types.Money
+	// Cashback is credited to the balance, in basis points of the amount
+	// rounded down.
+	Cashback int64
+	// Points are awarded for every full PointsPer of the amount, once per
+	// payment when PointsPer is zero.
+	Points    int64
+	PointsPer types.Money
+}
+
+// RewardsProgram awards a payment by the first of its rules matching it.
+type RewardsProgram struct {
+	Rules []RewardRule
+	// PointValue is the money a point is redeemed for.
+	PointValue types.Money
+}
+
+// Reward is what a payment earned, or points redeemed when PaymentID is
+// empty and Points is negative. DepositID is the deposit of the cashback or
+// of the redeemed points.
+type Reward struct {
+	ID        string       `json:"id"`
+	AccountID int64        `json:"account_id"`
+	PaymentID string       `json:"payment_id,omitempty"`
+	DepositID string       `json:"deposit_id,omitempty"`
+	Cashback  types.Money  `json:"cashback"`
+	Points    int64        `json:"points"`
+	Status    RewardStatus `json:"status"`
+	Created   int64        `json:"created"`
+}
+
+// SetRewardsProgram starts rewarding payments made from now on, nil stops
+// it. Rewards already earned stay.
+func (s *Service) SetRewardsProgram(program *RewardsProgram) {
+	s.rewardsProgram = program
+}
+
+func (p *RewardsProgram) rule(payment *types.Payment) *RewardRule {
+	for i, rule := range p.Rules {
+		if (rule.Category == "" || rule.Category == payment.Category) && payment.Amount >= rule.MinAmount {
+			return &p.Rules[i]
+		}
+	}
+	return nil
+}
+
+// award credits the reward of a committed payment.
+func (s *Service) award(account *types.Account, payment *types.Payment) {
+	if s.rewardsProgram == nil {
+		return
+	}
+	rule := s.rewardsProgram.rule(payment)
+	if rule == nil {
+		return
+	}
+	reward := &Reward{
+		ID:        uuid.New().String(),
+		AccountID: account.ID,
+		PaymentID: payment.ID,
+		Cashback:  cashback(payment.Amount, rule.Cashback),
+		Points:    rule.Points,
+		Status:    RewardStatusOk,
+		Created:   s.now().Unix(),
+	}
+	if rule.PointsPer > 0 {
+		reward.Points = points(int64(payment.Amount/rule.PointsPer), rule.Points)
+	}
+	if reward.Cashback <= 0 && reward.Points <= 0 {
+		return
+	}
+	if reward.Cashback > 0 {
+		reward.DepositID = s.deposit(account, reward.Cashback, types.DepositSourceCashback, payment.ID).ID
+	}
+	s.rewards = append(s.rewards, reward)
+	s.changes.reward(reward.ID)
+	s.publish(RewardAwarded{EventMeta: s.eventMeta(account.ID), Reward: *reward})
+}
+
+// cashback is basisPoints of amount rounded down. It divides first so that
+// large amounts don't overflow.
+func cashback(amount types.Money, basisPoints int64) types.Money {
+	bp := types.Money(basisPoints)
+	return amount/10_000*bp + amount%10_000*bp/10_000
+}
+
+// points is units*perUnit, capped at math.MaxInt64 instead of overflowing.
+func points(units int64, perUnit int64) int64 {
+	if units <= 0 || perUnit <= 0 {
+		return units * perUnit
+	}
+	hi, lo := bits.Mul64(uint64(units), uint64(perUnit))
+	if hi != 0 || lo > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(lo)
+}
+
+// reverseReward takes back what a rejected payment earned. Points already
+// redeemed may leave the account with a negative points balance.
+func (s *Service) reverseReward(account *types.Account, payment *types.Payment) {
+	for _, reward := range s.rewards {
+		if reward.PaymentID != payment.ID || reward.Status != RewardStatusOk {
+			continue
+		}
+		if reward.DepositID != "" {
+			deposit, err := s.FindDepositByID(reward.DepositID)
+			if err == nil && deposit.Status != types.DepositStatusReversed {
+				s.reverseDeposit(account, deposit)
+			}
+		}
+		reward.Status = RewardStatusReversed
+		s.changes.reward(reward.ID)
+		s.publish(RewardReversed{EventMeta: s.eventMeta(account.ID), Reward: *reward})
+	}
+}
+
+// Points returns the points balance of the account.
+func (s *Service) Points(accountID int64) (int64, error) {
+	_, err := s.FindAccountByID(accountID)
+	if err != nil {
+		return 0, err
+	}
+	return s.points(accountID), nil
+}
+
+func (s *Service) points(accountID int64) int64 {
+	points := int64(0)
+	for _, reward := range s.rewards {
+		if reward.AccountID == accountID && reward.Status == RewardStatusOk {
+			points += reward.Points
+		}
+	}
+	return points
+}
+
+// Rewards returns the rewards and redemptions of the account in the order
+// they were made.
+func (s *Service) Rewards(accountID int64) ([]Reward, error) {
+	_, err := s.FindAccountByID(accountID)
+	if err != nil {
+		return nil, err
+	}
+	rewards := make([]Reward, 0)
+	for _, reward := range s.rewards {
+		if reward.AccountID == accountID {
+			rewards = append(rewards, *reward)
+		}
+	}
+	return rewards, nil
+}
+
+// RedeemPoints deposits the value of points to the account.
+func (s *Service) RedeemPoints(accountID int64, points int64) (result *types.Deposit, err error) {
+	op := s.beginOperation("RedeemPoints", accountID, map[string]string{"points": strconv.FormatInt(points, 10)},
+		auditTarget{accountID: accountID})
+	defer func() {
+		after := auditTarget{accountID: accountID}
+		if result != nil {
+			after.depositID = result.ID
+		}
+		op.end(err, after)
+	}()
+	if s.rewardsProgram == nil || s.rewardsProgram.PointValue <= 0 {
+		return nil, ErrRewardsDisabled
+	}
+	if points <= 0 {
+		return nil, ErrAmountMustBePositive
+	}
+	account, err := s.FindAccountByID(accountID)
+	if err != nil {
+		return nil, err
+	}
+	if s.points(accountID) < points {
+		return nil, ErrNotEnoughPoints
+	}
+	err = s.checkSession(account.ID)
+	if err != nil {
+		return nil, err
+	}
+	reward := &Reward{
+		ID:        uuid.New().String(),
+		AccountID: account.ID,
+		Points:    -points,
+		Status:    RewardStatusOk,
+		Created:   s.now().Unix(),
+	}
+	deposit := s.deposit(account, types.Money(points)*s.rewardsProgram.PointValue, types.DepositSourceRewards, reward.ID)
+	reward.DepositID = deposit.ID
+	s.rewards = append(s.rewards, reward)
+	s.changes.reward(reward.ID)
+	s.publish(PointsRedeemed{EventMeta: s.eventMeta(account.ID), Reward: *reward, Deposit: *deposit})
+	return deposit, nil
+}
+
+func rewardsTable(rewards []*Reward) table {
+	return table{
+		columns: rewardColumns,
+		rows:    len(rewards),
+		fields:  func(row int) []string { return rewardFields(rewards[row]) },
+		value:   func(row int) interface{} { return rewards[row] },
+	}
+}
+
+func rewardFields(reward *Reward) []string {
+	return []string{
+		reward.ID,
+		strconv.FormatInt(reward.AccountID, 10),
+		reward.PaymentID,
+		reward.DepositID,
+		strconv.FormatInt(int64(reward.Cashback), 10),
+		strconv.FormatInt(reward.Points, 10),
+		string(reward.Status),
+		strconv.FormatInt(reward.Created, 10),
+	}
+}
+
+func parseRewardFields(fields []string, value interface{}) error {
+	if len(fields) < 8 {
+		return ErrWrongLineFormat
+	}
+	accountID, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return err
+	}
+	cashback, err := strconv.ParseInt(fields[4], 10, 64)
+	if err != nil {
+		return err
+	}
+	points, err := strconv.ParseInt(fields[5], 10, 64)
+	if err != nil {
+		return err
+	}
+	created, err := strconv.ParseInt(fields[7], 10, 64)
+	if err != nil {
+		return err
+	}
+	*value.(*Reward) = Reward{
+		ID:        fields[0],
+		AccountID: accountID,
+		PaymentID: fields[2],
+		DepositID: fields[3],
+		Cashback:  types.Money(cashback),
+		Points:    points,
+		Status:    RewardStatus(fields[6]),
+		Created:   created,
+	}
+	return nil
+}
+
+func (s *Service) rewardRecord(index *importIndex) func(fields []string, data []byte) error {
+	return func(fields []string, data []byte) error {
+		reward := &Reward{}
+		err := decodeRecord(fields, data, reward, parseRewardFields)
+		if err != nil {
+			s.log().Warn("skipped wrong record", "table", "rewards", "error", err)
+			return nil
+		}
+		s.upsertReward(index, reward)
+		return nil
+	}
+}
+
+func (s *Service) upsertReward(index *importIndex, reward *Reward) {
+	s.changes.reward(reward.ID)
+	if i, ok := index.rewards[reward.ID]; ok {
+		s.rewards[i] = reward
+		return
+	}
+	index.rewards[reward.ID] = len(s.rewards)
+	s.rewards = append(s.rewards, reward)
+}
+
+func (session *Session) RedeemPoints(points int64) (*types.Deposit, error) {
+	leave, err := session.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return session.s.RedeemPoints(session.AccountID, points)
+}
@@ -0,0 +1,174 @@
+package wallet
+
+import (
+	"context"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"math"
+	"reflect"
+	"testing"
+)
+
+var rewardsTestProgram = RewardsProgram{
+	Rules: []RewardRule{
+		{Category: "utilities", MinAmount: 1_000, Cashback: 150, Points: 1, PointsPer: 100},
+		{Category: "utilities", Points: 5},
+		{Category: "mobile", Cashback: 100},
+	},
+	PointValue: 10,
+}
+
+func TestService_Pay_rewards(t *testing.T) {
+	s := newTestService(withRewards(&rewardsTestProgram))
+	s.addAccounts(t, 100_000, "1")
+	payment, err := s.Pay(1, 2_050, "utilities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, category := range []types.PaymentCategory{"utilities", "mobile", "auto"} {
+		if _, err := s.Pay(1, 500, category); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rewards, err := s.Rewards(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rewards) != 3 || rewards[0].PaymentID != payment.ID || rewards[0].Cashback != 30 || rewards[0].Points != 20 ||
+		rewards[1].Cashback != 0 || rewards[1].Points != 5 || rewards[2].Cashback != 5 || rewards[2].Points != 0 {
+		t.Errorf("invalid rewards: %+v", rewards)
+	}
+	if points, _ := s.Points(1); points != 25 {
+		t.Errorf("points: %d", points)
+	}
+	if account, _ := s.FindAccountByID(1); account.Balance != 100_000-3_550+35 {
+		t.Errorf("cashback not credited: %d", account.Balance)
+	}
+
+	if err := s.Reject(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reject(payment.ID); err != ErrPaymentAlreadyRejected {
+		t.Errorf("want: %v, got: %v", ErrPaymentAlreadyRejected, err)
+	}
+	if points, _ := s.Points(1); points != 5 {
+		t.Errorf("points after reject: %d", points)
+	}
+	deposit, _ := s.FindDepositByID(rewards[0].DepositID)
+	if deposit.Status != types.DepositStatusReversed || deposit.Source != types.DepositSourceCashback {
+		t.Errorf("cashback not reversed: %+v", deposit)
+	}
+}
+
+func Test_cashback(t *testing.T) {
+	tests := []struct {
+		amount      types.Money
+		basisPoints int64
+		want        types.Money
+	}{
+		{2_050, 150, 30},
+		{9_999, 1, 0},
+		{10_000, 1, 1},
+		{math.MaxInt64, 150, 138_350_580_552_821_637},
+		{math.MaxInt64, 10_000, math.MaxInt64},
+	}
+	for _, test := range tests {
+		if got := cashback(test.amount, test.basisPoints); got != test.want {
+			t.Errorf("cashback(%d, %d) = %d, want: %d", test.amount, test.basisPoints, got, test.want)
+		}
+	}
+}
+
+func Test_points(t *testing.T) {
+	tests := []struct {
+		units   int64
+		perUnit int64
+		want    int64
+	}{
+		{20, 1, 20},
+		{0, 5, 0},
+		{1 << 32, 1 << 30, 1 << 62},
+		{1 << 32, 1 << 31, math.MaxInt64},
+		{math.MaxInt64, math.MaxInt64, math.MaxInt64},
+	}
+	for _, test := range tests {
+		if got := points(test.units, test.perUnit); got != test.want {
+			t.Errorf("points(%d, %d) = %d, want: %d", test.units, test.perUnit, got, test.want)
+		}
+	}
+}
+
+func TestService_Pay_rewardsLargeAmount(t *testing.T) {
+	s := newTestService(withRewards(&RewardsProgram{Rules: []RewardRule{{Points: 1 << 20, PointsPer: 1}}}))
+	s.addAccounts(t, 1<<62, "1")
+	if _, err := s.Pay(1, 1<<61, "auto"); err != nil {
+		t.Fatal(err)
+	}
+	rewards, err := s.Rewards(1)
+	if err != nil || len(rewards) != 1 || rewards[0].Points != math.MaxInt64 {
+		t.Errorf("invalid rewards: %+v, %v", rewards, err)
+	}
+}
+
+func TestService_RedeemPoints(t *testing.T) {
+	s := newTestService(withRewards(&rewardsTestProgram))
+	s.addAccounts(t, 100_000, "1")
+	if _, err := s.Pay(1, 1_000, "utilities"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RedeemPoints(1, 11); err != ErrNotEnoughPoints {
+		t.Errorf("want: %v, got: %v", ErrNotEnoughPoints, err)
+	}
+	if _, err := s.RedeemPoints(1, 0); err != ErrAmountMustBePositive {
+		t.Errorf("want: %v, got: %v", ErrAmountMustBePositive, err)
+	}
+	deposit, err := s.RedeemPoints(1, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deposit.Amount != 40 || deposit.Source != types.DepositSourceRewards {
+		t.Errorf("invalid deposit: %+v", deposit)
+	}
+	if points, _ := s.Points(1); points != 6 {
+		t.Errorf("points: %d", points)
+	}
+	result, err := s.Reconcile(context.Background(), ReconcileOptions{})
+	if err != nil || len(result.Discrepancies) != 0 {
+		t.Errorf("rewards not reconciled: %+v, %v", result, err)
+	}
+
+	s.SetRewardsProgram(nil)
+	if _, err := s.RedeemPoints(1, 1); err != ErrRewardsDisabled {
+		t.Errorf("want: %v, got: %v", ErrRewardsDisabled, err)
+	}
+}
+
+func TestService_rewards_roundTrip(t *testing.T) {
+	for _, format := range []Format{FormatDump, FormatJSON, FormatCSV, FormatBinary} {
+		s := newTestService(withRewards(&rewardsTestProgram))
+		s.addAccounts(t, 100_000, "1")
+		payment, err := s.Pay(1, 1_000, "utilities")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.RedeemPoints(1, 5); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Reject(payment.ID); err != nil {
+			t.Fatal(err)
+		}
+		dir := t.TempDir()
+		if err := s.ExportFormat(dir, format); err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		var got Service
+		if err := got.ImportFormat(dir, format); err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		if !reflect.DeepEqual(got.rewards, s.rewards) {
+			t.Errorf("format %d: rewards got: %v, want: %v", format, got.rewards, s.rewards)
+		}
+		if points, _ := got.Points(1); points != -5 {
+			t.Errorf("format %d: points: %d", format, points)
+		}
+	}
+}
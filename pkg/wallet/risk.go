@@ -0,0 +1,270 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"time"
+)
+
+var ErrPaymentBlocked = errors.New("payment blocked by risk rules")
+var ErrPaymentNotInReview = errors.New("payment not in review")
+
+type RiskDecision int
+
+const (
+	RiskAllow RiskDecision = iota
+	// RiskReview makes the payment but keeps it INPROGRESS until ApprovePayment
+	// or Reject.
+	RiskReview
+	RiskBlock
+)
+
+func (d RiskDecision) String() string {
+	switch d {
+	case RiskReview:
+		return "review"
+	case RiskBlock:
+		return "block"
+	default:
+		return "allow"
+	}
+}
+
+// RiskInput is what rules know about a payment about to be made.
+type RiskInput struct {
+	Payment types.Payment
+	Account types.Account
+	// History holds the earlier payments of the account, oldest first.
+	History []types.Payment
+	Now     time.Time
+}
+
+type RiskHit struct {
+	Rule     string
+	Decision RiskDecision
+	Reason   string
+}
+
+// RiskRule returns RiskAllow for payments it has nothing against.
+type RiskRule interface {
+	Name() string
+	Evaluate(input RiskInput) (RiskDecision, string)
+}
+
+// RiskEngine runs every rule, the strictest decision wins.
+type RiskEngine struct {
+	rules []RiskRule
+}
+
+func NewRiskEngine(rules ...RiskRule) *RiskEngine {
+	return &RiskEngine{rules: rules}
+}
+
+// DefaultRiskEngine blocks bursts of payments and accounts with many recent
+// rejects, and reviews unusually large payments and new categories.
+func DefaultRiskEngine() *RiskEngine {
+	return NewRiskEngine(
+		VelocityRule{Window: time.Minute, MaxPayments: 5, Decision: RiskBlock},
+		AmountDeviationRule{MinHistory: 5, Factor: 5, Decision: RiskReview},
+		NewCategoryRule{MinHistory: 5, Decision: RiskReview},
+		RepeatedRejectsRule{Window: 24 * time.Hour, MaxRejects: 3, Decision: RiskBlock},
+	)
+}
+
+func (e *RiskEngine) Evaluate(input RiskInput) (RiskDecision, []RiskHit) {
+	decision := RiskAllow
+	var hits []RiskHit
+	for _, rule := range e.rules {
+		d, reason := rule.Evaluate(input)
+		if d == RiskAllow {
+			continue
+		}
+		hits = append(hits, RiskHit{Rule: rule.Name(), Decision: d, Reason: reason})
+		if d > decision {
+			decision = d
+		}
+	}
+	return decision, hits
+}
+
+// VelocityRule hits when the account made MaxPayments or more payments within
+// Window before this one.
+type VelocityRule struct {
+	Window      time.Duration
+	MaxPayments int
+	Decision    RiskDecision
+}
+
+func (r VelocityRule) Name() string {
+	return "velocity"
+}
+
+func (r VelocityRule) Evaluate(input RiskInput) (RiskDecision, string) {
+	since := input.Now.Add(-r.Window).Unix()
+	count := 0
+	for _, payment := range input.History {
+		if payment.Created > since {
+			count++
+		}
+	}
+	if count >= r.MaxPayments {
+		return r.Decision, fmt.Sprintf("%d payments in %v", count+1, r.Window)
+	}
+	return RiskAllow, ""
+}
+
+// AmountDeviationRule hits when the amount is more than Factor times the
+// average of the account's payments that weren't rejected.
+type AmountDeviationRule struct {
+	MinHistory int
+	Factor     int64
+	Decision   RiskDecision
+}
+
+func (r AmountDeviationRule) Name() string {
+	return "amount_deviation"
+}
+
+func (r AmountDeviationRule) Evaluate(input RiskInput) (RiskDecision, string) {
+	var stats Stats
+	for _, payment := range input.History {
+		if payment.Status != types.PaymentStatusFail {
+			stats = stats.Add(payment.Amount)
+		}
+	}
+	if stats.Count < r.MinHistory || stats.Avg() <= 0 {
+		return RiskAllow, ""
+	}
+	if int64(input.Payment.Amount) > int64(stats.Avg())*r.Factor {
+		return r.Decision, fmt.Sprintf("amount %d, average %d", input.Payment.Amount, stats.Avg())
+	}
+	return RiskAllow, ""
+}
+
+// NewCategoryRule hits for the first payment in a category once the account
+// has MinHistory payments in others.
+type NewCategoryRule struct {
+	MinHistory int
+	Decision   RiskDecision
+}
+
+func (r NewCategoryRule) Name() string {
+	return "new_category"
+}
+
+func (r NewCategoryRule) Evaluate(input RiskInput) (RiskDecision, string) {
+	if len(input.History) < r.MinHistory {
+		return RiskAllow, ""
+	}
+	for _, payment := range input.History {
+		if payment.Category == input.Payment.Category {
+			return RiskAllow, ""
+		}
+	}
+	return r.Decision, fmt.Sprintf("first payment in %q", input.Payment.Category)
+}
+
+// RepeatedRejectsRule hits when MaxRejects or more payments made within
+// Window were rejected.
+type RepeatedRejectsRule struct {
+	Window     time.Duration
+	MaxRejects int
+	Decision   RiskDecision
+}
+
+func (r RepeatedRejectsRule) Name() string {
+	return "repeated_rejects"
+}
+
+func (r RepeatedRejectsRule) Evaluate(input RiskInput) (RiskDecision, string) {
+	since := input.Now.Add(-r.Window).Unix()
+	count := 0
+	for _, payment := range input.History {
+		if payment.Status == types.PaymentStatusFail && payment.Created > since {
+			count++
+		}
+	}
+	if count >= r.MaxRejects {
+		return r.Decision, fmt.Sprintf("%d rejected payments in %v", count, r.Window)
+	}
+	return RiskAllow, ""
+}
+
+// SetRiskEngine makes Pay and Repeat evaluate every payment, nil turns the
+// checks off.
+func (s *Service) SetRiskEngine(engine *RiskEngine) {
+	s.risk = engine
+}
+
+// assessRisk runs before the payment changes anything. A blocked payment
+// fails, one to review gets its hits stored on it.
+func (s *Service) assessRisk(payment *types.Payment, account *types.Account) error {
+	if s.risk == nil {
+		return nil
+	}
+	input := RiskInput{Payment: *payment, Account: *account, Now: s.now()}
+	for _, p := range s.payments {
+		if p.AccountID == account.ID {
+			input.History = append(input.History, *p)
+		}
+	}
+	decision, hits := s.risk.Evaluate(input)
+	if decision == RiskAllow {
+		return nil
+	}
+	attrs := []interface{}{"payment_id", payment.ID, "account_id", account.ID, "decision", decision.String()}
+	for _, hit := range hits {
+		attrs = append(attrs, hit.Rule, hit.Reason)
+	}
+	s.log().Warn("risk rules hit", attrs...)
+	if decision == RiskBlock {
+		return ErrPaymentBlocked
+	}
+	payment.Status = types.PaymentStatusInProgress
+	for _, hit := range hits {
+		payment.RiskHits = append(payment.RiskHits, hit.Rule)
+	}
+	return nil
+}
+
+// PaymentsInReview returns the payments waiting for a manual decision.
+func (s *Service) PaymentsInReview() []types.Payment {
+	result := make([]types.Payment, 0)
+	for _, payment := range s.payments {
+		if inReview(payment) {
+			result = append(result, *payment)
+		}
+	}
+	return result
+}
+
+// ApprovePayment completes a payment in review, awards its rewards and makes
+// the deposit of a payment request it pays, all held back during the review.
+// Reject declines it.
+func (s *Service) ApprovePayment(paymentID string) (err error) {
+	target := s.paymentAuditTarget(paymentID)
+	op := s.beginOperation("ApprovePayment", target.accountID, map[string]string{"payment_id": paymentID}, target)
+	defer func() { op.end(err, target) }()
+	payment, err := s.FindPaymentByID(paymentID)
+	if err != nil {
+		return err
+	}
+	if !inReview(payment) {
+		return ErrPaymentNotInReview
+	}
+	account, err := s.FindAccountByID(payment.AccountID)
+	if err != nil {
+		return err
+	}
+	payment.Status = types.PaymentStatusOk
+	s.changes.payment(payment.ID)
+	s.publish(PaymentApproved{EventMeta: s.eventMeta(account.ID), Payment: *payment, Balance: account.Balance})
+	s.award(account, payment)
+	s.approveTransfer(payment)
+	return nil
+}
+
+func inReview(payment *types.Payment) bool {
+	return payment.Status == types.PaymentStatusInProgress && len(payment.RiskHits) != 0
+}
@@ -0,0 +1,184 @@
+package wallet
+
+import (
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newRiskTestService gives account 1 a history of five payments an hour
+// apart for the default rules.
+func newRiskTestService(t *testing.T) *testService {
+	s := newTestService(withClock(time.Unix(1700000000, 0)), withRiskEngine(DefaultRiskEngine()))
+	s.addAccounts(t, 100_000, "123")
+	for i := 0; i < 5; i++ {
+		if _, err := s.Pay(1, 100, "auto"); err != nil {
+			t.Fatal(err)
+		}
+		*s.clock = s.clock.Add(time.Hour)
+	}
+	return s
+}
+
+func TestService_Pay_riskReview(t *testing.T) {
+	s := newRiskTestService(t)
+	payment, err := s.Pay(1, 1000, "casino")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"amount_deviation", "new_category"}
+	if !reflect.DeepEqual(payment.RiskHits, want) || payment.Status != types.PaymentStatusInProgress {
+		t.Errorf("invalid payment: %+v", payment)
+	}
+	if review := s.PaymentsInReview(); len(review) != 1 || review[0].ID != payment.ID {
+		t.Errorf("invalid review queue: %+v", review)
+	}
+	var approved []PaymentApproved
+	s.Events().Subscribe(func(event Event) {
+		if e, ok := event.(PaymentApproved); ok {
+			approved = append(approved, e)
+		}
+	})
+	if err := s.ApprovePayment(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+	if payment.Status != types.PaymentStatusOk || len(s.PaymentsInReview()) != 0 {
+		t.Errorf("payment not approved: %+v", payment)
+	}
+	if len(approved) != 1 || approved[0].Payment.ID != payment.ID || approved[0].Balance != 100_000-1_500 {
+		t.Errorf("invalid events: %+v", approved)
+	}
+	if err := s.ApprovePayment(payment.ID); err != ErrPaymentNotInReview {
+		t.Errorf("want: %v, got: %v", ErrPaymentNotInReview, err)
+	}
+
+	normal, err := s.Pay(1, 150, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if normal.RiskHits != nil {
+		t.Errorf("normal payment was flagged: %+v", normal)
+	}
+}
+
+func TestService_Pay_riskReviewRewards(t *testing.T) {
+	s := newRiskTestService(t)
+	s.SetRewardsProgram(&RewardsProgram{Rules: []RewardRule{{Category: "casino", Cashback: 1_000}}})
+	approved, err := s.Pay(1, 1000, "casino")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected, err := s.Pay(1, 2000, "casino")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewards, _ := s.Rewards(1); len(rewards) != 0 {
+		t.Errorf("payments in review rewarded: %+v", rewards)
+	}
+	if err := s.Reject(rejected.ID); err != nil {
+		t.Fatal(err)
+	}
+	repeated, err := s.Repeat(rejected.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !inReview(repeated) {
+		t.Fatalf("repeated payment not in review: %+v", repeated)
+	}
+	if rewards, _ := s.Rewards(1); len(rewards) != 0 {
+		t.Errorf("repeated payment in review rewarded: %+v", rewards)
+	}
+	if err := s.ApprovePayment(approved.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ApprovePayment(repeated.ID); err != nil {
+		t.Fatal(err)
+	}
+	rewards, err := s.Rewards(1)
+	if err != nil || len(rewards) != 2 || rewards[0].PaymentID != approved.ID || rewards[0].Cashback != 100 ||
+		rewards[1].PaymentID != repeated.ID || rewards[1].Cashback != 200 {
+		t.Errorf("invalid rewards: %+v, %v", rewards, err)
+	}
+	if account, _ := s.FindAccountByID(1); account.Balance != 100_000-500-1_000-2_000+100+200 {
+		t.Errorf("invalid balance: %d", account.Balance)
+	}
+}
+
+func TestService_Pay_riskBlock(t *testing.T) {
+	s := newRiskTestService(t)
+	for i := 0; i < 5; i++ {
+		if _, err := s.Pay(1, 100, "auto"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	payments := len(s.payments)
+	if _, err := s.Pay(1, 100, "auto"); err != ErrPaymentBlocked {
+		t.Errorf("want: %v, got: %v", ErrPaymentBlocked, err)
+	}
+	if _, err := s.Repeat(s.payments[0].ID); err != ErrPaymentBlocked {
+		t.Errorf("want: %v, got: %v", ErrPaymentBlocked, err)
+	}
+	account, err := s.FindAccountByID(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.payments) != payments || account.Balance != 100_000-1000 {
+		t.Errorf("blocked payment changed state: %d payments, balance %v", len(s.payments), account.Balance)
+	}
+
+	*s.clock = s.clock.Add(time.Minute)
+	for _, payment := range s.payments[5:8] {
+		if err := s.Reject(payment.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Pay(1, 100, "auto"); err != ErrPaymentBlocked {
+		t.Errorf("repeated rejects: want: %v, got: %v", ErrPaymentBlocked, err)
+	}
+}
+
+func TestService_riskHits_persisted(t *testing.T) {
+	for _, format := range []Format{FormatDump, FormatJSON, FormatCSV, FormatBinary} {
+		s := newRiskTestService(t)
+		payment, err := s.Pay(1, 1000, "casino")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := t.TempDir()
+		if err := s.ExportFormat(dir, format); err != nil {
+			t.Fatal(err)
+		}
+		var got Service
+		if err := got.ImportFormat(dir, format); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.payments, s.payments) {
+			t.Errorf("format %d: got: %v, want: %v", format, got.payments, s.payments)
+		}
+		if review := got.PaymentsInReview(); len(review) != 1 || review[0].ID != payment.ID {
+			t.Errorf("format %d: invalid review queue: %+v", format, review)
+		}
+	}
+}
+
+type categoryRule struct{}
+
+func (categoryRule) Name() string {
+	return "blocked_category"
+}
+
+func (categoryRule) Evaluate(input RiskInput) (RiskDecision, string) {
+	if input.Payment.Category == "casino" {
+		return RiskBlock, "category is blocked"
+	}
+	return RiskAllow, ""
+}
+
+func TestRiskEngine_customRule(t *testing.T) {
+	engine := NewRiskEngine(categoryRule{}, NewCategoryRule{Decision: RiskReview})
+	decision, hits := engine.Evaluate(RiskInput{Payment: types.Payment{Category: "casino"}})
+	if decision != RiskBlock || len(hits) != 2 || hits[0].Rule != "blocked_category" {
+		t.Errorf("invalid result: %v, %+v", decision, hits)
+	}
+}
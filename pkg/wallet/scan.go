@@ -0,0 +1,120 @@
+package wallet
+
+import (
+	"context"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"sync"
+)
+
+// scanParts returns how many parts of partSize records cover n records.
+func scanParts(n int, partSize int) int {
+	if n == 0 {
+		return 0
+	}
+	if partSize <= 0 || partSize > n {
+		return 1
+	}
+	parts := n / partSize
+	if n%partSize != 0 {
+		parts++
+	}
+	return parts
+}
+
+// partSizeFor splits n records into one part per goroutine.
+func partSizeFor(n int, goroutines int) int {
+	if goroutines <= 1 || n == 0 {
+		return n
+	}
+	if goroutines > n {
+		goroutines = n
+	}
+	size := n / goroutines
+	if n%goroutines != 0 {
+		size++
+	}
+	return size
+}
+
+// scanPayments cuts payments into parts of partSize records and calls fn
+// for every part from at most workers goroutines. fn gets the part index, so
+// callers collect results into a slice and combine them in order regardless
+// of scheduling. The first error returned by fn, or the cancellation of ctx,
+// stops the parts that haven't started yet and is returned.
+func scanPayments(ctx context.Context, payments []*types.Payment, workers int, partSize int,
+	fn func(part int, payments []*types.Payment) error,
+) error {
+	parts := scanParts(len(payments), partSize)
+	if partSize <= 0 || partSize > len(payments) {
+		partSize = len(payments)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > parts {
+		workers = parts
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if parts == 0 {
+		return nil
+	}
+	part := func(i int) []*types.Payment {
+		end := (i + 1) * partSize
+		if end > len(payments) {
+			end = len(payments)
+		}
+		return payments[i*partSize : end]
+	}
+	if workers == 1 {
+		for i := 0; i < parts; i++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(i, part(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var once sync.Once
+	var firstErr error
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := fn(i, part(i)); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+feed:
+	for i := 0; i < parts; i++ {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,146 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"reflect"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// withScanPayments adds two accounts and n payments of 1, 2, ..., n.
+func withScanPayments(n int) testOption {
+	return func(s *testService) {
+		s.accounts = append(s.accounts, &types.Account{ID: 1}, &types.Account{ID: 2})
+		for i := 0; i < n; i++ {
+			s.payments = append(s.payments, &types.Payment{
+				ID:        strconv.Itoa(i),
+				AccountID: int64(i%2 + 1),
+				Amount:    types.Money(i + 1),
+				Category:  "auto",
+				Status:    types.PaymentStatusOk,
+			})
+		}
+	}
+}
+
+func TestService_SumPayments_goroutines(t *testing.T) {
+	for _, n := range []int{0, 1, 3, 10, 101} {
+		s := newTestService(withScanPayments(n))
+		want := types.Money(n * (n + 1) / 2)
+		for _, goroutines := range []int{-1, 0, 1, 2, 3, 7, 200} {
+			if got := s.SumPayments(goroutines); got != want {
+				t.Errorf("payments %d, goroutines %d: got: %v, want: %v", n, goroutines, got, want)
+			}
+		}
+		if len(s.payments) != n {
+			t.Errorf("SumPayments changed payments: %d", len(s.payments))
+		}
+	}
+}
+
+func TestService_FilterPayments_order(t *testing.T) {
+	s := newTestService(withScanPayments(51))
+	want, err := s.FilterPayments(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, payment := range want {
+		if payment.ID != strconv.Itoa(i*2) {
+			t.Fatalf("sequential filter out of order: %v", want)
+		}
+	}
+	for _, goroutines := range []int{0, 2, 5, 100} {
+		got, err := s.FilterPayments(1, goroutines)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("goroutines %d: got: %v, want: %v", goroutines, got, want)
+		}
+	}
+}
+
+func TestService_FilterPayments_firstAccount(t *testing.T) {
+	s := newTestService(withScanPayments(4))
+	got, err := s.FilterPayments(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Errorf("invalid payments: %v", got)
+	}
+	if _, err := s.FilterPayments(3, 2); err != ErrAccountNotFound {
+		t.Errorf("want: %v, got: %v", ErrAccountNotFound, err)
+	}
+}
+
+func TestService_FilterPaymentsByFn_notFound(t *testing.T) {
+	s := newTestService(withScanPayments(5))
+	_, err := s.FilterPaymentsByFn(func(payment types.Payment) bool {
+		return false
+	}, 3)
+	if err != ErrPaymentNotFound {
+		t.Errorf("want: %v, got: %v", ErrPaymentNotFound, err)
+	}
+}
+
+func TestService_SumPaymentsContext_canceled(t *testing.T) {
+	s := newTestService(withScanPayments(10))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, goroutines := range []int{1, 4} {
+		if _, err := s.SumPaymentsContext(ctx, goroutines); err != context.Canceled {
+			t.Errorf("goroutines %d: want: %v, got: %v", goroutines, context.Canceled, err)
+		}
+	}
+}
+
+func Test_scanPayments_boundedWorkers(t *testing.T) {
+	s := newTestService(withScanPayments(100))
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	visited := make([]bool, scanParts(100, 3))
+	err := scanPayments(context.Background(), s.payments, 4, 3, func(part int, payments []*types.Payment) error {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		visited[part] = true
+		mu.Unlock()
+		runtime.Gosched()
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxRunning > 4 {
+		t.Errorf("%d parts ran at once, want at most 4", maxRunning)
+	}
+	for part, ok := range visited {
+		if !ok {
+			t.Errorf("part %d was not scanned", part)
+		}
+	}
+}
+
+func Test_scanPayments_error(t *testing.T) {
+	s := newTestService(withScanPayments(100))
+	errPart := errors.New("part failed")
+	err := scanPayments(context.Background(), s.payments, 3, 5, func(part int, payments []*types.Payment) error {
+		if part == 2 {
+			return errPart
+		}
+		return nil
+	})
+	if err != errPart {
+		t.Errorf("want: %v, got: %v", errPart, err)
+	}
+}
@@ -1,18 +1,18 @@
 package wallet
 
 import (
-	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"github.com/google/uuid"
 	"github.com/rustamfozilov/wallet/pkg/types"
 	"io"
-	"io/ioutil"
-	"log"
-	"os"
+	"log/slog"
 	"path"
+	"runtime"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 )
 
 var ErrAccountNotFound = errors.New("account not found")
@@ -20,6 +20,8 @@ var ErrPhoneRegistered = errors.New("phone already registered")
 var ErrAmountMustBePositive = errors.New("amount must be greater than zero")
 var ErrPaymentNotFound = errors.New("payment not found")
 var ErrFavoriteNotFound = errors.New("favorite not found")
+var ErrPaymentAlreadyRejected = errors.New("payment already rejected")
+var ErrWrongLineFormat = errors.New("wrong line format")
 
 //var ErrAccountNotFound = errors.New("account not found")
 type Service struct {
@@ -27,9 +29,61 @@ type Service struct {
 	accounts      []*types.Account
 	payments      []*types.Payment
 	favorites     []*types.Favorite
+	keys          KeyProvider
+	plaintext     bool
+	changes       changeSet
+	clock         func() time.Time
+	events        *EventBus
+	eventSeq      uint64
+	auditLog      *AuditLog
+	actor         string
+	logger        *slog.Logger
+	metrics       Metrics
+
+	credentials      []*credential
+	sessions         map[string]*Session
+	pinResets        map[int64]pinReset
+	requireSessions  bool
+	sessionAccountID int64
+
+	risk *RiskEngine
+
+	ledger       []*LedgerEntry
+	nextLedgerID int64
+	deposits     []*types.Deposit
+	budgets      []*Budget
+
+	rewardsProgram *RewardsProgram
+	rewards        []*Reward
+
+	interest *InterestConfig
+	accruals []*interestAccrual
+
+	splits          []*Split
+	paymentRequests []*PaymentRequest
 }
 
-func (s *Service) RegisterAccount(phone types.Phone) (*types.Account, error) {
+// SetClock replaces time.Now as the source of payment times, nil restores it.
+func (s *Service) SetClock(clock func() time.Time) {
+	s.clock = clock
+}
+
+func (s *Service) now() time.Time {
+	if s.clock != nil {
+		return s.clock()
+	}
+	return time.Now()
+}
+
+func (s *Service) RegisterAccount(phone types.Phone) (result *types.Account, err error) {
+	op := s.beginOperation("RegisterAccount", 0, map[string]string{"phone": string(phone)}, auditTarget{})
+	defer func() {
+		after := auditTarget{}
+		if result != nil {
+			after.accountID = result.ID
+		}
+		op.end(err, after)
+	}()
 	for _, account := range s.accounts {
 		if account.Phone == phone {
 			return nil, ErrPhoneRegistered
@@ -42,28 +96,16 @@ func (s *Service) RegisterAccount(phone types.Phone) (*types.Account, error) {
 		Balance: 0,
 	}
 	s.accounts = append(s.accounts, account)
+	s.changes.account(account.ID)
+	s.publish(AccountRegistered{EventMeta: s.eventMeta(account.ID), Account: *account})
 
 	return account, nil
 
 }
 
 func (s *Service) Deposit(accountID int64, amount types.Money) error {
-	if amount <= 0 {
-		return ErrAmountMustBePositive
-	}
-	var account *types.Account
-
-	for _, acc := range s.accounts {
-		if acc.ID == accountID {
-			account = acc
-			break
-		}
-	}
-	if account == nil {
-		return ErrAccountNotFound
-	}
-	account.Balance += amount
-	return nil
+	_, err := s.DepositFrom(accountID, amount, types.DepositSourceCashTerminal, "")
+	return err
 }
 
 func (s *Service) FindAccountByID(accountID int64) (*types.Account, error) {
@@ -105,39 +147,106 @@ func (s *Service) FindPaymentByID(paymentID string) (*types.Payment, error) {
 	return nil, ErrPaymentNotFound
 }
 
-func (s *Service) Pay(accountID int64, amount types.Money, category types.PaymentCategory) (*types.Payment, error) {
+func (s *Service) Pay(accountID int64, amount types.Money, category types.PaymentCategory) (result *types.Payment, err error) {
+	op := s.beginOperation("Pay", accountID, map[string]string{
+		"amount":   strconv.FormatInt(int64(amount), 10),
+		"category": string(category),
+	}, auditTarget{accountID: accountID})
+	defer func() {
+		after := auditTarget{accountID: accountID}
+		if result != nil {
+			after.paymentID = result.ID
+		}
+		op.end(err, after)
+	}()
+	// to do acc
+	account, err := s.FindAccountByID(accountID)
+	if err != nil {
+		return nil, err
+	}
+	err = s.checkSession(account.ID)
+	if err != nil {
+		return nil, err
+	}
+	return s.pay(account, amount, category)
+}
+
+// pay makes a payment of an account allowed to pay by the session.
+func (s *Service) pay(account *types.Account, amount types.Money, category types.PaymentCategory) (*types.Payment, error) {
 	payment := &types.Payment{
 		ID:        uuid.New().String(),
-		AccountID: accountID,
+		AccountID: account.ID,
 		Amount:    amount,
 		Category:  category,
 		Status:    types.PaymentStatusInProgress,
+		Created:   s.now().Unix(),
 	}
-	// to do acc
-	account, err := s.FindAccountByID(payment.AccountID)
+	budget, err := s.checkBudget(payment)
+	if err != nil {
+		return nil, err
+	}
+	err = s.assessRisk(payment, account)
 	if err != nil {
 		return nil, err
 	}
 	account.Balance = account.Balance - payment.Amount
 	s.payments = append(s.payments, payment)
+	s.changes.account(account.ID)
+	s.changes.payment(payment.ID)
+	s.record(account, LedgerPayment, -payment.Amount, payment)
+	s.observePayment(payment)
+	s.publish(PaymentCreated{EventMeta: s.eventMeta(account.ID), Payment: *payment, Balance: account.Balance})
+	s.alertBudget(budget, payment)
+	if !inReview(payment) {
+		s.award(account, payment)
+	}
 	return payment, nil
 }
 
-func (s Service) Reject(paymentID string) error {
+func (s *Service) Reject(paymentID string) (err error) {
+	target := s.paymentAuditTarget(paymentID)
+	op := s.beginOperation("Reject", target.accountID, map[string]string{"payment_id": paymentID}, target)
+	defer func() { op.end(err, target) }()
 	payment, err := s.FindPaymentByID(paymentID)
 	if err != nil {
 		return err
 	}
+	if payment.Status == types.PaymentStatusFail {
+		return ErrPaymentAlreadyRejected
+	}
 	account, err := s.FindAccountByID(payment.AccountID)
 	if err != nil {
 		return err
 	}
+	s.refund(account, payment)
+	s.reverseSplit(payment)
+	return nil
+}
+
+// refund rejects the payment and takes back what it earned and moved.
+func (s *Service) refund(account *types.Account, payment *types.Payment) {
 	payment.Status = types.PaymentStatusFail
 	account.Balance += payment.Amount
-	return nil
+	s.changes.account(account.ID)
+	s.changes.payment(payment.ID)
+	s.record(account, LedgerRefund, payment.Amount, payment)
+	s.publish(PaymentRejected{EventMeta: s.eventMeta(account.ID), Payment: *payment, Balance: account.Balance})
+	s.reverseReward(account, payment)
+	s.reverseTransfer(payment)
 }
 
-func (s *Service) Repeat(paymentID string) (*types.Payment, error) {
+// Repeat makes a new payment like the original, which may have been
+// rejected; the status isn't copied.
+func (s *Service) Repeat(paymentID string) (result *types.Payment, err error) {
+	target := s.paymentAuditTarget(paymentID)
+	op := s.beginOperation("Repeat", target.accountID, map[string]string{"payment_id": paymentID}, target)
+	defer func() {
+		after := auditTarget{accountID: target.accountID}
+		if result != nil {
+			after.paymentID = result.ID
+		}
+		op.end(err, after)
+	}()
 	payment, err := s.FindPaymentByID(paymentID)
 	if err != nil {
 		return nil, err
@@ -146,24 +255,65 @@ func (s *Service) Repeat(paymentID string) (*types.Payment, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = s.checkSession(account.ID)
+	if err != nil {
+		return nil, err
+	}
 	var repeatedPayment = types.Payment{
 		ID:        uuid.New().String(),
 		AccountID: payment.AccountID,
 		Amount:    payment.Amount,
 		Category:  payment.Category,
-		Status:    payment.Status,
+		Status:    types.PaymentStatusInProgress,
+		Created:   s.now().Unix(),
+	}
+	budget, err := s.checkBudget(&repeatedPayment)
+	if err != nil {
+		return nil, err
+	}
+	err = s.assessRisk(&repeatedPayment, account)
+	if err != nil {
+		return nil, err
 	}
 	//log.Println("reapetedPayment",repeatedPayment)
 	s.payments = append(s.payments, &repeatedPayment)
 	account.Balance = account.Balance - payment.Amount
+	s.changes.account(account.ID)
+	s.changes.payment(repeatedPayment.ID)
+	s.record(account, LedgerPayment, -repeatedPayment.Amount, &repeatedPayment)
+	s.observePayment(&repeatedPayment)
+	s.publish(PaymentRepeated{
+		EventMeta:  s.eventMeta(account.ID),
+		OriginalID: payment.ID,
+		Payment:    repeatedPayment,
+		Balance:    account.Balance,
+	})
+	s.alertBudget(budget, &repeatedPayment)
+	if !inReview(&repeatedPayment) {
+		s.award(account, &repeatedPayment)
+	}
 	return &repeatedPayment, nil
 }
 
-func (s *Service) FavoritePayment(paymentID string, name string) (*types.Favorite, error) {
+func (s *Service) FavoritePayment(paymentID string, name string) (result *types.Favorite, err error) {
+	target := s.paymentAuditTarget(paymentID)
+	op := s.beginOperation("FavoritePayment", target.accountID,
+		map[string]string{"payment_id": paymentID, "name": name}, auditTarget{paymentID: paymentID})
+	defer func() {
+		after := auditTarget{}
+		if result != nil {
+			after.favoriteID = result.ID
+		}
+		op.end(err, after)
+	}()
 	payment, err := s.FindPaymentByID(paymentID)
 	if err != nil {
 		return nil, ErrPaymentNotFound
 	}
+	err = s.checkSession(payment.AccountID)
+	if err != nil {
+		return nil, err
+	}
 	//log.Print("[")
 	//for _, payment := range s.payments {
 	//	log.Print(*payment)
@@ -178,6 +328,8 @@ func (s *Service) FavoritePayment(paymentID string, name string) (*types.Favorit
 		Category:  payment.Category,
 	}
 	s.favorites = append(s.favorites, &favorite)
+	s.changes.favorite(favorite.ID)
+	s.publish(FavoriteCreated{EventMeta: s.eventMeta(favorite.AccountID), Favorite: favorite})
 	return &favorite, nil
 }
 
@@ -201,50 +353,42 @@ func (s *Service) FindFavoriteByID(favoriteID string) (*types.Favorite, error) {
 }
 
 func (s *Service) ExportToFile(path string) error {
-	file, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if err := file.Close(); err != nil {
-			log.Println(err)
-		}
-	}()
-
+	var buf bytes.Buffer
+	buf.WriteString(dumpHeader + "|")
 	for _, account := range s.accounts {
-		line := strconv.FormatInt(account.ID, 10) + ";" + string(account.Phone) + ";" + strconv.FormatInt(int64(account.Balance), 10) + "|"
-		_, err = file.Write([]byte(line))
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+		line := joinFields([]string{
+			strconv.FormatInt(account.ID, 10),
+			string(account.Phone),
+			strconv.FormatInt(int64(account.Balance), 10),
+		}, ';') + "|"
+		buf.WriteString(line)
+	}
+	return s.writeFile(path, buf.Bytes())
 }
 
-func (s *Service) ImportFromFile(path string) error {
-	file, err := os.Open(path)
+func (s *Service) ImportFromFile(path string) (err error) {
+	op := s.beginOperation("ImportFromFile", 0, map[string]string{"path": path}, auditTarget{counts: true})
+	defer func() { op.end(err, auditTarget{counts: true}) }()
+	accounts, err := s.readFile(path)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if err := file.Close(); err != nil {
-			log.Println(err)
-		}
-	}()
-	accounts, err2 := readAll(file)
-	if err2 != nil {
-		return err2
-	}
-	lines := strings.Split(string(accounts), "|")
-	if len(lines) == 0 {
-		return err
+	content := string(accounts)
+	escaped := strings.HasPrefix(content, dumpHeader+"|")
+	var lines []string
+	if escaped {
+		lines = splitRaw(strings.TrimPrefix(content, dumpHeader+"|"), '|')
+	} else {
+		lines = strings.Split(content, "|")
 	}
 	lines = lines[:len(lines)-1]
-	log.Println(lines)
+	s.log().Debug("importing accounts", "path", path, "records", len(lines))
 	for _, line := range lines {
 
-		fields := strings.Split(line, ";")
-		//log.Println(fields)
+		fields := splitFields(line, ';', escaped)
+		if len(fields) < 3 {
+			return ErrWrongLineFormat
+		}
 		idString := fields[0]
 		id, err := strconv.ParseInt(idString, 10, 64)
 		if err != nil {
@@ -284,299 +428,405 @@ func readAll(reader io.Reader) ([]byte, error) {
 }
 
 func (s *Service) Export(dir string) error {
-	err := exportAccounts(dir, s)
-	if err != nil {
-		return err
-	}
-	err = exportPayments(dir, s)
-	if err != nil {
-		return err
-	}
-	return exportFavorites(dir, s)
+	return s.ExportFormat(dir, FormatDump)
 }
 
-func exportFavorites(dir string, s *Service) error {
-	if len(s.favorites) == 0 {
-		return nil
+func (s *Service) ExportFormat(dir string, format Format) error {
+	return s.ExportWithProgress(context.Background(), dir, format, ProgressOptions{})
+}
+
+// namedTable is a table together with the file name it is exported to.
+// Sidecar tables aren't part of the binary snapshot and are kept next to it
+// as dumps.
+type namedTable struct {
+	name    string
+	table   table
+	sidecar bool
+}
+
+// exportTables lists the collections Export writes, skipping empty ones.
+func (s *Service) exportTables() []namedTable {
+	tables := make([]namedTable, 0, 3)
+	if len(s.accounts) != 0 {
+		tables = append(tables, namedTable{name: "accounts", table: accountsTable(s.accounts)})
 	}
-	var line string
-	for _, favorite := range s.favorites {
-		line += favorite.ID + "|" + strconv.FormatInt(int64(favorite.AccountID), 10) + "|" +
-			favorite.Name + "|" + strconv.FormatInt(int64(favorite.Amount), 10) +
-			"|" + string(favorite.Category) + "\n"
+	if len(s.payments) != 0 {
+		tables = append(tables, namedTable{name: "payments", table: paymentsTable(s.payments)})
 	}
-	err := ioutil.WriteFile(path.Join(dir, "favorites.dump"), []byte(line), 0666)
-	if err != nil {
-		return err
+	if len(s.favorites) != 0 {
+		tables = append(tables, namedTable{name: "favorites", table: favoritesTable(s.favorites)})
 	}
-	return nil
+	if len(s.credentials) != 0 {
+		tables = append(tables, namedTable{name: "credentials", table: credentialsTable(s.credentials), sidecar: true})
+	}
+	if len(s.deposits) != 0 {
+		tables = append(tables, namedTable{name: "deposits", table: depositsTable(s.deposits), sidecar: true})
+	}
+	if len(s.budgets) != 0 {
+		tables = append(tables, namedTable{name: "budgets", table: budgetsTable(s.budgets), sidecar: true})
+	}
+	if len(s.rewards) != 0 {
+		tables = append(tables, namedTable{name: "rewards", table: rewardsTable(s.rewards), sidecar: true})
+	}
+	if len(s.accruals) != 0 {
+		tables = append(tables, namedTable{name: "interest", table: interestTable(s.accruals), sidecar: true})
+	}
+	if len(s.splits) != 0 {
+		tables = append(tables, namedTable{name: "splits", table: splitsTable(s.splits), sidecar: true})
+	}
+	if len(s.paymentRequests) != 0 {
+		tables = append(tables, namedTable{name: "payment_requests", table: paymentRequestsTable(s.paymentRequests),
+			sidecar: true})
+	}
+	if len(s.ledger) != 0 {
+		tables = append(tables, namedTable{name: "ledger", table: ledgerTable(s.ledger), sidecar: true})
+	}
+	return tables
 }
 
-func exportPayments(dir string, s *Service) error {
-	if len(s.payments) == 0 {
-		return nil
+func favoritesTable(favorites []*types.Favorite) table {
+	return table{
+		columns: favoriteColumns,
+		rows:    len(favorites),
+		fields:  func(row int) []string { return favoriteFields(favorites[row]) },
+		value:   func(row int) interface{} { return favorites[row] },
 	}
-	var line string
-	for _, payment := range s.payments {
-		line = creatingLine(line, payment)
+}
+
+func favoriteFields(favorite *types.Favorite) []string {
+	return []string{
+		favorite.ID,
+		strconv.FormatInt(favorite.AccountID, 10),
+		favorite.Name,
+		strconv.FormatInt(int64(favorite.Amount), 10),
+		string(favorite.Category),
 	}
-	err := ioutil.WriteFile(path.Join(dir, "payments.dump"), []byte(line), 0666)
-	if err != nil {
-		return err
+}
+
+func paymentsTable(payments []*types.Payment) table {
+	return table{
+		columns: paymentColumns,
+		rows:    len(payments),
+		fields:  func(row int) []string { return paymentFields(payments[row]) },
+		value:   func(row int) interface{} { return payments[row] },
 	}
-	return nil
 }
 
 func creatingLine(line string, payment *types.Payment) string {
-	line += payment.ID + "|" + strconv.FormatInt(payment.AccountID, 10) + "|" +
-		strconv.FormatInt(int64(payment.Amount), 10) + "|" + string(payment.Category) + "|" +
-		string(payment.Status) + "\n"
+	line += joinFields(paymentFields(payment), '|') + "\n"
 	return line
 }
 
-func exportAccounts(dir string, s *Service) error {
-	if len(s.accounts) == 0 {
-		return nil
+func paymentFields(payment *types.Payment) []string {
+	return []string{
+		payment.ID,
+		strconv.FormatInt(payment.AccountID, 10),
+		strconv.FormatInt(int64(payment.Amount), 10),
+		string(payment.Category),
+		string(payment.Status),
+		strconv.FormatInt(payment.Created, 10),
+		strings.Join(payment.RiskHits, ","),
 	}
-	var line string
-	for _, account := range s.accounts {
-		line += strconv.FormatInt(account.ID, 10) + "|" + string(account.Phone) +
-			"|" + strconv.FormatInt(int64(account.Balance), 10) + "\n"
+}
+
+func accountsTable(accounts []*types.Account) table {
+	return table{
+		columns: accountColumns,
+		rows:    len(accounts),
+		fields:  func(row int) []string { return accountFields(accounts[row]) },
+		value:   func(row int) interface{} { return accounts[row] },
 	}
+}
 
-	err := ioutil.WriteFile(path.Join(dir, "accounts.dump"), []byte(line), 0666)
-	if err != nil {
-		return err
+func accountFields(account *types.Account) []string {
+	return []string{
+		strconv.FormatInt(account.ID, 10),
+		string(account.Phone),
+		strconv.FormatInt(int64(account.Balance), 10),
 	}
-	return nil
 }
 
 func (s *Service) Import(dir string) error {
-	err := s.ImportAccounts(dir)
-	if err != nil {
-		return err
-	}
-	err = s.ImportPayments(dir)
-	if err != nil {
-		return err
-	}
-	err = s.ImportFavorites(dir)
-	if err != nil {
-		return err
-	}
-	return nil
+	return s.ImportFormat(dir, FormatDump)
 }
 
-func (s *Service) ImportAccounts(dir string) error {
-	fileAccounts, err := os.Open(path.Join(dir, "accounts.dump"))
-	if err != nil {
-		return nil
+func (s *Service) ImportFormat(dir string, format Format) error {
+	return s.ImportWithProgress(context.Background(), dir, format, ProgressOptions{})
+}
+
+// importTable is a file Import reads together with the handler of its rows.
+// A missing optional file isn't counted as a part of the import. Optional
+// tables are the sidecars of a binary snapshot. optionalColumns may be
+// missing from the header of a file written before they were added.
+type importTable struct {
+	name            string
+	columns         []string
+	optionalColumns []string
+	record          func(fields []string, data []byte) error
+	optional        bool
+}
+
+func (s *Service) importTables(index *importIndex) []importTable {
+	return []importTable{
+		{name: "accounts", columns: accountColumns, record: s.accountRecord(index)},
+		{name: "payments", columns: paymentColumns, optionalColumns: paymentOptionalColumns,
+			record: s.paymentRecord(index)},
+		{name: "favorites", columns: favoriteColumns, record: s.favoriteRecord(index)},
+		{name: "credentials", columns: credentialColumns, record: s.credentialRecord(index), optional: true},
+		{name: "deposits", columns: depositColumns, record: s.depositRecord(index), optional: true},
+		{name: "budgets", columns: budgetColumns, record: s.budgetRecord(index), optional: true},
+		{name: "rewards", columns: rewardColumns, record: s.rewardRecord(index), optional: true},
+		{name: "interest", columns: interestColumns, record: s.interestRecord(index), optional: true},
+		{name: "splits", columns: splitColumns, record: s.splitRecord(index), optional: true},
+		{name: "payment_requests", columns: paymentRequestColumns, record: s.paymentRequestRecord(index),
+			optional: true},
+		{name: "ledger", columns: ledgerColumns, optionalColumns: ledgerOptionalColumns,
+			record: s.ledgerRecord(index), optional: true},
 	}
-	defer func() {
-		if err2 := fileAccounts.Close(); err2 != nil {
-			log.Println(err2)
-		}
-	}()
-	reader := bufio.NewReader(fileAccounts)
-	var lines = make([]string, 0)
-	for {
-		line, err := reader.ReadString('\n')
-		if err == io.EOF {
-			break
-		}
+}
+
+func (s *Service) ImportAccounts(dir string) (err error) {
+	op := s.beginOperation("ImportAccounts", 0, map[string]string{"dir": dir}, auditTarget{counts: true})
+	defer func() { op.end(err, auditTarget{counts: true}) }()
+	return s.readTable(path.Join(dir, "accounts"+FormatDump.extension()), FormatDump, accountColumns, nil,
+		s.accountRecord(s.newImportIndex()))
+}
+
+func (s *Service) accountRecord(index *importIndex) func(fields []string, data []byte) error {
+	return func(fields []string, data []byte) error {
+		accFromFile := &types.Account{}
+		err := decodeRecord(fields, data, accFromFile, parseAccountFields)
 		if err != nil {
-			return err
+			s.log().Warn("skipped wrong record", "table", "accounts", "error", err)
+			return nil
 		}
-		//log.Println("line:", line)
-		line = line[:len(line)-len("\n")]
-		lines = append(lines, line)
-		//log.Println("lines:", lines)
+		s.upsertAccount(index, accFromFile)
+		return nil
 	}
-	for _, line := range lines {
-		accFromFile, err := parseAccountLine(line)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-		log.Println("accfromfile:", accFromFile)
-		if index := s.accountExists(accFromFile.ID); index != 0 { // update
-			s.accounts[index] = accFromFile
-			continue
-		}
-		s.accounts = append(s.accounts, accFromFile) // add
-		s.nextAccountID++
+}
+
+// importIndex maps IDs to positions in the service collections, so imports
+// of large dumps don't scan the collections for every record.
+type importIndex struct {
+	accounts    map[int64]int
+	payments    map[string]int
+	favorites   map[string]int
+	credentials map[int64]int
+	ledger      map[int64]int
+	deposits    map[string]int
+	budgets     map[string]int
+	rewards     map[string]int
+	accruals    map[int64]int
+	splits      map[string]int
+
+	paymentRequests map[string]int
+}
+
+func (s *Service) newImportIndex() *importIndex {
+	index := &importIndex{
+		accounts:  make(map[int64]int, len(s.accounts)),
+		payments:  make(map[string]int, len(s.payments)),
+		favorites: make(map[string]int, len(s.favorites)),
+
+		credentials: make(map[int64]int, len(s.credentials)),
+		ledger:      make(map[int64]int, len(s.ledger)),
+		deposits:    make(map[string]int, len(s.deposits)),
+		budgets:     make(map[string]int, len(s.budgets)),
+		rewards:     make(map[string]int, len(s.rewards)),
+		accruals:    make(map[int64]int, len(s.accruals)),
+		splits:      make(map[string]int, len(s.splits)),
+
+		paymentRequests: make(map[string]int, len(s.paymentRequests)),
 	}
-	return nil
+	for i, account := range s.accounts {
+		index.accounts[account.ID] = i
+	}
+	for i, payment := range s.payments {
+		index.payments[payment.ID] = i
+	}
+	for i, favorite := range s.favorites {
+		index.favorites[favorite.ID] = i
+	}
+	for i, c := range s.credentials {
+		index.credentials[c.AccountID] = i
+	}
+	for i, entry := range s.ledger {
+		index.ledger[entry.ID] = i
+	}
+	for i, deposit := range s.deposits {
+		index.deposits[deposit.ID] = i
+	}
+	for i, budget := range s.budgets {
+		index.budgets[budgetKey(budget.AccountID, budget.Category)] = i
+	}
+	for i, reward := range s.rewards {
+		index.rewards[reward.ID] = i
+	}
+	for i, accrual := range s.accruals {
+		index.accruals[accrual.AccountID] = i
+	}
+	for i, split := range s.splits {
+		index.splits[split.ID] = i
+	}
+	for i, request := range s.paymentRequests {
+		index.paymentRequests[request.ID] = i
+	}
+	return index
 }
 
-func parseAccountLine(line string) (*types.Account, error) {
-	fields := strings.Split(line, "|")
+func (s *Service) upsertAccount(index *importIndex, account *types.Account) {
+	s.changes.account(account.ID)
+	if i, ok := index.accounts[account.ID]; ok { // update
+		s.accounts[i] = account
+		return
+	}
+	index.accounts[account.ID] = len(s.accounts)
+	s.accounts = append(s.accounts, account) // add
+	if account.ID > s.nextAccountID {
+		s.nextAccountID = account.ID
+	}
+}
+
+func parseAccountFields(fields []string, value interface{}) error {
 	if len(fields) < 3 {
-		return nil, errors.New("wrong line format")
+		return ErrWrongLineFormat
 	}
 	id, err := strconv.ParseInt(fields[0], 10, 64)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	balance, err := strconv.ParseInt(fields[2], 10, 64)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &types.Account{
+	*value.(*types.Account) = types.Account{
 		ID:      id,
 		Phone:   types.Phone(fields[1]),
 		Balance: types.Money(balance),
-	}, nil
+	}
+	return nil
 }
 
-func (s *Service) accountExists(id int64) int {
-	for index, account := range s.accounts {
-		if account.ID == id {
-			return index
-		}
-	}
-	return 0
+func (s *Service) ImportPayments(dir string) (err error) {
+	op := s.beginOperation("ImportPayments", 0, map[string]string{"dir": dir}, auditTarget{counts: true})
+	defer func() { op.end(err, auditTarget{counts: true}) }()
+	return s.readTable(path.Join(dir, "payments"+FormatDump.extension()), FormatDump, paymentColumns,
+		paymentOptionalColumns, s.paymentRecord(s.newImportIndex()))
 }
 
-func (s *Service) ImportPayments(dir string) error {
-	filePayments, err := os.Open(path.Join(dir, "payments.dump"))
-	if err != nil {
-		return nil
-	}
-	defer func() {
-		if err2 := filePayments.Close(); err2 != nil {
-			log.Println(err2)
-		}
-	}()
-	reader := bufio.NewReader(filePayments)
-	var lines = make([]string, 0)
-	for {
-		line, err := reader.ReadString('\n')
-		if err == io.EOF {
-			break
-		}
+func (s *Service) paymentRecord(index *importIndex) func(fields []string, data []byte) error {
+	return func(fields []string, data []byte) error {
+		paymentFromFile := &types.Payment{}
+		err := decodeRecord(fields, data, paymentFromFile, parsePaymentFields)
 		if err != nil {
-			return err
+			s.log().Warn("skipped wrong record", "table", "payments", "error", err)
+			return nil
 		}
-		//log.Println("line:", line)
-		line = line[:len(line)-len("\n")]
-		lines = append(lines, line)
-		//log.Println("lines:", lines)
-	}
-	for _, line := range lines {
-		paymentFromFile, err := parsePaymentLine(line)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-		if index := s.paymentExists(paymentFromFile.ID); index != 0 {
-			s.payments[index] = paymentFromFile
-			continue
-		}
-		s.payments = append(s.payments, paymentFromFile)
+		s.upsertPayment(index, paymentFromFile)
+		return nil
 	}
-	return nil
 }
 
-func parsePaymentLine(line string) (*types.Payment, error) {
-	fields := strings.Split(line, "|")
-	//log.Println("fields:", fields)
+func (s *Service) upsertPayment(index *importIndex, payment *types.Payment) {
+	s.changes.payment(payment.ID)
+	if i, ok := index.payments[payment.ID]; ok {
+		s.payments[i] = payment
+		return
+	}
+	index.payments[payment.ID] = len(s.payments)
+	s.payments = append(s.payments, payment)
+}
 
+func parsePaymentFields(fields []string, value interface{}) error {
+	if len(fields) < 5 {
+		return ErrWrongLineFormat
+	}
 	accountID, err := strconv.ParseInt(fields[1], 10, 64)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	amount, err := strconv.ParseInt(fields[2], 10, 64)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	// Dumps made before payments had a time have five fields.
+	created := int64(0)
+	if len(fields) > 5 && fields[5] != "" {
+		created, err = strconv.ParseInt(fields[5], 10, 64)
+		if err != nil {
+			return err
+		}
+	}
+	var riskHits []string
+	if len(fields) > 6 && fields[6] != "" {
+		riskHits = strings.Split(fields[6], ",")
 	}
-	return &types.Payment{
+	*value.(*types.Payment) = types.Payment{
 		ID:        fields[0],
 		AccountID: accountID,
 		Amount:    types.Money(amount),
 		Category:  types.PaymentCategory(fields[3]),
 		Status:    types.PaymentStatus(fields[4]),
-	}, nil
-}
-func (s *Service) paymentExists(id string) int {
-	for index, payment := range s.payments {
-		if payment.ID == id {
-			return index
-		}
+		Created:   created,
+		RiskHits:  riskHits,
 	}
-	return 0
+	return nil
 }
 
-func (s *Service) ImportFavorites(dir string) error {
-	fileFavorites, err := os.Open(path.Join(dir, "favorites.dump"))
-	if err != nil {
-		return nil
-	}
-	defer func() {
-		if err2 := fileFavorites.Close(); err2 != nil {
-			log.Println(err2)
-		}
-	}()
-	reader := bufio.NewReader(fileFavorites)
-	var lines = make([]string, 0)
-	for {
-		line, err := reader.ReadString('\n')
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
-		//log.Println("line:", line)
-		line = line[:len(line)-len("\n")]
-		lines = append(lines, line)
-		//log.Println("lines:", lines)
-	}
-	for _, line := range lines {
-		favoriteFromFile, err := parseFavoriteLine(line)
+func (s *Service) ImportFavorites(dir string) (err error) {
+	op := s.beginOperation("ImportFavorites", 0, map[string]string{"dir": dir}, auditTarget{counts: true})
+	defer func() { op.end(err, auditTarget{counts: true}) }()
+	return s.readTable(path.Join(dir, "favorites"+FormatDump.extension()), FormatDump, favoriteColumns, nil,
+		s.favoriteRecord(s.newImportIndex()))
+}
+
+func (s *Service) favoriteRecord(index *importIndex) func(fields []string, data []byte) error {
+	return func(fields []string, data []byte) error {
+		favoriteFromFile := &types.Favorite{}
+		err := decodeRecord(fields, data, favoriteFromFile, parseFavoriteFields)
 		if err != nil {
-			log.Println(err)
-			continue
-		}
-		if index := s.favoriteExists(favoriteFromFile.ID); index != 0 {
-			s.favorites[index] = favoriteFromFile
-			continue
+			s.log().Warn("skipped wrong record", "table", "favorites", "error", err)
+			return nil
 		}
-		s.favorites = append(s.favorites, favoriteFromFile)
+		s.upsertFavorite(index, favoriteFromFile)
+		return nil
 	}
-	return nil
+}
 
+func (s *Service) upsertFavorite(index *importIndex, favorite *types.Favorite) {
+	s.changes.favorite(favorite.ID)
+	if i, ok := index.favorites[favorite.ID]; ok {
+		s.favorites[i] = favorite
+		return
+	}
+	index.favorites[favorite.ID] = len(s.favorites)
+	s.favorites = append(s.favorites, favorite)
 }
 
-func parseFavoriteLine(line string) (*types.Favorite, error) {
-	fields := strings.Split(line, "|")
-	//log.Println("fields fav:", fields)
+func parseFavoriteFields(fields []string, value interface{}) error {
+	if len(fields) < 5 {
+		return ErrWrongLineFormat
+	}
 	accountID, err := strconv.ParseInt(fields[1], 10, 64)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	amount, err := strconv.ParseInt(fields[3], 10, 64)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &types.Favorite{
+	*value.(*types.Favorite) = types.Favorite{
 		ID:        fields[0],
 		AccountID: accountID,
 		Name:      fields[2],
 		Amount:    types.Money(amount),
 		Category:  types.PaymentCategory(fields[4]),
-	}, nil
-}
-
-func (s *Service) favoriteExists(id string) int {
-	for index, favorite := range s.favorites {
-		if favorite.ID == id {
-			return index
-		}
 	}
-	return 0
+	return nil
 }
 
+// ExportAccountHistory returns the payments of the account, its deposits are
+// in ExportAccountTransactions.
 func (s *Service) ExportAccountHistory(accountID int64) ([]types.Payment, error) {
 	account, err := s.FindAccountByID(accountID)
 	if err != nil {
@@ -592,22 +842,36 @@ func (s *Service) ExportAccountHistory(accountID int64) ([]types.Payment, error)
 }
 
 func (s *Service) HistoryToFiles(payments []types.Payment, dir string, records int) error {
+	return s.HistoryToFilesFormat(payments, dir, records, FormatDump)
+}
+
+func (s *Service) HistoryToFilesFormat(payments []types.Payment, dir string, records int, format Format) error {
+	return s.HistoryToFilesWithProgress(context.Background(), payments, dir, records, format, ProgressOptions{})
+}
+
+// HistoryToFilesWithProgress writes payments in files of at most records
+// payments and reports every written file as a part.
+func (s *Service) HistoryToFilesWithProgress(ctx context.Context, payments []types.Payment, dir string, records int,
+	format Format, options ProgressOptions,
+) error {
 	if len(payments) == 0 {
 		return nil
 	}
-	//log.Println("payments:", payments, "dir:", dir)
-	//log.Println("len paymens:", len(payments), "records:", records)
+	history := make([]*types.Payment, len(payments))
+	for i := range payments {
+		history[i] = &payments[i]
+	}
 	if len(payments) <= records {
-		var line string
-		for _, payment := range payments {
-			line = creatingLine(line, &payment)
+		report := newProgressReporter(options.Report, 1, len(payments), 0)
+		if err := ctx.Err(); err != nil {
+			return err
 		}
-		log.Println("line", line)
-		filename := "payments.dump"
-		err := ioutil.WriteFile(path.Join(dir, filename), []byte(line), 0666)
+		filename := "payments" + format.extension()
+		n, err := s.writeTable(path.Join(dir, filename), format, paymentsTable(history))
 		if err != nil {
 			return err
 		}
+		report.part(0, len(payments), int64(n), 0)
 		return nil
 	}
 
@@ -616,266 +880,174 @@ func (s *Service) HistoryToFiles(payments []types.Payment, dir string, records i
 		fileN++
 	}
 
-	for numberFile := 1; numberFile <= fileN-1; numberFile++ {
-		var line string
-		for i := 0; i < records; i++ {
-			line = creatingLine(line, &payments[i])
+	report := newProgressReporter(options.Report, fileN, len(payments), 0)
+	for numberFile := 1; numberFile <= fileN; numberFile++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		size := records
+		if size > len(history) {
+			size = len(history)
 		}
-		payments = payments[records:]
-		//log.Println("line2:", line)
-		filename := "payments" + strconv.Itoa(numberFile) + ".dump"
-		//log.Println("filename:", filename)
-		err := ioutil.WriteFile(path.Join(dir, filename), []byte(line), 0666)
+		filename := "payments" + strconv.Itoa(numberFile) + format.extension()
+		n, err := s.writeTable(path.Join(dir, filename), format, paymentsTable(history[:size]))
 		if err != nil {
 			return err
 		}
-	}
-
-	line := ""
-	for _, payment := range payments {
-		line = creatingLine(line, &payment)
-	}
-	//log.Println("line2:", line)
-	filename := "payments" + strconv.Itoa(fileN) + ".dump"
-	//log.Println("filename:", filename)
-	err := ioutil.WriteFile(path.Join(dir, filename), []byte(line), 0666)
-	if err != nil {
-		return err
+		report.part(numberFile-1, size, int64(n), 0)
+		history = history[size:]
 	}
 	return nil
 }
 
-func (s Service) SumPayments(goroutines int) types.Money {
-	if goroutines == 0 || goroutines == 1 {
-		amount := types.Money(0)
-		for _, payment := range s.payments {
-			amount += payment.Amount
-		}
-		return amount
-	}
-	if goroutines > len(s.payments) {
-		goroutines = len(s.payments) / 5
-	}
-	howMuchCut := len(s.payments) / goroutines
-	lost := len(s.payments) % goroutines
-	if lost != 0 {
-		howMuchCut++
-	}
-
-	var mutex sync.Mutex
-	amount := types.Money(0)
-
-	var wg sync.WaitGroup
-	wg.Add(goroutines)
-	for i := 0; i < goroutines; i++ {
-		cutedPayments := make([]*types.Payment, 0)
-		if howMuchCut > len(s.payments) {
-			howMuchCut = len(s.payments)
-		}
-		ss := s.payments[:howMuchCut]
-		for _, payment := range ss {
-			cutedPayments = append(cutedPayments, payment)
-		}
-		go func([]*types.Payment) {
-			defer wg.Done()
-			val := types.Money(0)
-			for _, payment := range cutedPayments {
-				val += payment.Amount
-			}
-			mutex.Lock()
-			amount += val
-			mutex.Unlock()
-		}(cutedPayments)
-
-		s.payments = s.payments[howMuchCut:]
-	}
-	wg.Wait()
+func (s *Service) SumPayments(goroutines int) types.Money {
+	amount, _ := s.SumPaymentsContext(context.Background(), goroutines)
 	return amount
 }
 
-func (s Service) FilterPayments(accountID int64, goroutines int) ([]types.Payment, error) {
-
-	//log.Println(s.payments)
-	//log.Println(accountID, goroutines)
-	exists := s.accountExists(accountID)
-	if exists == 0 {
-		return nil, ErrAccountNotFound
-	}
-	filteredPayments := make([]types.Payment, 0)
-
-	if goroutines == 0 || goroutines == 1 {
-		for _, payment := range s.payments {
-			if payment.AccountID == accountID {
-				filteredPayments = append(filteredPayments, *payment)
+func (s *Service) SumPaymentsContext(ctx context.Context, goroutines int) (types.Money, error) {
+	size := partSizeFor(len(s.payments), goroutines)
+	sums := make([]types.Money, scanParts(len(s.payments), size))
+	err := scanPayments(ctx, s.payments, goroutines, size,
+		func(part int, payments []*types.Payment) error {
+			for _, payment := range payments {
+				sums[part] += payment.Amount
 			}
-		}
-		if len(filteredPayments) == 0 {
-			return nil, ErrPaymentNotFound
-		}
-		return filteredPayments, nil
-	}
-
-	if goroutines > len(s.payments) {
-		goroutines = 2
+			return nil
+		})
+	if err != nil {
+		return 0, err
 	}
-
-	howMuchCut := len(s.payments) / goroutines
-	lost := len(s.payments) % goroutines
-	if lost != 0 {
-		howMuchCut++
+	amount := types.Money(0)
+	for _, sum := range sums {
+		amount += sum
 	}
+	return amount, nil
+}
 
-	var mu sync.Mutex
-	var wg sync.WaitGroup
-	wg.Add(goroutines)
-	for i := 0; i < goroutines; i++ {
-		cutedPayments := make([]types.Payment, 0)
-		if len(s.payments) < howMuchCut {
-			howMuchCut = len(s.payments)
-		}
-		cut := s.payments[:howMuchCut]
-		for _, payment := range cut {
-			cutedPayments = append(cutedPayments, *payment)
-		}
-		go func(cp []types.Payment) {
-			defer wg.Done()
-			filter := make([]types.Payment, 0)
-			for _, payment := range cp {
-				if payment.AccountID == accountID {
-					filter = append(filter, payment)
-				}
-			}
-			mu.Lock()
-			for _, payment := range filter {
-				filteredPayments = append(filteredPayments, payment)
-			}
-			mu.Unlock()
+func (s *Service) FilterPayments(accountID int64, goroutines int) ([]types.Payment, error) {
+	return s.FilterPaymentsContext(context.Background(), accountID, goroutines)
+}
 
-		}(cutedPayments)
-		s.payments = s.payments[howMuchCut:]
-	}
-	wg.Wait()
-	if len(filteredPayments) == 0 {
-		return nil, ErrPaymentNotFound
+func (s *Service) FilterPaymentsContext(ctx context.Context, accountID int64, goroutines int) ([]types.Payment, error) {
+	_, err := s.FindAccountByID(accountID)
+	if err != nil {
+		return nil, err
 	}
-	return filteredPayments, nil
+	return s.FilterPaymentsByFnContext(ctx, func(payment types.Payment) bool {
+		return payment.AccountID == accountID
+	}, goroutines)
 }
 
-func (s Service) FilterPaymentsByFn(filter func(payment types.Payment) bool,
+func (s *Service) FilterPaymentsByFn(filter func(payment types.Payment) bool,
 	goroutines int,
 ) ([]types.Payment, error) {
+	return s.FilterPaymentsByFnContext(context.Background(), filter, goroutines)
+}
 
-	//log.Println(s.payments)
-	filteredPayments := make([]types.Payment, 0)
-
-	if goroutines == 0 || goroutines == 1 {
-		for _, payment := range s.payments {
-			if filter(*payment) {
-				filteredPayments = append(filteredPayments, *payment)
-			}
-		}
-		if len(filteredPayments) == 0 {
-			return nil, ErrPaymentNotFound
-		}
-		return filteredPayments, nil
-	}
+// FilterPaymentsByFnContext returns the payments matching filter in the order
+// they were made, however many goroutines scan them.
+func (s *Service) FilterPaymentsByFnContext(ctx context.Context, filter func(payment types.Payment) bool,
+	goroutines int,
+) ([]types.Payment, error) {
+	return s.FilterPaymentsByFnWithProgress(ctx, filter, goroutines, ProgressOptions{})
+}
 
-	if goroutines > len(s.payments) {
-		goroutines = 2
+func (s *Service) FilterPaymentsByFnWithProgress(ctx context.Context, filter func(payment types.Payment) bool,
+	goroutines int, options ProgressOptions,
+) ([]types.Payment, error) {
+	filteredPayments, err := s.filterPayments(ctx, filter, goroutines, options)
+	if err != nil {
+		return nil, err
 	}
-
-	howMuchCut := len(s.payments) / goroutines
-	lost := len(s.payments) % goroutines
-	if lost != 0 {
-		howMuchCut++
+	if len(filteredPayments) == 0 {
+		return nil, ErrPaymentNotFound
 	}
+	return filteredPayments, nil
+}
 
-	var mu sync.Mutex
-	var wg sync.WaitGroup
-	wg.Add(goroutines)
-	for i := 0; i < goroutines; i++ {
-		cutedPayments := make([]types.Payment, 0)
-		if len(s.payments) < howMuchCut {
-			howMuchCut = len(s.payments)
-		}
-		cut := s.payments[:howMuchCut]
-		for _, payment := range cut {
-			cutedPayments = append(cutedPayments, *payment)
-		}
-		go func(cp []types.Payment) {
-			defer wg.Done()
-			filtered := make([]types.Payment, 0)
-			for _, payment := range cp {
-				if filter(payment) {
-					filtered = append(filtered, payment)
+func (s *Service) filterPayments(ctx context.Context, filter func(payment types.Payment) bool,
+	goroutines int, options ProgressOptions,
+) ([]types.Payment, error) {
+	size := options.partSize(len(s.payments), goroutines)
+	parts := make([][]types.Payment, scanParts(len(s.payments), size))
+	report := newProgressReporter(options.Report, len(parts), len(s.payments), 0)
+	err := scanPayments(ctx, s.payments, goroutines, size,
+		func(part int, payments []*types.Payment) error {
+			for _, payment := range payments {
+				if filter(*payment) {
+					parts[part] = append(parts[part], *payment)
 				}
 			}
-			mu.Lock()
-			for _, payment := range filtered {
-				filteredPayments = append(filteredPayments, payment)
-			}
-			mu.Unlock()
-
-		}(cutedPayments)
-		s.payments = s.payments[howMuchCut:]
+			report.part(part, len(payments), 0, 0)
+			return nil
+		})
+	if err != nil {
+		return nil, err
 	}
-	wg.Wait()
-	if len(filteredPayments) == 0 {
-		return nil, ErrPaymentNotFound
+	filteredPayments := make([]types.Payment, 0)
+	for _, part := range parts {
+		filteredPayments = append(filteredPayments, part...)
 	}
 	return filteredPayments, nil
 }
 
+// Progress describes how far a long-running operation got. Parts are
+// reported as they finish, so Part isn't increasing when goroutines scan in
+// parallel, while Done, Records and Bytes are.
 type Progress struct {
-	Part   int
+	// Part is the index of the part that has just finished.
+	Part int
+	// Parts is the number of parts of the whole operation.
+	Parts int
+	// Done is the number of parts finished so far.
+	Done int
+	// Records is the number of records processed so far, TotalRecords is zero
+	// when the operation can't know it up front.
+	Records      int
+	TotalRecords int
+	// Bytes read or written so far by file operations, TotalBytes is zero
+	// when unknown.
+	Bytes      int64
+	TotalBytes int64
+	// Result is the sum of the part for SumPaymentsWithProgress.
 	Result types.Money
 }
 
-func (s Service) SumPaymentsWithProgress() <-chan Progress {
-	if len(s.payments) == 0 {
-		ch := make(chan Progress, 1)
-		close(ch)
-		return ch
-	}
-	size := 100_000
-	if size > len(s.payments) {
-		size = len(s.payments)
-	}
-	part := len(s.payments) / size
-	if len(s.payments)%size != 0 {
-		part += 1
-	}
-	if part <= 0 {
-		part = 1
-	}
+func (s *Service) SumPaymentsWithProgress() <-chan Progress {
+	return s.SumPaymentsWithProgressContext(context.Background(), ProgressOptions{})
+}
 
+// SumPaymentsWithProgressContext sends the sum of every part to the returned
+// channel, which is closed once all parts are done or ctx is canceled.
+func (s *Service) SumPaymentsWithProgressContext(ctx context.Context, options ProgressOptions) <-chan Progress {
+	payments := s.payments
+	size := options.PartSize
+	if size <= 0 {
+		size = defaultPartSize
+	}
 	ch := make(chan Progress, 1)
-	var wg sync.WaitGroup
-	wg.Add(part)
-
-	for i := 0; i < part; i++ {
-		i := i
-		go func(payments []*types.Payment) {
-			defer wg.Done()
-			var amount types.Money
-
-			for _, payment := range payments {
-				amount += payment.Amount
-			}
-			ch <- Progress{
-				Part:   i,
-				Result: amount,
-			}
-		}(s.payments[:size])
-
-		s.payments = s.payments[size:]
-		if size > len(s.payments) {
-			size = len(s.payments)
+	report := newProgressReporter(func(progress Progress) {
+		if options.Report != nil {
+			options.Report(progress)
 		}
-	}
+		select {
+		case ch <- progress:
+		case <-ctx.Done():
+		}
+	}, scanParts(len(payments), size), len(payments), 0)
+
 	go func() {
-		wg.Wait()
-		close(ch)
+		defer close(ch)
+		_ = scanPayments(ctx, payments, runtime.GOMAXPROCS(0), size,
+			func(part int, payments []*types.Payment) error {
+				var amount types.Money
+				for _, payment := range payments {
+					amount += payment.Amount
+				}
+				report.part(part, len(payments), 0, amount)
+				return nil
+			})
 	}()
 	return ch
 }
@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestService_FindAccountByID(t *testing.T) {
@@ -273,17 +274,83 @@ func TestService_FindPaymentByID_faill(t *testing.T) {
 
 type testService struct {
 	*Service
+	// clock is the time of the service when it was made withClock, tests
+	// move it forward.
+	clock *time.Time
 }
 
-func newTestService() *testService {
-	return &testService{Service: &Service{}}
+type testOption func(s *testService)
+
+func newTestService(options ...testOption) *testService {
+	s := &testService{Service: &Service{}}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+func withClock(now time.Time) testOption {
+	return func(s *testService) {
+		s.clock = &now
+		s.SetClock(func() time.Time { return *s.clock })
+	}
+}
+
+func withKeys(keys KeyProvider) testOption {
+	return func(s *testService) {
+		s.SetKeyProvider(keys)
+	}
+}
+
+func withAuditLog(auditLog *AuditLog) testOption {
+	return func(s *testService) {
+		s.SetAuditLog(auditLog)
+	}
+}
+
+func withRiskEngine(engine *RiskEngine) testOption {
+	return func(s *testService) {
+		s.SetRiskEngine(engine)
+	}
+}
+
+func withAMLMonitor(monitor *AMLMonitor) testOption {
+	return func(s *testService) {
+		monitor.Attach(s.Service)
+	}
+}
+
+func withRewards(program *RewardsProgram) testOption {
+	return func(s *testService) {
+		s.SetRewardsProgram(program)
+	}
+}
+
+func withInterest(config InterestConfig) testOption {
+	return func(s *testService) {
+		s.SetInterest(&config)
+	}
 }
 
+// addAccounts registers an account with balance for each phone.
+func (s *testService) addAccounts(t *testing.T, balance types.Money, phones ...types.Phone) {
+	t.Helper()
+	for _, phone := range phones {
+		if _, err := s.addAccountWithBalance(phone, balance); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// addAccountWithBalance leaves the account empty for a zero balance.
 func (s *testService) addAccountWithBalance(phone types.Phone, balance types.Money) (*types.Account, error) {
 	account, err := s.RegisterAccount(phone)
 	if err != nil {
 		return nil, fmt.Errorf("cant register acoount , error := %v ", err)
 	}
+	if balance == 0 {
+		return account, nil
+	}
 
 	err = s.Deposit(account.ID, balance)
 	if err != nil {
@@ -386,6 +453,34 @@ func TestService_Repeat_success(t *testing.T) {
 	log.Println(*payment, *repeatedPayment)
 }
 
+func TestService_Repeat_rejected(t *testing.T) {
+	s := newTestService()
+	_, payments, err := s.addAccount(defaultAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reject(payments[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	repeated, err := s.Repeat(payments[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repeated.Status != types.PaymentStatusInProgress {
+		t.Errorf("invalid status: %v", repeated.Status)
+	}
+	if err := s.Reject(repeated.ID); err != nil {
+		t.Errorf("repeated payment can't be refunded: %v", err)
+	}
+	account, err := s.FindAccountByID(repeated.AccountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance != defaultAccount.balance {
+		t.Errorf("invalid balance: %v", account.Balance)
+	}
+}
+
 func TestService_Repeat_fail(t *testing.T) {
 	s := newTestService()
 
@@ -498,7 +593,7 @@ func Test_creatingLine(t *testing.T) {
 		Status:    "s",
 	}
 	got := creatingLine(line, a)
-	want := "a|2|200|b|s\n"
+	want := "a|2|200|b|s|0|\n"
 	if got != want {
 		t.Fatal(got, want)
 	}
@@ -0,0 +1,335 @@
+package wallet
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"io"
+	"math"
+	"os"
+	"path"
+)
+
+var ErrWrongSnapshot = errors.New("wrong snapshot")
+var ErrUnsupportedSnapshotVersion = errors.New("unsupported snapshot version")
+var ErrSnapshotStringTooLong = errors.New("string too long for snapshot")
+
+// Snapshot layout: magic, version, flags, then the (optionally DEFLATE
+// compressed) body with accounts, payments and favorites, each prefixed by
+// its count. Integers are varints, strings are length prefixed. Version 2
+// added payment times and version 3 risk hits, older snapshots are still
+// read.
+const snapshotMagic = "WLTS"
+const snapshotVersion = 3
+const snapshotFlagCompressed = 1
+
+const maxSnapshotString = 1 << 20
+
+// Payment and favorite IDs are usually UUIDs, which take 16 bytes instead of 36.
+const (
+	snapshotIDString byte = iota
+	snapshotIDUUID
+)
+
+func exportSnapshot(dir string, s *Service, format Format) (int, error) {
+	var buf bytes.Buffer
+	err := writeSnapshot(&buf, s, format == FormatBinaryCompressed)
+	if err != nil {
+		return 0, err
+	}
+	return buf.Len(), s.writeFile(path.Join(dir, "wallet"+format.extension()), buf.Bytes())
+}
+
+func writeSnapshot(writer io.Writer, s *Service, compressed bool) error {
+	flags := byte(0)
+	if compressed {
+		flags |= snapshotFlagCompressed
+	}
+	_, err := writer.Write(append([]byte(snapshotMagic), snapshotVersion, flags))
+	if err != nil {
+		return err
+	}
+	body := writer
+	var compressor *flate.Writer
+	if compressed {
+		compressor, err = flate.NewWriter(writer, flate.DefaultCompression)
+		if err != nil {
+			return err
+		}
+		body = compressor
+	}
+	w := &snapshotWriter{w: bufio.NewWriter(body)}
+
+	w.uvarint(uint64(len(s.accounts)))
+	for _, account := range s.accounts {
+		w.varint(account.ID)
+		w.string(string(account.Phone))
+		w.varint(int64(account.Balance))
+	}
+	w.uvarint(uint64(len(s.payments)))
+	for _, payment := range s.payments {
+		w.id(payment.ID)
+		w.varint(payment.AccountID)
+		w.varint(int64(payment.Amount))
+		w.string(string(payment.Category))
+		w.string(string(payment.Status))
+		w.varint(payment.Created)
+		w.uvarint(uint64(len(payment.RiskHits)))
+		for _, hit := range payment.RiskHits {
+			w.string(hit)
+		}
+	}
+	w.uvarint(uint64(len(s.favorites)))
+	for _, favorite := range s.favorites {
+		w.id(favorite.ID)
+		w.varint(favorite.AccountID)
+		w.string(favorite.Name)
+		w.varint(int64(favorite.Amount))
+		w.string(string(favorite.Category))
+	}
+	if w.err != nil {
+		return w.err
+	}
+	err = w.w.Flush()
+	if err != nil {
+		return err
+	}
+	if compressor != nil {
+		return compressor.Close()
+	}
+	return nil
+}
+
+func (s *Service) importSnapshot(dir string) error {
+	data, err := s.readFile(path.Join(dir, "wallet"+FormatBinary.extension()))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.readSnapshot(bytes.NewReader(data))
+}
+
+func (s *Service) readSnapshot(reader io.Reader) error {
+	header := make([]byte, len(snapshotMagic)+2)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return ErrWrongSnapshot
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return ErrWrongSnapshot
+	}
+	version := header[len(snapshotMagic)]
+	if version < 1 || version > snapshotVersion {
+		return ErrUnsupportedSnapshotVersion
+	}
+	body := reader
+	if header[len(snapshotMagic)+1]&snapshotFlagCompressed != 0 {
+		decompressor := flate.NewReader(reader)
+		defer decompressor.Close()
+		body = decompressor
+	}
+	r := &snapshotReader{r: bufio.NewReader(body)}
+
+	n := r.count()
+	accounts := make([]*types.Account, 0, capacity(n))
+	for i := 0; i < n && r.err == nil; i++ {
+		accounts = append(accounts, &types.Account{
+			ID:      r.varint(),
+			Phone:   types.Phone(r.string()),
+			Balance: types.Money(r.varint()),
+		})
+	}
+	n = r.count()
+	payments := make([]*types.Payment, 0, capacity(n))
+	for i := 0; i < n && r.err == nil; i++ {
+		payment := &types.Payment{
+			ID:        r.id(),
+			AccountID: r.varint(),
+			Amount:    types.Money(r.varint()),
+			Category:  types.PaymentCategory(r.string()),
+			Status:    types.PaymentStatus(r.string()),
+		}
+		if version >= 2 {
+			payment.Created = r.varint()
+		}
+		if version >= 3 {
+			hits := r.count()
+			for j := 0; j < hits && r.err == nil; j++ {
+				payment.RiskHits = append(payment.RiskHits, r.string())
+			}
+		}
+		payments = append(payments, payment)
+	}
+	n = r.count()
+	favorites := make([]*types.Favorite, 0, capacity(n))
+	for i := 0; i < n && r.err == nil; i++ {
+		favorites = append(favorites, &types.Favorite{
+			ID:        r.id(),
+			AccountID: r.varint(),
+			Name:      r.string(),
+			Amount:    types.Money(r.varint()),
+			Category:  types.PaymentCategory(r.string()),
+		})
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	index := s.newImportIndex()
+	for _, account := range accounts {
+		s.upsertAccount(index, account)
+	}
+	for _, payment := range payments {
+		s.upsertPayment(index, payment)
+	}
+	for _, favorite := range favorites {
+		s.upsertFavorite(index, favorite)
+	}
+	return nil
+}
+
+// snapshotWriter keeps the first error so the encoding code stays linear.
+type snapshotWriter struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (w *snapshotWriter) write(p []byte) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = w.w.Write(p)
+}
+
+func (w *snapshotWriter) uvarint(v uint64) {
+	w.write(w.buf[:binary.PutUvarint(w.buf[:], v)])
+}
+
+func (w *snapshotWriter) varint(v int64) {
+	w.write(w.buf[:binary.PutVarint(w.buf[:], v)])
+}
+
+// string refuses what the reader would reject, so a snapshot that was
+// written can always be read back.
+func (w *snapshotWriter) string(v string) {
+	if len(v) > maxSnapshotString {
+		if w.err == nil {
+			w.err = ErrSnapshotStringTooLong
+		}
+		return
+	}
+	w.uvarint(uint64(len(v)))
+	w.write([]byte(v))
+}
+
+func (w *snapshotWriter) id(v string) {
+	id, err := uuid.Parse(v)
+	if err != nil || id.String() != v {
+		w.write([]byte{snapshotIDString})
+		w.string(v)
+		return
+	}
+	w.write([]byte{snapshotIDUUID})
+	w.write(id[:])
+}
+
+type snapshotReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (r *snapshotReader) fail(err error) {
+	if r.err != nil {
+		return
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrWrongSnapshot
+	}
+	r.err = err
+}
+
+func (r *snapshotReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		r.fail(err)
+	}
+	return v
+}
+
+func (r *snapshotReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, err := binary.ReadVarint(r.r)
+	if err != nil {
+		r.fail(err)
+	}
+	return v
+}
+
+func (r *snapshotReader) count() int {
+	v := r.uvarint()
+	if v > math.MaxInt32 {
+		r.fail(ErrWrongSnapshot)
+		return 0
+	}
+	return int(v)
+}
+
+// capacity limits preallocation so a corrupt count doesn't allocate
+// gigabytes before the reader runs out of input.
+func capacity(n int) int {
+	if n > 1<<16 {
+		return 1 << 16
+	}
+	return n
+}
+
+func (r *snapshotReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	p := make([]byte, n)
+	_, err := io.ReadFull(r.r, p)
+	if err != nil {
+		r.fail(err)
+		return nil
+	}
+	return p
+}
+
+func (r *snapshotReader) string() string {
+	n := r.uvarint()
+	if n > maxSnapshotString {
+		r.fail(ErrWrongSnapshot)
+		return ""
+	}
+	return string(r.bytes(int(n)))
+}
+
+func (r *snapshotReader) id() string {
+	kind := r.bytes(1)
+	if r.err != nil {
+		return ""
+	}
+	switch kind[0] {
+	case snapshotIDString:
+		return r.string()
+	case snapshotIDUUID:
+		var id uuid.UUID
+		copy(id[:], r.bytes(len(id)))
+		return id.String()
+	}
+	r.fail(ErrWrongSnapshot)
+	return ""
+}
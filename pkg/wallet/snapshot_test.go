@@ -0,0 +1,193 @@
+package wallet
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/google/uuid"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestService_ExportFormat_snapshotRoundTrip(t *testing.T) {
+	for _, format := range []Format{FormatBinary, FormatBinaryCompressed} {
+		s := newTestService(withFormatsData())
+		s.payments = append(s.payments, &types.Payment{
+			ID:        uuid.New().String(),
+			AccountID: 1,
+			Amount:    -5,
+			Category:  "auto",
+			Status:    types.PaymentStatusInProgress,
+		})
+		dir := t.TempDir()
+		if err := s.ExportFormat(dir, format); err != nil {
+			t.Fatal(err)
+		}
+		var got Service
+		if err := got.ImportFormat(dir, format); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.accounts, s.accounts) ||
+			!reflect.DeepEqual(got.payments, s.payments) ||
+			!reflect.DeepEqual(got.favorites, s.favorites) {
+			t.Errorf("format %d: snapshot changed after round trip", format)
+		}
+	}
+}
+
+func TestService_readSnapshot_wrongData(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeSnapshot(&buf, newTestService(withFormatsData()).Service, false); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	var s Service
+	if err := s.readSnapshot(bytes.NewReader(data[:len(data)-3])); err != ErrWrongSnapshot {
+		t.Errorf("truncated snapshot: want: %v, got: %v", ErrWrongSnapshot, err)
+	}
+	if len(s.accounts) != 0 {
+		t.Errorf("truncated snapshot imported accounts: %v", s.accounts)
+	}
+
+	version := append([]byte{}, data...)
+	version[len(snapshotMagic)] = snapshotVersion + 1
+	if err := s.readSnapshot(bytes.NewReader(version)); err != ErrUnsupportedSnapshotVersion {
+		t.Errorf("want: %v, got: %v", ErrUnsupportedSnapshotVersion, err)
+	}
+
+	if err := s.readSnapshot(bytes.NewReader([]byte("1|123|0\n"))); err != ErrWrongSnapshot {
+		t.Errorf("text dump: want: %v, got: %v", ErrWrongSnapshot, err)
+	}
+}
+
+func newBenchmarkService(payments int) *Service {
+	s := &Service{}
+	for i := 1; i <= 1000; i++ {
+		s.accounts = append(s.accounts, &types.Account{
+			ID:      int64(i),
+			Phone:   types.Phone("+992" + strconv.Itoa(900000000+i)),
+			Balance: types.Money(i * 1000),
+		})
+	}
+	categories := []types.PaymentCategory{"auto", "food", "mobile", "utilities"}
+	for i := 0; i < payments; i++ {
+		s.payments = append(s.payments, &types.Payment{
+			ID:        uuid.New().String(),
+			AccountID: int64(i%1000 + 1),
+			Amount:    types.Money(i % 100_000),
+			Category:  categories[i%len(categories)],
+			Status:    types.PaymentStatusOk,
+		})
+	}
+	return s
+}
+
+func dirSize(b *testing.B, dir string) int64 {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	size := int64(0)
+	for _, file := range files {
+		size += file.Size()
+	}
+	return size
+}
+
+var benchmarkFormats = map[string]Format{
+	"dump":       FormatDump,
+	"binary":     FormatBinary,
+	"compressed": FormatBinaryCompressed,
+}
+
+// BenchmarkService_ImportFormat compares load time and file size of the
+// text dump and the binary snapshots.
+func BenchmarkService_ImportFormat(b *testing.B) {
+	s := newBenchmarkService(100_000)
+	for name, format := range benchmarkFormats {
+		format := format
+		b.Run(name, func(b *testing.B) {
+			dir := b.TempDir()
+			if err := s.ExportFormat(dir, format); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var got Service
+				if err := got.ImportFormat(dir, format); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(dirSize(b, dir)), "file-bytes")
+		})
+	}
+}
+
+func BenchmarkService_ExportFormat(b *testing.B) {
+	s := newBenchmarkService(100_000)
+	for name, format := range benchmarkFormats {
+		format := format
+		b.Run(name, func(b *testing.B) {
+			dir := b.TempDir()
+			for i := 0; i < b.N; i++ {
+				if err := s.ExportFormat(dir, format); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(dirSize(b, dir)), "file-bytes")
+		})
+	}
+}
+
+func TestService_readSnapshot_olderVersions(t *testing.T) {
+	for version := byte(1); version < snapshotVersion; version++ {
+		var buf bytes.Buffer
+		buf.WriteString(snapshotMagic)
+		buf.Write([]byte{version, 0})
+		w := &snapshotWriter{w: bufio.NewWriter(&buf)}
+		w.uvarint(1)
+		w.varint(1)
+		w.string("+992000000001")
+		w.varint(100)
+		w.uvarint(1)
+		w.id("p1")
+		w.varint(1)
+		w.varint(50)
+		w.string("auto")
+		w.string(string(types.PaymentStatusOk))
+		if version >= 2 {
+			w.varint(1_600_000_000)
+		}
+		w.uvarint(0)
+		if err := w.w.Flush(); err != nil || w.err != nil {
+			t.Fatal(err, w.err)
+		}
+
+		var s Service
+		if err := s.readSnapshot(&buf); err != nil {
+			t.Fatalf("version %d: %v", version, err)
+		}
+		want := &types.Payment{ID: "p1", AccountID: 1, Amount: 50, Category: "auto", Status: types.PaymentStatusOk}
+		if version >= 2 {
+			want.Created = 1_600_000_000
+		}
+		if len(s.accounts) != 1 || s.accounts[0].Balance != 100 {
+			t.Errorf("version %d: accounts: %v", version, s.accounts)
+		}
+		if len(s.payments) != 1 || !reflect.DeepEqual(s.payments[0], want) {
+			t.Errorf("version %d: payments got: %v, want: %v", version, s.payments, want)
+		}
+	}
+}
+
+func TestService_ExportFormat_snapshotLongString(t *testing.T) {
+	s := newTestService(withFormatsData())
+	s.favorites[0].Name = strings.Repeat("a", maxSnapshotString+1)
+	if err := writeSnapshot(ioutil.Discard, s.Service, false); err != ErrSnapshotStringTooLong {
+		t.Errorf("want: %v, got: %v", ErrSnapshotStringTooLong, err)
+	}
+}
@@ -0,0 +1,550 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrSplitNotFound = errors.New("split not found")
+var ErrWrongSplit = errors.New("wrong split")
+var ErrSplitClosed = errors.New("split not open")
+var ErrSplitExpired = errors.New("split expired")
+var ErrNotInSplit = errors.New("account not in split")
+var ErrPartPaid = errors.New("part already paid")
+
+type SplitStatus string
+
+const (
+	SplitStatusOpen      SplitStatus = "OPEN"
+	SplitStatusPaid      SplitStatus = "PAID"
+	SplitStatusCancelled SplitStatus = "CANCELLED"
+	SplitStatusExpired   SplitStatus = "EXPIRED"
+	// SplitStatusReversed is a paid split the payment of a part of which was
+	// rejected, the other parts are refunded to the accounts that paid them.
+	SplitStatusReversed SplitStatus = "REVERSED"
+)
+
+// SplitMethod says how the total of a split is divided into parts.
+type SplitMethod int
+
+const (
+	// SplitEqually gives every account the same part, the units left over
+	// go one each to the first accounts.
+	SplitEqually SplitMethod = iota
+	// SplitByShares divides the total in proportion to SplitShare.Share,
+	// the units left over go one each to the first accounts.
+	SplitByShares
+	// SplitByAmounts takes the parts from SplitShare.Amount, they must add
+	// up to the total.
+	SplitByAmounts
+)
+
+// payment_id is left empty, it held the payment of the whole bill before the
+// parts were paid by payments of their own.
+var splitColumns = []string{"id", "account_id", "category", "total", "status", "payment_id", "created", "expires", "parts"}
+
+// SplitShare is an account sharing a bill.
+type SplitShare struct {
+	AccountID int64
+	Share     int64
+	Amount    types.Money
+}
+
+// SplitRequest is a bill of Total split among Shares. AccountID opens and may
+// cancel the split, it pays a part only if it is among Shares.
+type SplitRequest struct {
+	AccountID int64
+	Total     types.Money
+	Category  types.PaymentCategory
+	Method    SplitMethod
+	Shares    []SplitShare
+	// Expires is when the split is cancelled if not all parts are paid, zero
+	// for never.
+	Expires time.Time
+}
+
+// SplitPart is what an account owes of a split. Paid is the Unix time it was
+// paid, zero until then. PaymentID is the payment of the part, empty for
+// parts paid before parts were payments.
+type SplitPart struct {
+	AccountID int64       `json:"account_id"`
+	Amount    types.Money `json:"amount"`
+	Paid      int64       `json:"paid"`
+	PaymentID string      `json:"payment_id,omitempty"`
+}
+
+// Split is a bill shared among accounts. Every account pays its part with a
+// payment in the category of the split, the bill is paid with the last part.
+type Split struct {
+	ID        string                `json:"id"`
+	AccountID int64                 `json:"account_id"`
+	Category  types.PaymentCategory `json:"category"`
+	Total     types.Money           `json:"total"`
+	Status    SplitStatus           `json:"status"`
+	Created   int64                 `json:"created"`
+	Expires   int64                 `json:"expires"`
+	Parts     []SplitPart           `json:"parts"`
+}
+
+func (split *Split) clone() Split {
+	copied := *split
+	copied.Parts = append([]SplitPart(nil), split.Parts...)
+	return copied
+}
+
+func (split *Split) part(accountID int64) *SplitPart {
+	for i := range split.Parts {
+		if split.Parts[i].AccountID == accountID {
+			return &split.Parts[i]
+		}
+	}
+	return nil
+}
+
+func (split *Split) expired(now time.Time) bool {
+	return split.Expires != 0 && now.Unix() >= split.Expires
+}
+
+// CreateSplit opens a split of a bill. Nothing is paid until the accounts pay
+// their parts.
+func (s *Service) CreateSplit(request SplitRequest) (result *Split, err error) {
+	op := s.beginOperation("CreateSplit", request.AccountID, map[string]string{
+		"total":    strconv.FormatInt(int64(request.Total), 10),
+		"category": string(request.Category),
+		"accounts": strconv.Itoa(len(request.Shares)),
+	}, auditTarget{accountID: request.AccountID})
+	defer func() { op.end(err, auditTarget{accountID: request.AccountID}) }()
+	if request.Total <= 0 {
+		return nil, ErrAmountMustBePositive
+	}
+	if !request.Expires.IsZero() && !request.Expires.After(s.now()) {
+		return nil, ErrWrongSplit
+	}
+	account, err := s.FindAccountByID(request.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	err = s.checkSession(account.ID)
+	if err != nil {
+		return nil, err
+	}
+	parts, err := splitParts(request)
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range parts {
+		_, err = s.FindAccountByID(part.AccountID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	split := &Split{
+		ID:        uuid.New().String(),
+		AccountID: account.ID,
+		Category:  request.Category,
+		Total:     request.Total,
+		Status:    SplitStatusOpen,
+		Created:   s.now().Unix(),
+		Parts:     parts,
+	}
+	if !request.Expires.IsZero() {
+		split.Expires = request.Expires.Unix()
+	}
+	s.splits = append(s.splits, split)
+	s.changes.split(split.ID)
+	s.publish(SplitCreated{EventMeta: s.eventMeta(account.ID), Split: split.clone()})
+	return split, nil
+}
+
+// splitParts divides the total of request by its method.
+func splitParts(request SplitRequest) ([]SplitPart, error) {
+	if len(request.Shares) == 0 {
+		return nil, ErrWrongSplit
+	}
+	parts := make([]SplitPart, len(request.Shares))
+	seen := make(map[int64]bool, len(request.Shares))
+	weights := int64(0)
+	for i, share := range request.Shares {
+		if seen[share.AccountID] {
+			return nil, ErrWrongSplit
+		}
+		seen[share.AccountID] = true
+		parts[i].AccountID = share.AccountID
+		switch request.Method {
+		case SplitEqually:
+			weights++
+		case SplitByShares:
+			if share.Share <= 0 || share.Share > math.MaxInt64-weights {
+				return nil, ErrWrongSplit
+			}
+			weights += share.Share
+		case SplitByAmounts:
+			parts[i].Amount = share.Amount
+		default:
+			return nil, ErrWrongSplit
+		}
+	}
+	if request.Method != SplitByAmounts {
+		left := request.Total
+		for i, share := range request.Shares {
+			weight := int64(1)
+			if request.Method == SplitByShares {
+				weight = share.Share
+			}
+			parts[i].Amount = types.Money(mulDiv(int64(request.Total), weight, weights))
+			left -= parts[i].Amount
+		}
+		for i := 0; left > 0; i, left = i+1, left-1 {
+			parts[i].Amount++
+		}
+	}
+	sum := types.Money(0)
+	for _, part := range parts {
+		if part.Amount <= 0 || part.Amount > request.Total-sum {
+			return nil, ErrWrongSplit
+		}
+		sum += part.Amount
+	}
+	if sum != request.Total {
+		return nil, ErrWrongSplit
+	}
+	return parts, nil
+}
+
+// mulDiv is a*b/c rounded down for non-negative a and 0 <= b <= c, without
+// overflowing the product.
+func mulDiv(a int64, b int64, c int64) int64 {
+	hi, lo := bits.Mul64(uint64(a), uint64(b))
+	quotient, _ := bits.Div64(hi, lo, uint64(c))
+	return int64(quotient)
+}
+
+func (s *Service) FindSplitByID(splitID string) (*Split, error) {
+	for _, split := range s.splits {
+		if split.ID == splitID {
+			return split, nil
+		}
+	}
+	return nil, ErrSplitNotFound
+}
+
+// Splits returns the splits the account collects or pays a part of, in the
+// order they were created.
+func (s *Service) Splits(accountID int64) ([]Split, error) {
+	_, err := s.FindAccountByID(accountID)
+	if err != nil {
+		return nil, err
+	}
+	splits := make([]Split, 0)
+	for _, split := range s.splits {
+		if split.AccountID == accountID || split.part(accountID) != nil {
+			splits = append(splits, split.clone())
+		}
+	}
+	return splits, nil
+}
+
+// PaySplitPart pays the part of the account like Pay in the category of the
+// split, so budgets, risk rules and rewards apply to the part. When it is the
+// last part unpaid, the bill is paid.
+func (s *Service) PaySplitPart(splitID string, accountID int64) (err error) {
+	op := s.beginOperation("PaySplitPart", accountID, map[string]string{"split_id": splitID},
+		auditTarget{accountID: accountID})
+	defer func() { op.end(err, auditTarget{accountID: accountID}) }()
+	split, err := s.FindSplitByID(splitID)
+	if err != nil {
+		return err
+	}
+	part := split.part(accountID)
+	if part == nil {
+		return ErrNotInSplit
+	}
+	if split.Status != SplitStatusOpen {
+		return ErrSplitClosed
+	}
+	if split.expired(s.now()) {
+		return ErrSplitExpired
+	}
+	if part.Paid != 0 {
+		return ErrPartPaid
+	}
+	account, err := s.FindAccountByID(accountID)
+	if err != nil {
+		return err
+	}
+	err = s.checkSession(account.ID)
+	if err != nil {
+		return err
+	}
+	payment, err := s.pay(account, part.Amount, split.Category)
+	if err != nil {
+		return err
+	}
+	part.Paid = payment.Created
+	part.PaymentID = payment.ID
+	s.changes.split(split.ID)
+	s.publish(SplitPartPaid{
+		EventMeta: s.eventMeta(account.ID),
+		Split:     split.clone(),
+		Payment:   *payment,
+		Balance:   account.Balance,
+	})
+	for _, part := range split.Parts {
+		if part.Paid == 0 {
+			return nil
+		}
+	}
+	split.Status = SplitStatusPaid
+	s.publish(SplitCompleted{EventMeta: s.eventMeta(split.AccountID), Split: split.clone()})
+	return nil
+}
+
+func (s *Service) recordSplit(account *types.Account, split *Split, amount types.Money) {
+	entry := s.record(account, LedgerSplit, amount, nil)
+	entry.SplitID = split.ID
+	entry.Category = split.Category
+}
+
+// CancelSplit closes an open split and refunds the parts already paid.
+func (s *Service) CancelSplit(splitID string) (err error) {
+	target := s.splitAuditTarget(splitID)
+	op := s.beginOperation("CancelSplit", target.accountID, map[string]string{"split_id": splitID}, target)
+	defer func() { op.end(err, target) }()
+	split, err := s.FindSplitByID(splitID)
+	if err != nil {
+		return err
+	}
+	if split.Status != SplitStatusOpen {
+		return ErrSplitClosed
+	}
+	err = s.checkSession(split.AccountID)
+	if err != nil {
+		return err
+	}
+	s.closeSplit(split, SplitStatusCancelled)
+	return nil
+}
+
+// ExpireSplits closes the open splits past their expiry, refunding the parts
+// paid, and returns them.
+func (s *Service) ExpireSplits() (result []Split, err error) {
+	op := s.beginOperation("ExpireSplits", 0, nil, auditTarget{counts: true})
+	defer func() { op.end(err, auditTarget{counts: true}) }()
+	now := s.now()
+	result = make([]Split, 0)
+	for _, split := range s.splits {
+		if split.Status == SplitStatusOpen && split.expired(now) {
+			s.closeSplit(split, SplitStatusExpired)
+			result = append(result, split.clone())
+		}
+	}
+	return result, nil
+}
+
+// closeSplit refunds the parts paid by rejecting their payments. Parts paid
+// before they were payments are credited back to the balance.
+func (s *Service) closeSplit(split *Split, status SplitStatus) {
+	for _, part := range split.Parts {
+		if part.Paid == 0 {
+			continue
+		}
+		account, err := s.FindAccountByID(part.AccountID)
+		if err != nil {
+			s.log().Warn("split part not refunded", "split_id", split.ID, "account_id", part.AccountID, "error", err)
+			continue
+		}
+		if part.PaymentID == "" {
+			account.Balance += part.Amount
+			s.changes.account(account.ID)
+			s.recordSplit(account, split, part.Amount)
+			continue
+		}
+		payment, err := s.FindPaymentByID(part.PaymentID)
+		if err != nil {
+			s.log().Warn("split part not refunded", "split_id", split.ID, "account_id", part.AccountID, "error", err)
+			continue
+		}
+		if payment.Status != types.PaymentStatusFail {
+			s.refund(account, payment)
+		}
+	}
+	split.Status = status
+	s.changes.split(split.ID)
+	s.publish(SplitClosed{EventMeta: s.eventMeta(split.AccountID), Split: split.clone()})
+}
+
+// reverseSplit handles the rejected payment of a part. An open split waits
+// for the part again, a paid split is reversed and its other parts refunded.
+func (s *Service) reverseSplit(payment *types.Payment) {
+	for _, split := range s.splits {
+		for i := range split.Parts {
+			part := &split.Parts[i]
+			if part.PaymentID != payment.ID {
+				continue
+			}
+			switch split.Status {
+			case SplitStatusOpen:
+				part.Paid = 0
+				part.PaymentID = ""
+				s.changes.split(split.ID)
+			case SplitStatusPaid:
+				s.closeSplit(split, SplitStatusReversed)
+			}
+			return
+		}
+	}
+}
+
+// splitAuditTarget is the account collecting the split.
+func (s *Service) splitAuditTarget(splitID string) auditTarget {
+	if s.auditLog == nil {
+		return auditTarget{}
+	}
+	target := auditTarget{}
+	if split, err := s.FindSplitByID(splitID); err == nil {
+		target.accountID = split.AccountID
+	}
+	return target
+}
+
+func splitsTable(splits []*Split) table {
+	return table{
+		columns: splitColumns,
+		rows:    len(splits),
+		fields:  func(row int) []string { return splitRowFields(splits[row]) },
+		value:   func(row int) interface{} { return splits[row] },
+	}
+}
+
+func splitRowFields(split *Split) []string {
+	parts := make([]string, len(split.Parts))
+	for i, part := range split.Parts {
+		parts[i] = fmt.Sprintf("%d:%d:%d:%s", part.AccountID, part.Amount, part.Paid, part.PaymentID)
+	}
+	return []string{
+		split.ID,
+		strconv.FormatInt(split.AccountID, 10),
+		string(split.Category),
+		strconv.FormatInt(int64(split.Total), 10),
+		string(split.Status),
+		"",
+		strconv.FormatInt(split.Created, 10),
+		strconv.FormatInt(split.Expires, 10),
+		strings.Join(parts, ","),
+	}
+}
+
+func parseSplitFields(fields []string, value interface{}) error {
+	if len(fields) < 9 {
+		return ErrWrongLineFormat
+	}
+	accountID, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return err
+	}
+	total, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return err
+	}
+	created, err := strconv.ParseInt(fields[6], 10, 64)
+	if err != nil {
+		return err
+	}
+	expires, err := strconv.ParseInt(fields[7], 10, 64)
+	if err != nil {
+		return err
+	}
+	var parts []SplitPart
+	if fields[8] != "" {
+		for _, field := range strings.Split(fields[8], ",") {
+			// The payment ID was added as the fourth value.
+			values := strings.Split(field, ":")
+			if len(values) != 3 && len(values) != 4 {
+				return ErrWrongLineFormat
+			}
+			var part [3]int64
+			for i, number := range values[:3] {
+				part[i], err = strconv.ParseInt(number, 10, 64)
+				if err != nil {
+					return err
+				}
+			}
+			parsed := SplitPart{AccountID: part[0], Amount: types.Money(part[1]), Paid: part[2]}
+			if len(values) == 4 {
+				parsed.PaymentID = values[3]
+			}
+			parts = append(parts, parsed)
+		}
+	}
+	*value.(*Split) = Split{
+		ID:        fields[0],
+		AccountID: accountID,
+		Category:  types.PaymentCategory(fields[2]),
+		Total:     types.Money(total),
+		Status:    SplitStatus(fields[4]),
+		Created:   created,
+		Expires:   expires,
+		Parts:     parts,
+	}
+	return nil
+}
+
+func (s *Service) splitRecord(index *importIndex) func(fields []string, data []byte) error {
+	return func(fields []string, data []byte) error {
+		split := &Split{}
+		err := decodeRecord(fields, data, split, parseSplitFields)
+		if err != nil {
+			s.log().Warn("skipped wrong record", "table", "splits", "error", err)
+			return nil
+		}
+		s.upsertSplit(index, split)
+		return nil
+	}
+}
+
+func (s *Service) upsertSplit(index *importIndex, split *Split) {
+	s.changes.split(split.ID)
+	if i, ok := index.splits[split.ID]; ok {
+		s.splits[i] = split
+		return
+	}
+	index.splits[split.ID] = len(s.splits)
+	s.splits = append(s.splits, split)
+}
+
+// CreateSplit creates the split for the account of the session, whatever
+// request.AccountID is.
+func (session *Session) CreateSplit(request SplitRequest) (*Split, error) {
+	leave, err := session.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	request.AccountID = session.AccountID
+	return session.s.CreateSplit(request)
+}
+
+func (session *Session) CancelSplit(splitID string) error {
+	leave, err := session.enter()
+	if err != nil {
+		return err
+	}
+	defer leave()
+	return session.s.CancelSplit(splitID)
+}
+
+func (session *Session) PaySplitPart(splitID string) error {
+	leave, err := session.enter()
+	if err != nil {
+		return err
+	}
+	defer leave()
+	return session.s.PaySplitPart(splitID, session.AccountID)
+}
@@ -0,0 +1,295 @@
+package wallet
+
+import (
+	"context"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_splitParts(t *testing.T) {
+	shares := []SplitShare{{AccountID: 1, Share: 1, Amount: 500}, {AccountID: 2, Share: 2, Amount: 300}, {AccountID: 3, Share: 2, Amount: 200}}
+	tests := []struct {
+		name   string
+		method SplitMethod
+		total  types.Money
+		shares []SplitShare
+		want   []types.Money
+		err    error
+	}{
+		{"equally", SplitEqually, 1_000, shares, []types.Money{334, 333, 333}, nil},
+		{"by shares", SplitByShares, 1_001, shares, []types.Money{201, 400, 400}, nil},
+		{"by amounts", SplitByAmounts, 1_000, shares, []types.Money{500, 300, 200}, nil},
+		{"amounts not adding up", SplitByAmounts, 999, shares, nil, ErrWrongSplit},
+		{"zero part", SplitEqually, 2, shares, nil, ErrWrongSplit},
+		{"same account twice", SplitEqually, 1_000, append(shares, shares[0]), nil, ErrWrongSplit},
+		{"no accounts", SplitEqually, 1_000, nil, nil, ErrWrongSplit},
+		{"large total", SplitByShares, math.MaxInt64, []SplitShare{{AccountID: 1, Share: 3}, {AccountID: 2, Share: 1}},
+			[]types.Money{6_917_529_027_641_081_856, 2_305_843_009_213_693_951}, nil},
+		{"shares overflowing", SplitByShares, 1_000, []SplitShare{{AccountID: 1, Share: math.MaxInt64}, {AccountID: 2, Share: 1}},
+			nil, ErrWrongSplit},
+		{"amounts overflowing", SplitByAmounts, 1, []SplitShare{{AccountID: 1, Amount: math.MaxInt64}, {AccountID: 2, Amount: 2}},
+			nil, ErrWrongSplit},
+	}
+	for _, test := range tests {
+		parts, err := splitParts(SplitRequest{Total: test.total, Method: test.method, Shares: test.shares})
+		if err != test.err {
+			t.Errorf("%s: want: %v, got: %v", test.name, test.err, err)
+			continue
+		}
+		for i, amount := range test.want {
+			if parts[i].Amount != amount || parts[i].AccountID != test.shares[i].AccountID {
+				t.Errorf("%s: invalid parts: %+v", test.name, parts)
+			}
+		}
+	}
+}
+
+func TestService_PaySplitPart(t *testing.T) {
+	s := newTestService(withClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)))
+	s.addAccounts(t, 10_000, "1", "2", "3")
+	split, err := s.CreateSplit(SplitRequest{
+		AccountID: 1,
+		Total:     3_000,
+		Category:  "utilities",
+		Shares:    []SplitShare{{AccountID: 1}, {AccountID: 2}, {AccountID: 3}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, accountID := range []int64{2, 1} {
+		if err := s.PaySplitPart(split.ID, accountID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.PaySplitPart(split.ID, 2); err != ErrPartPaid {
+		t.Errorf("want: %v, got: %v", ErrPartPaid, err)
+	}
+	if split.Status != SplitStatusOpen {
+		t.Errorf("split completed early: %+v", split)
+	}
+	if err := s.PaySplitPart(split.ID, 3); err != nil {
+		t.Fatal(err)
+	}
+	if split.Status != SplitStatusPaid {
+		t.Errorf("split not completed: %+v", split)
+	}
+	for _, part := range split.Parts {
+		payment, err := s.FindPaymentByID(part.PaymentID)
+		if err != nil || payment.AccountID != part.AccountID || payment.Amount != 1_000 || payment.Category != "utilities" {
+			t.Errorf("invalid payment: %+v, %v", payment, err)
+		}
+	}
+	if len(s.payments) != 3 {
+		t.Errorf("invalid payments: %d", len(s.payments))
+	}
+	for _, accountID := range []int64{1, 2, 3} {
+		if account, _ := s.FindAccountByID(accountID); account.Balance != 9_000 {
+			t.Errorf("account %d balance: %d", accountID, account.Balance)
+		}
+	}
+	if err := s.CancelSplit(split.ID); err != ErrSplitClosed {
+		t.Errorf("want: %v, got: %v", ErrSplitClosed, err)
+	}
+	result, err := s.Reconcile(context.Background(), ReconcileOptions{})
+	if err != nil || len(result.Discrepancies) != 0 {
+		t.Errorf("split not reconciled: %+v, %v", result, err)
+	}
+	splits, err := s.Splits(3)
+	if err != nil || len(splits) != 1 || splits[0].ID != split.ID {
+		t.Errorf("invalid splits: %+v, %v", splits, err)
+	}
+}
+
+func TestService_Reject_split(t *testing.T) {
+	s := newTestService(withClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)))
+	s.addAccounts(t, 10_000, "1", "2", "3")
+	split, err := s.CreateSplit(SplitRequest{
+		AccountID: 1,
+		Total:     1_000,
+		Category:  "utilities",
+		Method:    SplitByAmounts,
+		Shares:    []SplitShare{{AccountID: 1, Amount: 200}, {AccountID: 2, Amount: 800}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PaySplitPart(split.ID, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reject(split.Parts[1].PaymentID); err != nil {
+		t.Fatal(err)
+	}
+	if split.Status != SplitStatusOpen || split.Parts[1].Paid != 0 || split.Parts[1].PaymentID != "" {
+		t.Errorf("part not reopened: %+v", split)
+	}
+	for _, accountID := range []int64{1, 2} {
+		if err := s.PaySplitPart(split.ID, accountID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Reject(split.Parts[0].PaymentID); err != nil {
+		t.Fatal(err)
+	}
+	payment, err := s.FindPaymentByID(split.Parts[1].PaymentID)
+	if err != nil || payment.Status != types.PaymentStatusFail {
+		t.Errorf("part payment not rejected: %+v, %v", payment, err)
+	}
+	for _, accountID := range []int64{1, 2} {
+		if account, _ := s.FindAccountByID(accountID); account.Balance != 10_000 {
+			t.Errorf("account %d balance: %d", accountID, account.Balance)
+		}
+	}
+	if split.Status != SplitStatusReversed {
+		t.Errorf("split not reversed: %+v", split)
+	}
+	result, err := s.Reconcile(context.Background(), ReconcileOptions{})
+	if err != nil || len(result.Discrepancies) != 0 {
+		t.Errorf("reversal not reconciled: %+v, %v", result, err)
+	}
+}
+
+func TestService_CancelSplit(t *testing.T) {
+	s := newTestService(withClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)))
+	s.addAccounts(t, 10_000, "1", "2", "3")
+	request := SplitRequest{
+		AccountID: 1,
+		Total:     1_000,
+		Category:  "utilities",
+		Method:    SplitByAmounts,
+		Shares:    []SplitShare{{AccountID: 2, Amount: 600}, {AccountID: 3, Amount: 400}},
+		Expires:   s.clock.Add(time.Hour),
+	}
+	cancelled, err := s.CreateSplit(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiring, err := s.CreateSplit(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, split := range []*Split{cancelled, expiring} {
+		if err := s.PaySplitPart(split.ID, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.PaySplitPart(cancelled.ID, 1); err != ErrNotInSplit {
+		t.Errorf("want: %v, got: %v", ErrNotInSplit, err)
+	}
+	if err := s.CancelSplit(cancelled.ID); err != nil {
+		t.Fatal(err)
+	}
+	if account, _ := s.FindAccountByID(2); account.Balance != 10_000-600 {
+		t.Errorf("part not refunded: %d", account.Balance)
+	}
+
+	*s.clock = s.clock.Add(time.Hour)
+	if err := s.PaySplitPart(expiring.ID, 3); err != ErrSplitExpired {
+		t.Errorf("want: %v, got: %v", ErrSplitExpired, err)
+	}
+	expired, err := s.ExpireSplits()
+	if err != nil || len(expired) != 1 || expired[0].ID != expiring.ID || expired[0].Status != SplitStatusExpired {
+		t.Fatalf("invalid expired splits: %+v, %v", expired, err)
+	}
+	if account, _ := s.FindAccountByID(2); account.Balance != 10_000 {
+		t.Errorf("part not refunded: %d", account.Balance)
+	}
+	if cancelled.Status != SplitStatusCancelled {
+		t.Errorf("invalid split: %+v", cancelled)
+	}
+	for _, payment := range s.payments {
+		if payment.Status != types.PaymentStatusFail {
+			t.Errorf("part payment not rejected: %+v", payment)
+		}
+	}
+}
+
+func TestService_PaySplitPart_budgetExceeded(t *testing.T) {
+	s := newTestService(withClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)))
+	s.addAccounts(t, 10_000, "1", "2")
+	if err := s.SetBudget(Budget{AccountID: 2, Category: "utilities", Limit: 400, Enforce: true}); err != nil {
+		t.Fatal(err)
+	}
+	split, err := s.CreateSplit(SplitRequest{
+		AccountID: 1,
+		Total:     1_000,
+		Category:  "utilities",
+		Shares:    []SplitShare{{AccountID: 1}, {AccountID: 2}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PaySplitPart(split.ID, 2); err != ErrBudgetExceeded {
+		t.Errorf("want: %v, got: %v", ErrBudgetExceeded, err)
+	}
+	if split.Parts[1].Paid != 0 || len(s.payments) != 0 {
+		t.Errorf("part paid: %+v", split)
+	}
+	if account, _ := s.FindAccountByID(2); account.Balance != 10_000 {
+		t.Errorf("account 2 balance: %d", account.Balance)
+	}
+}
+
+func TestService_PaySplitPart_rewards(t *testing.T) {
+	s := newTestService(withClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)), withRewards(&rewardsTestProgram))
+	s.addAccounts(t, 10_000, "1", "2", "3")
+	if _, err := s.Pay(3, 1_000, "utilities"); err != nil {
+		t.Fatal(err)
+	}
+	split, err := s.CreateSplit(SplitRequest{
+		AccountID: 1,
+		Total:     2_000,
+		Category:  "utilities",
+		Shares:    []SplitShare{{AccountID: 1}, {AccountID: 2}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, accountID := range []int64{1, 2} {
+		if err := s.PaySplitPart(split.ID, accountID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, _ := s.Points(3)
+	for _, accountID := range []int64{1, 2} {
+		if points, err := s.Points(accountID); err != nil || points != want {
+			t.Errorf("account %d points: %d, want: %d, %v", accountID, points, want, err)
+		}
+	}
+}
+
+func TestService_splits_roundTrip(t *testing.T) {
+	for _, format := range []Format{FormatDump, FormatJSON, FormatCSV, FormatBinary} {
+		s := newTestService(withClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)))
+		s.addAccounts(t, 10_000, "1", "2", "3")
+		split, err := s.CreateSplit(SplitRequest{
+			AccountID: 1,
+			Total:     500,
+			Category:  "utilities",
+			Method:    SplitByShares,
+			Shares:    []SplitShare{{AccountID: 2, Share: 3}, {AccountID: 3, Share: 2}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PaySplitPart(split.ID, 3); err != nil {
+			t.Fatal(err)
+		}
+		dir := t.TempDir()
+		if err := s.ExportFormat(dir, format); err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		var got Service
+		if err := got.ImportFormat(dir, format); err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		if !reflect.DeepEqual(got.splits, s.splits) {
+			t.Errorf("format %d: splits got: %v, want: %v", format, got.splits, s.splits)
+		}
+		if !reflect.DeepEqual(got.ledger, s.ledger) {
+			t.Errorf("format %d: ledger got: %v, want: %v", format, got.ledger, s.ledger)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package wallet
+
+import (
+	"encoding/csv"
+	"errors"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	htmltemplate "html/template"
+	"io"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var ErrWrongPeriod = errors.New("period must end after it starts")
+
+// Statement is the account activity over the period [From, To).
+type Statement struct {
+	AccountID int64
+	Phone     types.Phone
+	From      time.Time
+	To        time.Time
+	Opening   types.Money
+	Lines     []StatementLine
+	// Deposits, Reversals, Payments, Refunds and Adjustments are the totals of
+	// the lines of each kind, Reversals and Payments are negative. Interest is
+	// the interest posted less overdraft charges. Splits are the parts of
+	// split bills paid less those refunded, plus the parts collected.
+	Deposits    types.Money
+	Reversals   types.Money
+	Payments    types.Money
+	Refunds     types.Money
+	Adjustments types.Money
+	Interest    types.Money
+	Splits      types.Money
+	Categories  []CategoryTotal
+	Closing     types.Money
+}
+
+// StatementLine is one balance change with the balance after it.
+type StatementLine struct {
+	Time      time.Time
+	Kind      LedgerKind
+	PaymentID string
+	Category  types.PaymentCategory
+	Amount    types.Money
+	Balance   types.Money
+}
+
+// CategoryTotal is what was spent on a category: payments less refunds.
+type CategoryTotal struct {
+	Category types.PaymentCategory
+	Payments int
+	Paid     types.Money
+	Refunded types.Money
+	Spent    types.Money
+}
+
+// Statement builds the statement of the account for [from, to). The opening
+// balance is derived backwards from the current balance, so it is right for
+// accounts with history made before the ledger existed as well.
+func (s *Service) Statement(accountID int64, from time.Time, to time.Time) (*Statement, error) {
+	if !to.After(from) {
+		return nil, ErrWrongPeriod
+	}
+	account, err := s.FindAccountByID(accountID)
+	if err != nil {
+		return nil, err
+	}
+	statement := &Statement{
+		AccountID: account.ID,
+		Phone:     account.Phone,
+		From:      from,
+		To:        to,
+		Opening:   account.Balance,
+		Lines:     make([]StatementLine, 0),
+	}
+	start, end := from.Unix(), to.Unix()
+	in := make([]*LedgerEntry, 0)
+	for _, entry := range s.ledger {
+		if entry.AccountID != accountID || entry.Time < start {
+			continue
+		}
+		statement.Opening -= entry.Amount
+		if entry.Time < end {
+			in = append(in, entry)
+		}
+	}
+	sort.SliceStable(in, func(i, j int) bool { return in[i].Time < in[j].Time })
+
+	balance := statement.Opening
+	categories := make(map[types.PaymentCategory]*CategoryTotal)
+	for _, entry := range in {
+		balance += entry.Amount
+		statement.Lines = append(statement.Lines, StatementLine{
+			Time:      time.Unix(entry.Time, 0).In(from.Location()),
+			Kind:      entry.Kind,
+			PaymentID: entry.PaymentID,
+			Category:  entry.Category,
+			Amount:    entry.Amount,
+			Balance:   balance,
+		})
+		switch entry.Kind {
+		case LedgerDeposit:
+			statement.Deposits += entry.Amount
+			continue
+		case LedgerPayment:
+			statement.Payments += entry.Amount
+		case LedgerRefund:
+			statement.Refunds += entry.Amount
+		case LedgerReversal:
+			statement.Reversals += entry.Amount
+			continue
+		case LedgerAdjustment:
+			statement.Adjustments += entry.Amount
+			continue
+		case LedgerInterest, LedgerCharge:
+			statement.Interest += entry.Amount
+			continue
+		case LedgerSplit:
+			statement.Splits += entry.Amount
+			continue
+		default:
+			continue
+		}
+		total := categories[entry.Category]
+		if total == nil {
+			total = &CategoryTotal{Category: entry.Category}
+			categories[entry.Category] = total
+		}
+		if entry.Kind == LedgerPayment {
+			total.Payments++
+			total.Paid -= entry.Amount
+		} else {
+			total.Refunded += entry.Amount
+		}
+		total.Spent -= entry.Amount
+	}
+	statement.Closing = balance
+
+	statement.Categories = make([]CategoryTotal, 0, len(categories))
+	for _, total := range categories {
+		statement.Categories = append(statement.Categories, *total)
+	}
+	sort.Slice(statement.Categories, func(i, j int) bool {
+		return statement.Categories[i].Category < statement.Categories[j].Category
+	})
+	return statement, nil
+}
+
+const statementTimeLayout = "2006-01-02 15:04:05"
+
+var statementFuncs = map[string]interface{}{
+	"money": formatMoney,
+	"date":  func(t time.Time) string { return t.Format("2006-01-02") },
+	"time":  func(t time.Time) string { return t.Format(statementTimeLayout) },
+	"csv":   csvRecord,
+}
+
+var statementText = template.Must(template.New("text").Funcs(statementFuncs).Parse(
+	`Statement of account {{.AccountID}} ({{.Phone}})
+Period: {{date .From}} - {{date .To}}
+
+Opening balance: {{money .Opening}}
+{{range .Lines}}
+{{time .Time}}  {{printf "%-8s" .Kind}}  {{printf "%12s" (money .Amount)}}  {{printf "%12s" (money .Balance)}}{{if .Category}}  {{.Category}}{{end}}{{if .PaymentID}}  {{.PaymentID}}{{end}}{{end}}
+
+Deposits: {{money .Deposits}}
+{{if .Reversals}}Reversals: {{money .Reversals}}
+{{end}}Payments: {{money .Payments}}
+Refunds: {{money .Refunds}}
+{{if .Adjustments}}Adjustments: {{money .Adjustments}}
+{{end}}{{if .Interest}}Interest: {{money .Interest}}
+{{end}}{{if .Splits}}Split bills: {{money .Splits}}
+{{end}}{{if .Categories}}
+Spent by category:
+{{range .Categories}}  {{.Category}}: {{money .Spent}} ({{.Payments}} payments, {{money .Refunded}} refunded)
+{{end}}{{end}}
+Closing balance: {{money .Closing}}
+`))
+
+// statementCSV has a row per line between the opening and closing balance
+// rows, followed by a total row per category.
+var statementCSV = template.Must(template.New("csv").Funcs(statementFuncs).Parse(
+	`{{csv "time" "kind" "payment_id" "category" "amount" "balance"}}
+{{csv (time .From) "opening" "" "" "" (money .Opening)}}
+{{range .Lines}}{{csv (time .Time) (print .Kind) .PaymentID (print .Category) (money .Amount) (money .Balance)}}
+{{end}}{{csv (time .To) "closing" "" "" "" (money .Closing)}}
+{{range .Categories}}{{csv "" "total" "" (print .Category) (money .Spent) ""}}
+{{end}}`))
+
+var statementHTML = htmltemplate.Must(htmltemplate.New("html").Funcs(statementFuncs).Parse(
+	`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Statement of account {{.AccountID}}</title></head>
+<body>
+<h1>Statement of account {{.AccountID}}</h1>
+<p>{{.Phone}}, {{date .From}} &ndash; {{date .To}}</p>
+<table>
+<thead><tr><th>Time</th><th>Kind</th><th>Category</th><th>Payment</th><th>Amount</th><th>Balance</th></tr></thead>
+<tbody>
+<tr><td>{{time .From}}</td><td colspan="4">Opening balance</td><td>{{money .Opening}}</td></tr>
+{{range .Lines}}<tr><td>{{time .Time}}</td><td>{{.Kind}}</td><td>{{.Category}}</td><td>{{.PaymentID}}</td><td>{{money .Amount}}</td><td>{{money .Balance}}</td></tr>
+{{end}}<tr><td>{{time .To}}</td><td colspan="4">Closing balance</td><td>{{money .Closing}}</td></tr>
+</tbody>
+</table>
+<p>Deposits: {{money .Deposits}}{{if .Reversals}}, reversals: {{money .Reversals}}{{end}}, payments: {{money .Payments}}, refunds: {{money .Refunds}}{{if .Adjustments}}, adjustments: {{money .Adjustments}}{{end}}{{if .Interest}}, interest: {{money .Interest}}{{end}}{{if .Splits}}, split bills: {{money .Splits}}{{end}}</p>
+{{if .Categories}}<table>
+<thead><tr><th>Category</th><th>Payments</th><th>Paid</th><th>Refunded</th><th>Spent</th></tr></thead>
+<tbody>
+{{range .Categories}}<tr><td>{{.Category}}</td><td>{{.Payments}}</td><td>{{money .Paid}}</td><td>{{money .Refunded}}</td><td>{{money .Spent}}</td></tr>
+{{end}}</tbody>
+</table>
+{{end}}</body>
+</html>
+`))
+
+func (st *Statement) WriteText(w io.Writer) error {
+	return statementText.Execute(w, st)
+}
+
+// WriteCSV writes the statement as RFC 4180 CSV.
+func (st *Statement) WriteCSV(w io.Writer) error {
+	return statementCSV.Execute(w, st)
+}
+
+func (st *Statement) WriteHTML(w io.Writer) error {
+	return statementHTML.Execute(w, st)
+}
+
+// csvRecord quotes fields the way encoding/csv does, without the line end.
+func csvRecord(fields ...string) (string, error) {
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	err := w.Write(fields)
+	if err != nil {
+		return "", err
+	}
+	w.Flush()
+	if err = w.Error(); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
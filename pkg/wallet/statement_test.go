@@ -0,0 +1,158 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/csv"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statementScenario makes an account with a deposit and a payment before
+// the period, and a deposit, two payments and a refund in it.
+func statementScenario(t *testing.T) (*testService, time.Time, time.Time) {
+	s := newTestService(withClock(time.Date(2024, 1, 20, 12, 0, 0, 0, time.UTC)))
+	s.addAccounts(t, 1_000, "+992000000001")
+	if _, err := s.Pay(1, 100, "auto"); err != nil {
+		t.Fatal(err)
+	}
+	*s.clock = time.Date(2024, 2, 1, 9, 0, 0, 0, time.UTC)
+	if err := s.Deposit(1, 500); err != nil {
+		t.Fatal(err)
+	}
+	*s.clock = s.clock.Add(time.Hour)
+	payment, err := s.Pay(1, 300, "food")
+	if err != nil {
+		t.Fatal(err)
+	}
+	*s.clock = s.clock.Add(time.Hour)
+	if _, err := s.Repeat(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+	*s.clock = s.clock.Add(time.Hour)
+	if err := s.Reject(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+	*s.clock = time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)
+	if _, err := s.Pay(1, 50, "auto"); err != nil {
+		t.Fatal(err)
+	}
+	return s, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func TestService_Statement(t *testing.T) {
+	s, from, to := statementScenario(t)
+	statement, err := s.Statement(1, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statement.Opening != 900 || statement.Closing != 1_100 {
+		t.Errorf("opening %d, closing %d", statement.Opening, statement.Closing)
+	}
+	balances := make([]types.Money, 0)
+	for _, line := range statement.Lines {
+		balances = append(balances, line.Balance)
+	}
+	if want := []types.Money{1_400, 1_100, 800, 1_100}; !reflect.DeepEqual(balances, want) {
+		t.Errorf("balances got: %v, want: %v", balances, want)
+	}
+	if statement.Deposits != 500 || statement.Payments != -600 || statement.Refunds != 300 {
+		t.Errorf("invalid totals: %+v", statement)
+	}
+	want := []CategoryTotal{{Category: "food", Payments: 2, Paid: 600, Refunded: 300, Spent: 300}}
+	if !reflect.DeepEqual(statement.Categories, want) {
+		t.Errorf("categories got: %+v, want: %+v", statement.Categories, want)
+	}
+}
+
+func TestService_Statement_errors(t *testing.T) {
+	s, from, to := statementScenario(t)
+	if _, err := s.Statement(1, to, from); err != ErrWrongPeriod {
+		t.Errorf("want: %v, got: %v", ErrWrongPeriod, err)
+	}
+	if _, err := s.Statement(2, from, to); err != ErrAccountNotFound {
+		t.Errorf("want: %v, got: %v", ErrAccountNotFound, err)
+	}
+}
+
+func TestAuthorized_Statement(t *testing.T) {
+	s, from, to := statementScenario(t)
+	owner := s.As(Principal{ID: "alice", Role: RoleCustomer, AccountID: 1})
+	if _, err := owner.Statement(1, from, to); err != nil {
+		t.Error(err)
+	}
+	if entries, err := owner.Ledger(1); err != nil || len(entries) != 7 {
+		t.Errorf("invalid ledger: %+v, %v", entries, err)
+	}
+	other := s.As(Principal{ID: "bob", Role: RoleCustomer, AccountID: 2})
+	if _, err := other.Statement(1, from, to); err != ErrPermissionDenied {
+		t.Errorf("want: %v, got: %v", ErrPermissionDenied, err)
+	}
+	if _, err := other.Ledger(1); err != ErrPermissionDenied {
+		t.Errorf("want: %v, got: %v", ErrPermissionDenied, err)
+	}
+	support := s.As(Principal{ID: "carol", Role: RoleSupport})
+	if _, err := support.Statement(1, from, to); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestService_Statement_ledgerPersisted(t *testing.T) {
+	for _, format := range []Format{FormatDump, FormatJSON, FormatCSV, FormatBinary} {
+		s, from, to := statementScenario(t)
+		dir := t.TempDir()
+		if err := s.ExportFormat(dir, format); err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		var got Service
+		if err := got.ImportFormat(dir, format); err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		want, _ := s.Statement(1, from, to)
+		statement, err := got.Statement(1, from, to)
+		if err != nil || !reflect.DeepEqual(statement, want) {
+			t.Errorf("format %d: got: %+v, %v, want: %+v", format, statement, err, want)
+		}
+	}
+}
+
+func TestStatement_render(t *testing.T) {
+	s, from, to := statementScenario(t)
+	s.accounts[0].Phone = `<b>"x",y</b>`
+	statement, err := s.Statement(1, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var text bytes.Buffer
+	if err := statement.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Opening balance: 900", "Closing balance: 1100", "food: 300"} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("text has no %q:\n%s", want, text.String())
+		}
+	}
+
+	var html bytes.Buffer
+	if err := statement.WriteHTML(&html); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(html.String(), "<b>") || strings.Count(html.String(), "<tr>") != 9 {
+		t.Errorf("invalid html:\n%s", html.String())
+	}
+
+	var data bytes.Buffer
+	if err := statement.WriteCSV(&data); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&data).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 8 || rows[1][1] != "opening" || rows[6][5] != "1100" || rows[7][3] != "food" {
+		t.Errorf("invalid csv: %q", rows)
+	}
+}
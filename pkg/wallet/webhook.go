@@ -0,0 +1,548 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrWebhookNotFound = errors.New("webhook not found")
+var ErrWrongWebhookURL = errors.New("wrong webhook url")
+var ErrDeliveryNotFound = errors.New("delivery not found")
+
+// Receivers check the signature header against HMAC-SHA256 of the timestamp
+// header, a dot and the body, keyed with the endpoint secret.
+const (
+	WebhookSignatureHeader = "X-Wallet-Signature"
+	WebhookTimestampHeader = "X-Wallet-Timestamp"
+	WebhookDeliveryHeader  = "X-Wallet-Delivery"
+)
+
+const (
+	defaultWebhookMaxAttempts = 8
+	defaultWebhookBaseDelay   = 30 * time.Second
+	defaultWebhookMaxDelay    = time.Hour
+	maxWebhookLog             = 1000
+	maxWebhookDead            = 1000
+)
+
+// WebhookEndpoint receives the payment events of an account or of some
+// categories. Zero AccountID and empty Categories match every payment.
+type WebhookEndpoint struct {
+	ID         string                  `json:"id"`
+	URL        string                  `json:"url"`
+	Secret     string                  `json:"secret"`
+	AccountID  int64                   `json:"account_id"`
+	Categories []types.PaymentCategory `json:"categories"`
+}
+
+func (e *WebhookEndpoint) match(payment types.Payment) bool {
+	if e.AccountID != 0 && e.AccountID != payment.AccountID {
+		return false
+	}
+	return len(e.Categories) == 0 || containsCategory(e.Categories, payment.Category)
+}
+
+// WebhookDelivery is a payload waiting in the queue or dead-lettered after
+// its last attempt failed.
+type WebhookDelivery struct {
+	ID          string          `json:"id"`
+	EndpointID  string          `json:"endpoint_id"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error"`
+}
+
+// WebhookAttempt is one entry of the delivery log.
+type WebhookAttempt struct {
+	DeliveryID string    `json:"delivery_id"`
+	EndpointID string    `json:"endpoint_id"`
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"status_code"`
+	Error      string    `json:"error"`
+}
+
+// WebhookPayload is the body posted to endpoints.
+type WebhookPayload struct {
+	ID      string        `json:"id"`
+	Type    string        `json:"type"`
+	Time    time.Time     `json:"time"`
+	Payment types.Payment `json:"payment"`
+}
+
+// Webhooks queues payment events for the registered endpoints and delivers
+// them with Deliver or Run. Endpoints, the queue, dead letters and the log
+// are saved to a file, so deliveries survive restarts. Endpoint changes are
+// saved right away, queued events with the next Deliver or Flush, so one
+// write covers every event queued in between.
+type Webhooks struct {
+	// MaxAttempts, BaseDelay and MaxDelay configure the retries: the n-th
+	// retry waits BaseDelay*2^(n-1), at most MaxDelay.
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Client      *http.Client
+	// Clock replaces time.Now, for tests.
+	Clock func() time.Time
+	// Logger defaults to slog.Default, secrets are redacted.
+	Logger *slog.Logger
+
+	filename  string
+	keys      KeyProvider
+	mu        sync.Mutex
+	deliverMu sync.Mutex
+	state     webhookState
+	// dirty is set when events were queued after the last save.
+	dirty bool
+}
+
+type webhookState struct {
+	Endpoints []*WebhookEndpoint `json:"endpoints"`
+	Queue     []*WebhookDelivery `json:"queue"`
+	Dead      []*WebhookDelivery `json:"dead"`
+	Log       []WebhookAttempt   `json:"log"`
+}
+
+// NewWebhooks loads the state saved in filename, if any.
+func NewWebhooks(filename string) (*Webhooks, error) {
+	return NewEncryptedWebhooks(filename, nil)
+}
+
+// NewEncryptedWebhooks is NewWebhooks with the state file, endpoint secrets
+// included, encrypted with keys. A plaintext state file is rejected, it is
+// migrated by loading it with NewWebhooks and calling SetKeyProvider.
+func NewEncryptedWebhooks(filename string, keys KeyProvider) (*Webhooks, error) {
+	w := &Webhooks{filename: filename, keys: keys}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return w, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err = unseal(keys, false, data)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &w.state)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// SetKeyProvider encrypts the state file with keys from now on and saves it
+// again, nil writes plaintext.
+func (w *Webhooks) SetKeyProvider(keys KeyProvider) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.keys = keys
+	return w.save()
+}
+
+func (w *Webhooks) Register(endpoint WebhookEndpoint) (*WebhookEndpoint, error) {
+	u, err := url.Parse(endpoint.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, ErrWrongWebhookURL
+	}
+	endpoint.ID = uuid.New().String()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.state.Endpoints = append(w.state.Endpoints, &endpoint)
+	return &endpoint, w.save()
+}
+
+// Unregister removes the endpoint, its queued and dead deliveries are
+// dropped.
+func (w *Webhooks) Unregister(endpointID string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	endpoints := make([]*WebhookEndpoint, 0, len(w.state.Endpoints))
+	for _, endpoint := range w.state.Endpoints {
+		if endpoint.ID != endpointID {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	if len(endpoints) == len(w.state.Endpoints) {
+		return ErrWebhookNotFound
+	}
+	w.state.Endpoints = endpoints
+	queue := make([]*WebhookDelivery, 0, len(w.state.Queue))
+	for _, delivery := range w.state.Queue {
+		if delivery.EndpointID != endpointID {
+			queue = append(queue, delivery)
+		}
+	}
+	w.state.Queue = queue
+	dead := make([]*WebhookDelivery, 0, len(w.state.Dead))
+	for _, delivery := range w.state.Dead {
+		if delivery.EndpointID != endpointID {
+			dead = append(dead, delivery)
+		}
+	}
+	w.state.Dead = dead
+	return w.save()
+}
+
+// Attach subscribes to the payment events of s. The returned function
+// detaches.
+func (w *Webhooks) Attach(s *Service) func() {
+	return s.Events().Subscribe(func(event Event) {
+		err := w.Enqueue(event)
+		if err != nil {
+			w.log().Error("webhook enqueue failed", "seq", event.Meta().Seq, "error", err)
+		}
+	})
+}
+
+// Enqueue queues event for every matching endpoint. Events other than
+// payment status changes are ignored.
+func (w *Webhooks) Enqueue(event Event) error {
+	var kind string
+	var payment types.Payment
+	switch e := event.(type) {
+	case PaymentCreated:
+		kind, payment = "payment.created", e.Payment
+	case PaymentRejected:
+		kind, payment = "payment.rejected", e.Payment
+	case PaymentApproved:
+		kind, payment = "payment.approved", e.Payment
+	case PaymentRepeated:
+		kind, payment = "payment.repeated", e.Payment
+	default:
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	queued := false
+	for _, endpoint := range w.state.Endpoints {
+		if !endpoint.match(payment) {
+			continue
+		}
+		id := uuid.New().String()
+		payload, err := json.Marshal(WebhookPayload{ID: id, Type: kind, Time: event.Meta().Time, Payment: payment})
+		if err != nil {
+			return err
+		}
+		w.state.Queue = append(w.state.Queue, &WebhookDelivery{
+			ID:          id,
+			EndpointID:  endpoint.ID,
+			Payload:     payload,
+			NextAttempt: w.now(),
+		})
+		queued = true
+	}
+	if queued {
+		w.dirty = true
+	}
+	return nil
+}
+
+// Flush saves the events queued since the last save.
+func (w *Webhooks) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.dirty {
+		return nil
+	}
+	return w.save()
+}
+
+// Deliver makes one attempt for every due delivery and returns how many
+// succeeded. Failed deliveries are retried later or dead-lettered, only the
+// last maxWebhookDead dead letters are kept.
+func (w *Webhooks) Deliver(ctx context.Context) (int, error) {
+	w.deliverMu.Lock()
+	defer w.deliverMu.Unlock()
+
+	type attempt struct {
+		delivery WebhookDelivery
+		endpoint WebhookEndpoint
+	}
+	w.mu.Lock()
+	now := w.now()
+	var due []attempt
+	for _, delivery := range w.state.Queue {
+		endpoint := w.endpoint(delivery.EndpointID)
+		if endpoint != nil && !delivery.NextAttempt.After(now) {
+			due = append(due, attempt{delivery: *delivery, endpoint: *endpoint})
+		}
+	}
+	w.mu.Unlock()
+
+	delivered := 0
+	results := make(map[string]WebhookAttempt, len(due))
+	for _, a := range due {
+		if err := ctx.Err(); err != nil {
+			break
+		}
+		result := w.post(ctx, a.endpoint, a.delivery)
+		if result.Error == "" {
+			delivered++
+		} else {
+			w.log().Warn("webhook attempt failed", "delivery", a.delivery.ID, "endpoint", a.endpoint.ID,
+				"attempt", a.delivery.Attempts+1, "error", result.Error)
+		}
+		results[a.delivery.ID] = result
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	queue := make([]*WebhookDelivery, 0, len(w.state.Queue))
+	for _, delivery := range w.state.Queue {
+		result, ok := results[delivery.ID]
+		if !ok {
+			queue = append(queue, delivery)
+			continue
+		}
+		w.state.Log = append(w.state.Log, result)
+		if result.Error == "" {
+			continue
+		}
+		delivery.Attempts++
+		delivery.LastError = result.Error
+		if delivery.Attempts >= w.maxAttempts() {
+			w.state.Dead = append(w.state.Dead, delivery)
+			continue
+		}
+		delivery.NextAttempt = result.Time.Add(w.backoff(delivery.Attempts))
+		queue = append(queue, delivery)
+	}
+	w.state.Queue = queue
+	if len(w.state.Log) > maxWebhookLog {
+		w.state.Log = append([]WebhookAttempt(nil), w.state.Log[len(w.state.Log)-maxWebhookLog:]...)
+	}
+	if len(w.state.Dead) > maxWebhookDead {
+		w.state.Dead = append([]*WebhookDelivery(nil), w.state.Dead[len(w.state.Dead)-maxWebhookDead:]...)
+	}
+	if len(results) == 0 && !w.dirty {
+		return 0, ctx.Err()
+	}
+	err := w.save()
+	if err != nil {
+		return delivered, err
+	}
+	return delivered, ctx.Err()
+}
+
+// Run calls Deliver every interval until ctx is canceled, then saves the
+// events queued since.
+func (w *Webhooks) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		_, err := w.Deliver(ctx)
+		if err != nil && ctx.Err() == nil {
+			w.log().Error("webhook delivery failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			err = w.Flush()
+			if err != nil {
+				w.log().Error("webhook save failed", "error", err)
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Redeliver moves a dead letter back to the queue with its attempts reset.
+// A dead letter of a removed endpoint is dropped with ErrWebhookNotFound.
+func (w *Webhooks) Redeliver(deliveryID string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i, delivery := range w.state.Dead {
+		if delivery.ID != deliveryID {
+			continue
+		}
+		w.state.Dead = append(w.state.Dead[:i:i], w.state.Dead[i+1:]...)
+		if w.endpoint(delivery.EndpointID) == nil {
+			err := w.save()
+			if err != nil {
+				return err
+			}
+			return ErrWebhookNotFound
+		}
+		delivery.Attempts = 0
+		delivery.NextAttempt = w.now()
+		w.state.Queue = append(w.state.Queue, delivery)
+		return w.save()
+	}
+	return ErrDeliveryNotFound
+}
+
+func (w *Webhooks) Endpoints() []WebhookEndpoint {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	endpoints := make([]WebhookEndpoint, 0, len(w.state.Endpoints))
+	for _, endpoint := range w.state.Endpoints {
+		endpoints = append(endpoints, *endpoint)
+	}
+	return endpoints
+}
+
+func (w *Webhooks) Pending() []WebhookDelivery {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return copyDeliveries(w.state.Queue)
+}
+
+func (w *Webhooks) DeadLetters() []WebhookDelivery {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return copyDeliveries(w.state.Dead)
+}
+
+// Log returns the last delivery attempts, oldest first.
+func (w *Webhooks) Log() []WebhookAttempt {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]WebhookAttempt(nil), w.state.Log...)
+}
+
+func (w *Webhooks) post(ctx context.Context, endpoint WebhookEndpoint, delivery WebhookDelivery) WebhookAttempt {
+	result := WebhookAttempt{DeliveryID: delivery.ID, EndpointID: endpoint.ID, Time: w.now()}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	timestamp := strconv.FormatInt(result.Time.Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WebhookDeliveryHeader, delivery.ID)
+	request.Header.Set(WebhookTimestampHeader, timestamp)
+	request.Header.Set(WebhookSignatureHeader, SignWebhook(endpoint.Secret, timestamp, delivery.Payload))
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer response.Body.Close()
+	_, _ = ioutil.ReadAll(response.Body)
+	result.StatusCode = response.StatusCode
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		result.Error = fmt.Sprintf("unexpected status %d", response.StatusCode)
+	}
+	return result
+}
+
+// SignWebhook returns the signature header value for a payload.
+func SignWebhook(secret string, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook checks a signature in constant time.
+func VerifyWebhook(secret string, timestamp string, payload []byte, signature string) bool {
+	return hmac.Equal([]byte(SignWebhook(secret, timestamp, payload)), []byte(signature))
+}
+
+func (w *Webhooks) endpoint(endpointID string) *WebhookEndpoint {
+	for _, endpoint := range w.state.Endpoints {
+		if endpoint.ID == endpointID {
+			return endpoint
+		}
+	}
+	return nil
+}
+
+func (w *Webhooks) backoff(attempts int) time.Duration {
+	base, max := w.BaseDelay, w.MaxDelay
+	if base <= 0 {
+		base = defaultWebhookBaseDelay
+	}
+	if max <= 0 {
+		max = defaultWebhookMaxDelay
+	}
+	delay := base
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		return max
+	}
+	return delay
+}
+
+func (w *Webhooks) maxAttempts() int {
+	if w.MaxAttempts > 0 {
+		return w.MaxAttempts
+	}
+	return defaultWebhookMaxAttempts
+}
+
+func (w *Webhooks) log() *slog.Logger {
+	logger := w.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return slog.New(NewRedactingHandler(logger.Handler()))
+}
+
+func (w *Webhooks) now() time.Time {
+	if w.Clock != nil {
+		return w.Clock()
+	}
+	return time.Now()
+}
+
+// save replaces the state file atomically. Without a file the state is
+// kept in memory only.
+func (w *Webhooks) save() error {
+	if w.filename == "" {
+		w.dirty = false
+		return nil
+	}
+	data, err := json.Marshal(&w.state)
+	if err != nil {
+		return err
+	}
+	data, err = seal(w.keys, data)
+	if err != nil {
+		return err
+	}
+	tmp := w.filename + ".tmp"
+	err = ioutil.WriteFile(tmp, data, dumpFileMode)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, w.filename)
+	if err != nil {
+		return err
+	}
+	w.dirty = false
+	return nil
+}
+
+func copyDeliveries(deliveries []*WebhookDelivery) []WebhookDelivery {
+	result := make([]WebhookDelivery, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		result = append(result, *delivery)
+	}
+	return result
+}
@@ -0,0 +1,363 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/rustamfozilov/wallet/pkg/types"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type webhookReceiver struct {
+	mu       sync.Mutex
+	fail     int
+	payloads []WebhookPayload
+	invalid  int
+}
+
+func (r *webhookReceiver) handler(secret string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		body, _ := ioutil.ReadAll(req.Body)
+		if !VerifyWebhook(secret, req.Header.Get(WebhookTimestampHeader), body, req.Header.Get(WebhookSignatureHeader)) {
+			r.invalid++
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.fail > 0 {
+			r.fail--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var payload WebhookPayload
+		_ = json.Unmarshal(body, &payload)
+		r.payloads = append(r.payloads, payload)
+	}
+}
+
+func TestWebhooks_deliver(t *testing.T) {
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver.handler("secret"))
+	defer server.Close()
+
+	s := newTestService()
+	account, err := s.addAccountWithBalance("123", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountID := account.ID
+	webhooks, err := NewWebhooks(path.Join(t.TempDir(), "webhooks.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := webhooks.Register(WebhookEndpoint{URL: server.URL, Secret: "secret", Categories: []types.PaymentCategory{"auto"}}); err != nil {
+		t.Fatal(err)
+	}
+	detach := webhooks.Attach(s.Service)
+	defer detach()
+
+	payment, err := s.Pay(accountID, 100, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Pay(accountID, 100, "food"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reject(payment.ID); err != nil {
+		t.Fatal(err)
+	}
+	delivered, err := webhooks.Deliver(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivered != 2 || len(receiver.payloads) != 2 || receiver.invalid != 0 {
+		t.Fatalf("delivered %d: %+v", delivered, receiver.payloads)
+	}
+	if receiver.payloads[0].Type != "payment.created" || receiver.payloads[1].Type != "payment.rejected" ||
+		receiver.payloads[1].Payment.ID != payment.ID {
+		t.Errorf("invalid payloads: %+v", receiver.payloads)
+	}
+	if len(webhooks.Pending()) != 0 || len(webhooks.Log()) != 2 {
+		t.Errorf("invalid state: %v, %v", webhooks.Pending(), webhooks.Log())
+	}
+}
+
+func TestWebhooks_retries(t *testing.T) {
+	receiver := &webhookReceiver{fail: 2}
+	server := httptest.NewServer(receiver.handler("secret"))
+	defer server.Close()
+
+	now := time.Unix(1700000000, 0)
+	filename := path.Join(t.TempDir(), "webhooks.json")
+	webhooks, err := NewWebhooks(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks.Clock = func() time.Time { return now }
+	webhooks.BaseDelay = time.Minute
+	if _, err := webhooks.Register(WebhookEndpoint{URL: server.URL, Secret: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestService()
+	account, err := s.addAccountWithBalance("123", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountID := account.ID
+	webhooks.Attach(s.Service)
+	if _, err := s.Pay(accountID, 100, "auto"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, step := range []struct {
+		after     time.Duration
+		delivered int
+		attempts  int
+	}{
+		{0, 0, 1},
+		{30 * time.Second, 0, 1},
+		{30 * time.Second, 0, 2},
+		{time.Minute, 0, 2},
+		{time.Minute, 1, 2},
+	} {
+		now = now.Add(step.after)
+		delivered, err := webhooks.Deliver(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if delivered != step.delivered {
+			t.Errorf("at %v: got: %d, want: %d", now, delivered, step.delivered)
+		}
+		if pending := webhooks.Pending(); step.delivered == 0 && (len(pending) != 1 || pending[0].Attempts != step.attempts) {
+			t.Errorf("at %v: invalid queue: %+v", now, pending)
+		}
+	}
+
+	// The queue and the log survive a restart.
+	restored, err := NewWebhooks(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.Pending()) != 0 || len(restored.Log()) != 3 || len(restored.Endpoints()) != 1 {
+		t.Errorf("invalid restored state: %+v", restored.state)
+	}
+}
+
+func TestWebhooks_encrypted(t *testing.T) {
+	filename := path.Join(t.TempDir(), "webhooks.json")
+	webhooks, err := NewWebhooks(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := webhooks.Register(WebhookEndpoint{URL: "https://example.com/hook", Secret: "top-secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewEncryptedWebhooks(filename, newTestKeyring()); err != ErrNotEncrypted {
+		t.Errorf("want: %v, got: %v", ErrNotEncrypted, err)
+	}
+	if err := webhooks.SetKeyProvider(newTestKeyring()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("top-secret")) {
+		t.Error("secret saved in plaintext")
+	}
+	restored, err := NewEncryptedWebhooks(filename, newTestKeyring())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoints := restored.Endpoints(); len(endpoints) != 1 || endpoints[0].Secret != "top-secret" {
+		t.Errorf("invalid endpoints: %+v", endpoints)
+	}
+	if _, err := NewWebhooks(filename); err != ErrNoKeyProvider {
+		t.Errorf("want: %v, got: %v", ErrNoKeyProvider, err)
+	}
+}
+
+func TestWebhooks_deadLetter(t *testing.T) {
+	receiver := &webhookReceiver{fail: 100}
+	server := httptest.NewServer(receiver.handler("secret"))
+	defer server.Close()
+
+	now := time.Unix(1700000000, 0)
+	filename := path.Join(t.TempDir(), "webhooks.json")
+	webhooks, err := NewWebhooks(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks.Clock = func() time.Time { return now }
+	webhooks.MaxAttempts = 3
+	if _, err := webhooks.Register(WebhookEndpoint{URL: server.URL, Secret: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestService()
+	account, err := s.addAccountWithBalance("123", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountID := account.ID
+	webhooks.Attach(s.Service)
+	if _, err := s.Pay(accountID, 100, "auto"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := webhooks.Deliver(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(defaultWebhookMaxDelay)
+	}
+	restored, err := NewWebhooks(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := restored.DeadLetters()
+	if len(restored.Pending()) != 0 || len(dead) != 1 || dead[0].Attempts != 3 || dead[0].LastError == "" {
+		t.Fatalf("invalid dead letters: %+v", dead)
+	}
+
+	receiver.fail = 0
+	if err := webhooks.Redeliver(dead[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if delivered, err := webhooks.Deliver(context.Background()); err != nil || delivered != 1 {
+		t.Errorf("redelivery: %d, %v", delivered, err)
+	}
+	if err := webhooks.Redeliver(dead[0].ID); err != ErrDeliveryNotFound {
+		t.Errorf("want: %v, got: %v", ErrDeliveryNotFound, err)
+	}
+}
+
+func TestWebhooks_signature(t *testing.T) {
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver.handler("other secret"))
+	defer server.Close()
+
+	webhooks, err := NewWebhooks("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks.MaxAttempts = 1
+	if _, err := webhooks.Register(WebhookEndpoint{URL: server.URL, Secret: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := webhooks.Register(WebhookEndpoint{URL: "ftp://example.com"}); err != ErrWrongWebhookURL {
+		t.Errorf("want: %v, got: %v", ErrWrongWebhookURL, err)
+	}
+	s := newTestService()
+	account, err := s.addAccountWithBalance("123", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountID := account.ID
+	webhooks.Attach(s.Service)
+	if _, err := s.Pay(accountID, 100, "auto"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := webhooks.Deliver(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if receiver.invalid != 1 || len(webhooks.DeadLetters()) != 1 {
+		t.Errorf("wrong signature was accepted: %d, %v", receiver.invalid, webhooks.DeadLetters())
+	}
+}
+
+func TestWebhooks_batchedSave(t *testing.T) {
+	filename := path.Join(t.TempDir(), "webhooks.json")
+	webhooks, err := NewWebhooks(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := webhooks.Register(WebhookEndpoint{URL: "https://example.com/hook", Secret: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestService()
+	s.addAccounts(t, 1000, "123")
+	webhooks.Attach(s.Service)
+	for i := 0; i < 3; i++ {
+		if _, err := s.Pay(1, 100, "auto"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	restored, err := NewWebhooks(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.Pending()) != 0 {
+		t.Errorf("events saved before flush: %v", restored.Pending())
+	}
+	if err := webhooks.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	restored, err = NewWebhooks(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.Pending()) != 3 {
+		t.Errorf("invalid restored queue: %v", restored.Pending())
+	}
+}
+
+func TestWebhooks_deadLetterLimit(t *testing.T) {
+	receiver := &webhookReceiver{fail: 100}
+	server := httptest.NewServer(receiver.handler("secret"))
+	defer server.Close()
+
+	webhooks, err := NewWebhooks("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks.MaxAttempts = 1
+	endpoint, err := webhooks.Register(WebhookEndpoint{URL: server.URL, Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxWebhookDead; i++ {
+		webhooks.state.Dead = append(webhooks.state.Dead, &WebhookDelivery{ID: strconv.Itoa(i), EndpointID: endpoint.ID})
+	}
+	s := newTestService()
+	s.addAccounts(t, 1000, "123")
+	webhooks.Attach(s.Service)
+	if _, err := s.Pay(1, 100, "auto"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := webhooks.Deliver(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	dead := webhooks.DeadLetters()
+	if len(dead) != maxWebhookDead || dead[0].ID != "1" || dead[len(dead)-1].Attempts != 1 {
+		t.Errorf("invalid dead letters: %d, first %q", len(dead), dead[0].ID)
+	}
+
+	if err := webhooks.Unregister(endpoint.ID); err != nil {
+		t.Fatal(err)
+	}
+	if len(webhooks.DeadLetters()) != 0 {
+		t.Errorf("dead letters of a removed endpoint kept: %d", len(webhooks.DeadLetters()))
+	}
+}
+
+func TestWebhooks_Redeliver_removedEndpoint(t *testing.T) {
+	webhooks, err := NewWebhooks("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks.state.Dead = append(webhooks.state.Dead, &WebhookDelivery{ID: "d1", EndpointID: "removed"})
+	if err := webhooks.Redeliver("d1"); err != ErrWebhookNotFound {
+		t.Errorf("want: %v, got: %v", ErrWebhookNotFound, err)
+	}
+	if len(webhooks.Pending()) != 0 || len(webhooks.DeadLetters()) != 0 {
+		t.Errorf("delivery of a removed endpoint kept: %v, %v", webhooks.Pending(), webhooks.DeadLetters())
+	}
+}